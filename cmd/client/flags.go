@@ -0,0 +1,26 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// mapFlag collects repeated key=value flags.
+type mapFlag map[string]string
+
+func (m mapFlag) String() string {
+	var sa []string
+	for k, v := range m {
+		sa = append(sa, k+"="+v)
+	}
+	return strings.Join(sa, ",")
+}
+
+func (m mapFlag) Set(s string) error {
+	kv := strings.SplitN(s, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("expected key=value: %q", s)
+	}
+	m[kv[0]] = kv[1]
+	return nil
+}
@@ -1,170 +1,311 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"flag"
 	"fmt"
-	"github.com/go-resty/resty/v2"
-	"github.com/gostones/s3upload/internal"
-	. "github.com/gostones/s3upload/internal/types"
-	"net/http"
-	"strconv"
-)
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strings"
+	"syscall"
 
-type MultipartUploader struct {
-	c  *resty.Client
-	fc *internal.FileChunk
+	"github.com/gostones/s3upload/pkg/uploader"
+)
 
-	uploadID string
-}
+func main() {
+	var baseURL = flag.String("url", "http://localhost:4000", "upload server url")
+	var chunksize = flag.Int64("chunk", uploader.DefaultChunkSize, "chunk size in bytes")
+	var limit = flag.Int64("limit", 0, "bandwidth limit in bytes/sec, 0 for unlimited")
+	var schedule = flag.String("schedule", "", "bandwidth schedule overriding -limit, e.g. 22:00-06:00=0,09:00-18:00=1048576")
+	var key = flag.String("key", "", "object key, default to the file name")
+	var abort = flag.Bool("abort", false, "abort the upload on interrupt instead of saving a checkpoint")
+	var user = flag.String("user", os.Getenv("USER"), "uploader name recorded in the audit trail")
+	var storageClass = flag.String("storage-class", "", "storage class of the object, e.g. STANDARD_IA")
+	var cacheControl = flag.String("cache-control", "", "Cache-Control of the object")
+	var contentDisposition = flag.String("content-disposition", "", "Content-Disposition of the object")
+	var contentEncoding = flag.String("content-encoding", "", "Content-Encoding of the object")
+	var meta = mapFlag{}
+	flag.Var(meta, "meta", "user metadata key=value, may be repeated")
+	var tags = mapFlag{}
+	flag.Var(tags, "tag", "object tag key=value, may be repeated")
+	var sse = flag.String("sse", "", "server-side encryption, AES256 or aws:kms, default to the server setting")
+	var sseKeyFile = flag.String("sse-c-key-file", "", "file with the 256-bit customer key (SSE-C), raw or base64 encoded")
+	var encryptKeyFile = flag.String("encrypt-key-file", "", "file with the 256-bit key to encrypt the parts on the client, raw or base64 encoded")
+	var passphraseFile = flag.String("encrypt-passphrase-file", "", "file with the passphrase to encrypt the parts on the client")
+	var decryptURL = flag.String("decrypt-url", "", "download and decrypt the object at the url into the file instead of uploading")
+	var compression = flag.String("compress", "", "compress the content before upload, gzip or zstd")
+	var checksum = flag.String("checksum", "", "S3 checksum of the parts, SHA256, SHA1, CRC32 or CRC32C")
+	var digests = flag.String("digest", "", "whole-file digests stored in the metadata, e.g. SHA256,CRC32C")
+	var digestWorkers = flag.Int("digest-workers", 0, "hash the chunks concurrently for -digest, MD5 and SHA digests are then composite")
+	var readMode = flag.String("read-mode", "", "how the file is read, mmap or readahead, default to ReadAt")
+	var checkParts = flag.Bool("check-each-part", false, "check the file was not modified after each part, not only before completing")
+	var restarts = flag.Int("restarts", 0, "restart the upload up to n times if the file is modified while uploading")
+	var offset = flag.Int64("offset", 0, "upload the file from the offset")
+	var length = flag.Int64("length", -1, "upload length bytes of the file, -1 for the rest")
+	var downloadKey = flag.Bool("download", false, "download the object -key into the file instead of uploading, resuming from its journal")
+	var workers = flag.Int("workers", uploader.DefaultDownloadWorkers, "ranges of -chunk bytes downloaded concurrently")
+	var retries = flag.Int("retries", 3, "retries of a failed range download")
+	var compose = flag.Bool("compose", false, "create the object from the args in order, s3:<key> copies an object of the bucket, others upload files")
+	var checkpoint = flag.String("checkpoint", "", "file to save the progress to on interrupt and resume from")
+	flag.Parse()
 
-func NewMultipartUploader(baseURL string, filename string, chunksize int64) *MultipartUploader {
-	return &MultipartUploader{
-		c:  resty.New().SetHostURL(baseURL),
-		fc: internal.NewFileChunk(filename, chunksize),
+	var filename = "local/35MBb.raw"
+	if flag.NArg() > 0 {
+		filename = flag.Arg(0)
 	}
-}
 
-// startUpload obtains an uploadId generated in the backend
-// server by the AWS S3 SDK. This uploadId will be used subsequently for uploading
-// the individual chunks of the selectedFile.
-func (r *MultipartUploader) startUpload() error {
-	if err := r.fc.Open(); err != nil {
-		return err
-	}
+	opts := uploader.Options{
+		BaseURL:   *baseURL,
+		ChunkSize: *chunksize,
+		User:      *user,
 
-	var result StartUploadResponse
-	if resp, err := r.c.R().
-		SetQueryParams(map[string]string{
-			"fileName": r.fc.Name(),
-			"fileType": r.fc.ContentType(),
-		}).
-		SetHeader("Accept", "application/json").
-		SetResult(&result).
-		Get("/start-upload"); err != nil || resp.StatusCode() != http.StatusOK {
-		return fmt.Errorf("%v %v %v", resp.StatusCode(), resp, err)
-	}
+		StorageClass:       *storageClass,
+		CacheControl:       *cacheControl,
+		ContentDisposition: *contentDisposition,
+		ContentEncoding:    *contentEncoding,
+		Metadata:           meta,
+		Tags:               tags,
 
-	r.uploadID = result.UploadID
-	fmt.Printf("response: %v\n", result)
+		ServerSideEncryption: *sse,
+		Compression:          *compression,
+		ChecksumAlgorithm:    *checksum,
+		ReadMode:             *readMode,
+		CheckSourcePerPart:   *checkParts,
+		SourceRestarts:       *restarts,
+		DownloadWorkers:      *workers,
+		DownloadRetries:      *retries,
 
-	if err := r.uploadMultipartFile(); err != nil {
-		return err
+		Progress: func(sent, total int64) {
+			fmt.Printf("\rprogress: %v/%v", sent, total)
+		},
+		Logf: func(format string, args ...interface{}) {
+			fmt.Printf(format+"\n", args...)
+		},
 	}
-	return nil
-}
 
-// uploadMultipartFile function splits the selectedFile into chunks
-// and does the following:
-// (1) call the backend server for a presigned url for each part,
-// (2) uploads them, and
-// (3) upon completion of all responses, sends a completeMultipartUpload call to the backend server.
-func (r *MultipartUploader) uploadMultipartFile() error {
-	var filename = r.fc.Name()
-	var parts = make([]CompleteUploadPart, r.fc.Chunk())
-
-	fn := func(idx int, reader *internal.ChunkReader) error {
-		partNo := idx + 1
-
-		// (1) Generate presigned URL for each part
-		var getUploadURLResp GetUploadURLResponse
-		md5, _, _ := reader.MD5()
-		if _, err := r.c.R().
-			SetQueryParams(map[string]string{
-				"fileName":   filename,
-				"partNumber": strconv.Itoa(partNo),
-				"uploadId":   r.uploadID,
-				"md5":        md5,
-			}).
-			SetHeader("Accept", "application/json").
-			SetResult(&getUploadURLResp).
-			Get("/get-upload-url"); err != nil {
-			return err
+	if *limit > 0 || *schedule != "" {
+		l := uploader.NewRateLimiter(*limit)
+		if *schedule != "" {
+			s, err := uploader.ParseSchedule(*schedule)
+			if err != nil {
+				fmt.Println(err)
+				os.Exit(1)
+			}
+			l.SetSchedule(s)
 		}
-
-		presignedURL := getUploadURLResp.PresignedURL
-		fmt.Printf("chunk: %v contentType: %v Presigned URL: %v\n", idx, r.fc.ContentType(), presignedURL)
-
-		// (2) Puts each file part into the storage server
-		uploadReq, err := http.NewRequest("PUT", presignedURL, reader)
+		handleLimitSignals(l)
+		opts.Limiter = l
+	}
+	opts.AbortOnCancel = *abort
+	if *digests != "" {
+		opts.Checksums = strings.Split(*digests, ",")
+		opts.DigestWorkers = *digestWorkers
+	}
+	if *sseKeyFile != "" {
+		k, err := readKeyFile(*sseKeyFile)
 		if err != nil {
-			return err
+			fmt.Println(err)
+			os.Exit(1)
 		}
+		opts.SSECustomerKey = k
+	}
+	switch {
+	case *encryptKeyFile != "":
+		b, err := readKeyFile(*encryptKeyFile)
+		if err == nil {
+			opts.EncryptionKey, err = uploader.NewEncryptionKey(b)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+	case *passphraseFile != "":
+		b, err := ioutil.ReadFile(*passphraseFile)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		opts.EncryptionKey = uploader.PassphraseKey(string(bytes.TrimRight(b, "\r\n")))
+	}
 
-		uploadReq.Header.Set("Content-Type", r.fc.ContentType())
-		uploadReq.Header.Set("Accept", "application/json")
-
-		// b64, _, err := reader.MD5()
-		// if err != nil {
-		// 	return err
-		// }
-		// uploadReq.Header.Set("Content-MD5", b64)
+	// cancel the upload on Ctrl-C or SIGTERM
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-sig
+		fmt.Println("\ncanceling upload")
+		cancel()
+	}()
 
-		uploadReq.ContentLength = reader.Size()
+	if *decryptURL != "" {
+		if err := download(ctx, uploader.New(opts), *decryptURL, filename); err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("decrypted: %v\n", filename)
+		return
+	}
 
-		fmt.Println("request:", uploadReq)
-		uploadResp, err := http.DefaultClient.Do(uploadReq)
-		//fmt.Println(uploadResp)
+	if *key == "" {
+		*key = filepath.Base(filename)
+	}
+	if *downloadKey {
+		result, err := uploader.New(opts).Download(ctx, *key, filename)
 		if err != nil {
-			return err
+			fmt.Println(err)
+			os.Exit(1)
 		}
-
-		if uploadResp.StatusCode != http.StatusOK {
-			return fmt.Errorf("part: %v %v", partNo, uploadResp)
+		fmt.Printf("\ndownloaded: %+v\n", *result)
+		return
+	}
+	if *compose {
+		var parts []uploader.ComposePart
+		for _, arg := range append([]string{filename}, flag.Args()[1:]...) {
+			if strings.HasPrefix(arg, "s3:") {
+				parts = append(parts, uploader.ComposePart{Source: strings.TrimPrefix(arg, "s3:"), Length: -1})
+			} else {
+				parts = append(parts, uploader.ComposePart{File: &uploader.Range{Filename: arg, Length: -1}})
+			}
 		}
-		etag := uploadResp.Header.Get("ETag")
-
-		parts[idx] = CompleteUploadPart{
-			ETag:       etag,
-			PartNumber: int64(partNo),
+		result, err := uploader.New(opts).Compose(ctx, *key, parts...)
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
 		}
-		return nil
+		fmt.Printf("\ncomposed: %+v\n", *result)
+		return
 	}
+	// the files are concatenated, each from the offset
+	var ranges []uploader.Range
+	for _, name := range append([]string{filename}, flag.Args()[1:]...) {
+		ranges = append(ranges, uploader.Range{Filename: name, Offset: *offset, Length: *length})
+	}
+	result, err := upload(ctx, uploader.New(opts), ranges, *key, *checkpoint)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Printf("\nuploaded: %+v\n", *result)
+}
 
-	// TODO retry?
-	errs := r.fc.Map(fn)
-	fmt.Println("errors:", errs)
-	if err := checkError(errs); err != nil {
-		return err
+// upload uploads the ranges of files, resuming from the checkpoint file if
+// it exists and saving the checkpoint there if the upload is canceled.
+func upload(ctx context.Context, u *uploader.Uploader, ranges []uploader.Range, key, checkpoint string) (*uploader.Result, error) {
+	cp, err := loadCheckpoint(checkpoint)
+	if err != nil {
+		return nil, err
+	}
+	resume := cp != nil && cp.Key == key
+	if resume {
+		fmt.Printf("resuming upload: %v parts done\n", len(cp.Parts))
 	}
 
-	// (3) Calls the CompleteMultipartUpload endpoint in the backend server
-	completeUploadReq := CompleteUploadRequest{
-		Params: CompleteUploadParams{
-			FileName: filename,
-			Parts:    parts,
-			UploadID: r.uploadID,
-		},
+	var result *uploader.Result
+	switch {
+	case len(ranges) == 1 && ranges[0].Offset == 0 && ranges[0].Length < 0:
+		// a whole file can be restarted if modified
+		result, err = uploadFile(ctx, u, ranges[0].Filename, key, cp, resume)
+	case resume:
+		result, err = u.ResumeRanges(ctx, cp, ranges...)
+	default:
+		result, err = u.UploadRanges(ctx, key, ranges...)
 	}
 
-	var completeUploadResp CompleteUploadResponse
-	if _, err := r.c.R().
-		SetBody(completeUploadReq).
-		SetHeader("Accept", "application/json").
-		SetResult(&completeUploadResp).
-		Post("/complete-upload"); err != nil {
-		return err
+	if ce, ok := err.(*uploader.CanceledError); ok && checkpoint != "" {
+		if ce.Checkpoint == nil {
+			os.Remove(checkpoint)
+		} else if serr := saveCheckpoint(checkpoint, ce.Checkpoint); serr != nil {
+			fmt.Println("can't save checkpoint:", serr)
+		} else {
+			fmt.Println("checkpoint saved:", checkpoint)
+		}
 	}
+	if err == nil && checkpoint != "" {
+		os.Remove(checkpoint)
+	}
+	return result, err
+}
 
-	fmt.Println(completeUploadResp)
-	return nil
+func uploadFile(ctx context.Context, u *uploader.Uploader, filename, key string, cp *uploader.Checkpoint, resume bool) (*uploader.Result, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if resume {
+		return u.Resume(ctx, f, fi.Size(), cp)
+	}
+	return u.Upload(ctx, f, fi.Size(), key)
 }
 
-func checkError(errs []error) error {
-	var sa []string
-	for _, err := range errs {
-		if err != nil {
-			sa = append(sa, err.Error())
-		}
+// download decrypts the object at url into the file. The file is written
+// only once the whole object is authenticated.
+func download(ctx context.Context, u *uploader.Uploader, url, filename string) error {
+	tmp := filename + ".part"
+	f, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
 	}
-	if len(sa) > 0 {
-		return fmt.Errorf("%v", sa)
+	err = u.DownloadDecrypted(ctx, url, f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
 	}
-	return nil
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, filename)
 }
 
-func main() {
-	var chunksize int64 = 10000000 // 10MB
-	var filename = "local/35MBb.raw"
+func loadCheckpoint(filename string) (*uploader.Checkpoint, error) {
+	if filename == "" {
+		return nil, nil
+	}
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var cp uploader.Checkpoint
+	if err := json.Unmarshal(b, &cp); err != nil {
+		return nil, err
+	}
+	return &cp, nil
+}
+
+func saveCheckpoint(filename string, cp *uploader.Checkpoint) error {
+	b, err := json.MarshalIndent(cp, "", "  ")
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(filename, b, 0600)
+}
 
-	mpu := NewMultipartUploader("http://localhost:4000", filename, chunksize)
-	mpu.startUpload()
+// readKeyFile reads a 256-bit key stored raw or base64 encoded.
+func readKeyFile(filename string) ([]byte, error) {
+	b, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(b) == 32 {
+		return b, nil
+	}
+	k, err := base64.StdEncoding.DecodeString(string(bytes.TrimSpace(b)))
+	if err != nil || len(k) != 32 {
+		return nil, fmt.Errorf("%s: not a 256-bit key", filename)
+	}
+	return k, nil
 }
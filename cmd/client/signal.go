@@ -0,0 +1,39 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/gostones/s3upload/pkg/uploader"
+)
+
+// handleLimitSignals adjusts the bandwidth limit at runtime:
+// SIGUSR1 halves the rate, SIGUSR2 doubles it and SIGHUP restores the initial rate.
+// An unlimited rate stays unlimited.
+func handleLimitSignals(l *uploader.RateLimiter) {
+	initial := l.Rate()
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGUSR1, syscall.SIGUSR2, syscall.SIGHUP)
+	go func() {
+		for s := range sig {
+			rate := l.Rate()
+			switch s {
+			case syscall.SIGUSR1:
+				if rate > 1 {
+					rate /= 2
+				}
+			case syscall.SIGUSR2:
+				rate *= 2
+			case syscall.SIGHUP:
+				rate = initial
+			}
+			l.SetRate(rate)
+			fmt.Printf("bandwidth limit: %v bytes/sec\n", rate)
+		}
+	}()
+}
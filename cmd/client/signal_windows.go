@@ -0,0 +1,8 @@
+package main
+
+import (
+	"github.com/gostones/s3upload/pkg/uploader"
+)
+
+// handleLimitSignals is a no-op, there are no user signals on windows.
+func handleLimitSignals(l *uploader.RateLimiter) {}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gostones/s3upload/internal"
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+func parseStartUploadRequest(r *http.Request) (*StartUploadRequest, error) {
+	if r.Method == http.MethodPost {
+		var req StartUploadRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			return nil, badRequest(fmt.Sprintf("invalid request body: %v", err))
+		}
+		if req.FileSize < 0 {
+			return nil, badRequest("fileSize must be a non negative integer")
+		}
+		return &req, validateStartUploadRequest(&req)
+	}
+
+	q := r.URL.Query()
+	req := &StartUploadRequest{
+		FileName:             q.Get("fileName"),
+		FileType:             q.Get("fileType"),
+		CacheControl:         q.Get("cacheControl"),
+		ContentDisposition:   q.Get("contentDisposition"),
+		ContentEncoding:      q.Get("contentEncoding"),
+		StorageClass:         q.Get("storageClass"),
+		ServerSideEncryption: q.Get("serverSideEncryption"),
+		ChecksumAlgorithm:    q.Get("checksumAlgorithm"),
+	}
+	if v := q.Get("fileSize"); v != "" {
+		size, err := strconv.ParseInt(v, 10, 64)
+		if err != nil || size < 0 {
+			return nil, badRequest("fileSize must be a non negative integer")
+		}
+		req.FileSize = size
+	}
+	return req, validateStartUploadRequest(req)
+}
+
+func validateStartUploadRequest(req *StartUploadRequest) error {
+	if req.FileName == "" {
+		return badRequest("fileName is required")
+	}
+	if req.ChecksumAlgorithm != "" {
+		if _, err := checksumSize(req.ChecksumAlgorithm); err != nil {
+			return err
+		}
+	}
+	return uploadPolicy.validate(req)
+}
+
+func writeStartUploadResponse(w http.ResponseWriter, uploadId string) {
+	writeJSON(w, &StartUploadResponse{
+		UploadID: uploadId,
+	})
+}
+
+func parseGetUploadRequest(r *http.Request) (*GetUploadURLRequest, error) {
+	q := r.URL.Query()
+	req := &GetUploadURLRequest{
+		FileName:   q.Get("fileName"),
+		PartNumber: q.Get("partNumber"),
+		UploadID:   q.Get("uploadId"),
+		MD5:        q.Get("md5"),
+
+		ChecksumAlgorithm: q.Get("checksumAlgorithm"),
+		Checksum:          q.Get("checksum"),
+	}
+	if req.FileName == "" || req.UploadID == "" {
+		return nil, badRequest("fileName and uploadId are required")
+	}
+	if err := validatePartNumber(req.PartNumber); err != nil {
+		return nil, err
+	}
+	if req.MD5 != "" {
+		if _, err := base64.StdEncoding.DecodeString(req.MD5); err != nil {
+			return nil, badRequest("md5 is not base64 encoded")
+		}
+	}
+	if req.ChecksumAlgorithm != "" || req.Checksum != "" {
+		if err := validateChecksum(req.ChecksumAlgorithm, req.Checksum); err != nil {
+			return nil, err
+		}
+	}
+	return req, nil
+}
+
+// checksumSize returns the digest size of the S3 checksum algorithm.
+func checksumSize(alg string) (int, error) {
+	if alg == internal.ChecksumMD5 {
+		return 0, badRequest("MD5 is set as md5, not as checksumAlgorithm")
+	}
+	h, err := internal.NewHash(alg)
+	if err != nil {
+		return 0, badRequest(err.Error())
+	}
+	return h.Size(), nil
+}
+
+// validateChecksum checks the base64 coded checksum is a digest of the algorithm.
+func validateChecksum(alg, checksum string) error {
+	size, err := checksumSize(alg)
+	if err != nil {
+		return err
+	}
+	b, err := base64.StdEncoding.DecodeString(checksum)
+	if err != nil || len(b) != size {
+		return badRequest(fmt.Sprintf("checksum is not a base64 coded %s digest", alg))
+	}
+	return nil
+}
+
+func validatePartNumber(s string) error {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 1 || n > maxPartNumber {
+		return badRequest(fmt.Sprintf("partNumber must be between 1 and %v", maxPartNumber))
+	}
+	return nil
+}
+
+func writeGetUploadResponse(w http.ResponseWriter, pURL string, signed http.Header) {
+	writeJSON(w, &GetUploadURLResponse{
+		PresignedURL: pURL,
+		Headers:      signedHeaders(signed),
+	})
+}
+
+// signedHeaders returns the signed headers the client must send, nil if none.
+func signedHeaders(signed http.Header) map[string]string {
+	var headers map[string]string
+	for k := range signed {
+		if headers == nil {
+			headers = make(map[string]string)
+		}
+		headers[http.CanonicalHeaderKey(k)] = signed.Get(k)
+	}
+	return headers
+}
+
+func parseGetDownloadRequest(r *http.Request) (*GetDownloadURLRequest, error) {
+	q := r.URL.Query()
+	req := &GetDownloadURLRequest{
+		FileName: q.Get("fileName"),
+		Range:    q.Get("range"),
+		IfMatch:  q.Get("ifMatch"),
+	}
+	if req.FileName == "" {
+		return nil, badRequest("fileName is required")
+	}
+	if req.Range != "" {
+		if err := validateRange(req.Range); err != nil {
+			return nil, err
+		}
+	}
+	return req, uploadPolicy.validateDownload(req.FileName)
+}
+
+func parseCompleteUploadRequest(r *http.Request) (*CompleteUploadRequest, error) {
+	var j CompleteUploadRequest
+	decoder := json.NewDecoder(r.Body)
+	err := decoder.Decode(&j)
+	if err != nil {
+		return nil, badRequest(fmt.Sprintf("invalid request body: %v", err))
+	}
+	p := j.Params
+	if p.FileName == "" || p.UploadID == "" {
+		return nil, badRequest("fileName and uploadId are required")
+	}
+	if len(p.Parts) == 0 {
+		return nil, badRequest("parts are required")
+	}
+	for _, part := range p.Parts {
+		if part.ETag == "" || part.PartNumber < 1 || part.PartNumber > maxPartNumber {
+			return nil, badRequest(fmt.Sprintf("invalid part: %v", part))
+		}
+		if p.ChecksumAlgorithm != "" {
+			if err := validateChecksum(p.ChecksumAlgorithm, part.Checksum); err != nil {
+				return nil, badRequest(fmt.Sprintf("part %v: %v", part.PartNumber, err))
+			}
+		}
+	}
+	return &j, nil
+}
+
+func writeCompleteUploadResponse(w http.ResponseWriter, location, bucket, key, etag string) {
+	writeJSON(w, &CompleteUploadResponse{
+		Data: CompleteUploadData{
+			Location: location,
+			Bucket:   bucket,
+			Key:      key,
+			ETag:     etag,
+		},
+	})
+}
+
+// byteRange matches the byte range of a copied part or of a download, bytes=first-last.
+var byteRange = regexp.MustCompile(`^bytes=([0-9]+)-([0-9]+)$`)
+
+// validateRange checks the byte range is bytes=first-last with first <= last.
+func validateRange(rng string) error {
+	m := byteRange.FindStringSubmatch(rng)
+	if m == nil {
+		return badRequest("range must be bytes=first-last")
+	}
+	first, err1 := strconv.ParseInt(m[1], 10, 64)
+	last, err2 := strconv.ParseInt(m[2], 10, 64)
+	if err1 != nil || err2 != nil || first > last {
+		return badRequest(fmt.Sprintf("invalid range: %q", rng))
+	}
+	return nil
+}
+
+func parseCopyUploadPartRequest(r *http.Request) (*CopyUploadPartRequest, error) {
+	var req CopyUploadPartRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest(fmt.Sprintf("invalid request body: %v", err))
+	}
+	if req.FileName == "" || req.UploadID == "" || req.Source == "" {
+		return nil, badRequest("fileName, uploadId and source are required")
+	}
+	if req.PartNumber < 1 || req.PartNumber > maxPartNumber {
+		return nil, badRequest(fmt.Sprintf("partNumber must be between 1 and %v", maxPartNumber))
+	}
+	if req.Range != "" {
+		if err := validateRange(req.Range); err != nil {
+			return nil, err
+		}
+	}
+	if req.ChecksumAlgorithm != "" {
+		if _, err := checksumSize(req.ChecksumAlgorithm); err != nil {
+			return nil, err
+		}
+	}
+	return &req, uploadPolicy.validateCopySource(req.Source)
+}
+
+func writeCopyUploadPartResponse(w http.ResponseWriter, etag, checksum string) {
+	writeJSON(w, &CopyUploadPartResponse{
+		ETag:     etag,
+		Checksum: checksum,
+	})
+}
+
+func parseComposeUploadRequest(r *http.Request) (*ComposeUploadRequest, error) {
+	var req ComposeUploadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		return nil, badRequest(fmt.Sprintf("invalid request body: %v", err))
+	}
+	if req.UploadID == "" {
+		if req.Params.FileSize < 0 {
+			return nil, badRequest("fileSize must be a non negative integer")
+		}
+		if err := validateStartUploadRequest(&req.Params); err != nil {
+			return nil, err
+		}
+	} else if req.Params.FileName == "" {
+		return nil, badRequest("fileName is required")
+	}
+	if len(req.Parts) == 0 || len(req.Parts) > maxPartNumber {
+		return nil, badRequest(fmt.Sprintf("1 to %v parts are required", maxPartNumber))
+	}
+	alg := req.Params.ChecksumAlgorithm
+	if alg != "" {
+		if _, err := checksumSize(alg); err != nil {
+			return nil, err
+		}
+	}
+	for i, part := range req.Parts {
+		n := i + 1
+		switch {
+		case part.Source != "" && part.ETag != "":
+			return nil, badRequest(fmt.Sprintf("part %v: both a source and an etag", n))
+		case part.Source != "":
+			if part.Range != "" {
+				if err := validateRange(part.Range); err != nil {
+					return nil, badRequest(fmt.Sprintf("part %v: %v", n, err))
+				}
+			}
+			if err := uploadPolicy.validateCopySource(part.Source); err != nil {
+				return nil, err
+			}
+		case part.ETag != "":
+			// the part was uploaded to the upload of the request
+			if req.UploadID == "" {
+				return nil, badRequest(fmt.Sprintf("part %v: an uploaded part needs the uploadId", n))
+			}
+			if alg != "" {
+				if err := validateChecksum(alg, part.Checksum); err != nil {
+					return nil, badRequest(fmt.Sprintf("part %v: %v", n, err))
+				}
+			}
+		default:
+			return nil, badRequest(fmt.Sprintf("part %v: no source or etag", n))
+		}
+	}
+	return &req, nil
+}
+
+func parseAbortUploadRequest(r *http.Request) (*AbortUploadRequest, error) {
+	q := r.URL.Query()
+	req := &AbortUploadRequest{
+		FileName: q.Get("fileName"),
+		UploadID: q.Get("uploadId"),
+	}
+	if req.FileName == "" || req.UploadID == "" {
+		return nil, badRequest("fileName and uploadId are required")
+	}
+	return req, nil
+}
+
+func parseListPartsRequest(r *http.Request) (*ListPartsRequest, error) {
+	q := r.URL.Query()
+	req := &ListPartsRequest{
+		FileName: q.Get("fileName"),
+		UploadID: q.Get("uploadId"),
+	}
+	if req.FileName == "" || req.UploadID == "" {
+		return nil, badRequest("fileName and uploadId are required")
+	}
+	return req, nil
+}
+
+func writeListPartsResponse(w http.ResponseWriter, parts []*s3.Part) {
+	resp := &ListPartsResponse{Parts: []UploadedPart{}}
+	for _, p := range parts {
+		resp.Parts = append(resp.Parts, UploadedPart{
+			PartNumber: aws.Int64Value(p.PartNumber),
+			ETag:       aws.StringValue(p.ETag),
+			Size:       aws.Int64Value(p.Size),
+			Checksums:  partChecksums(p),
+		})
+	}
+	writeJSON(w, resp)
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,320 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gostones/s3upload/internal/logging"
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+// Audit event types.
+const (
+	auditUploadStarted   = "upload.started"
+	auditUploadCompleted = "upload.completed"
+	auditUploadAborted   = "upload.aborted"
+	auditPartCopied      = "upload.part_copied"
+	auditDownload        = "object.download"
+)
+
+// auditEvent records who did what to which object and when.
+type auditEvent struct {
+	Time      time.Time  `json:"time"`
+	Event     string     `json:"event"`
+	User      string     `json:"user,omitempty"`
+	ClientIP  string     `json:"clientIp"`
+	RequestID string     `json:"requestId,omitempty"`
+	Bucket    string     `json:"bucket"`
+	Key       string     `json:"key"`
+	UploadID  string     `json:"uploadId"`
+	Size      int64      `json:"size,omitempty"`
+	ETag      string     `json:"etag,omitempty"`
+	Started   *time.Time `json:"started,omitempty"`
+	Source    string     `json:"source,omitempty"` // key of the object copied
+}
+
+// auditSink receives the upload lifecycle events.
+type auditSink interface {
+	Emit(e *auditEvent) error
+	// Close flushes the events emitted, until ctx is done.
+	Close(ctx context.Context) error
+}
+
+// newAuditEvent fills in the event with the details of the request.
+func newAuditEvent(r *http.Request, event string) *auditEvent {
+	return &auditEvent{
+		Time:      time.Now().UTC(),
+		Event:     event,
+		User:      requestUser(r),
+		ClientIP:  clientIP(r),
+		RequestID: logging.RequestID(r.Context()),
+	}
+}
+
+// requestUser returns the user name of the basic authentication or the
+// X-Upload-User header. The server doesn't check the password, the user is
+// only trusted from the proxy authenticating the requests, with trustProxy.
+func requestUser(r *http.Request) string {
+	if !trustProxy {
+		return ""
+	}
+	if user, _, ok := r.BasicAuth(); ok {
+		return user
+	}
+	return r.Header.Get(HeaderUser)
+}
+
+// trustProxy enables X-Forwarded-For for the client IP and the user of the
+// requests, set SERVER_TRUST_PROXY=true env when running behind a load
+// balancer or proxy that sets them.
+var trustProxy = os.Getenv("SERVER_TRUST_PROXY") == "true"
+
+func clientIP(r *http.Request) string {
+	if trustProxy {
+		if xff := r.Header.Get("X-Forwarded-For"); xff != "" {
+			return strings.TrimSpace(strings.Split(xff, ",")[0])
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// emitAudit sends the event to the sink, failures are logged and don't fail
+// the request. The webhook sink doesn't delay the request, it posts the
+// events in the background.
+func (s *server) emitAudit(r *http.Request, e *auditEvent) {
+	if s.audit == nil {
+		return
+	}
+	if err := s.audit.Emit(e); err != nil {
+		logging.FromContext(r.Context()).Error("audit", "event", e.Event, "upload_id", e.UploadID, "error", err)
+	}
+}
+
+// fileAuditSink appends the events as JSON lines to a file.
+type fileAuditSink struct {
+	sync.Mutex
+	f *os.File
+}
+
+func newFileAuditSink(filename string) (*fileAuditSink, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	return &fileAuditSink{f: f}, nil
+}
+
+func (r *fileAuditSink) Emit(e *auditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	r.Lock()
+	defer r.Unlock()
+	if _, err := r.f.Write(append(b, '\n')); err != nil {
+		return err
+	}
+	return r.f.Sync()
+}
+
+func (r *fileAuditSink) Close(ctx context.Context) error {
+	return r.f.Close()
+}
+
+// webhookQueueSize is the number of audit events waiting to be posted.
+const webhookQueueSize = 1000
+
+// webhookAuditSink posts each event as JSON to a URL, in order from a queue.
+// The events not posted, when the queue stays full, the post fails or the
+// sink is closed, are appended to the spill file so none is lost.
+type webhookAuditSink struct {
+	url    string
+	client *http.Client
+	wait   time.Duration  // for room in the queue before spilling the event
+	spill  *fileAuditSink // nil if not configured, the events are then only logged
+
+	mu      sync.RWMutex // guards closed and the send on queue
+	closed  bool
+	queue   chan *auditEvent
+	done    chan struct{} // closed when the queue is drained
+	stop    context.Context
+	abandon context.CancelFunc // spills the queued events on a close timeout
+}
+
+func newWebhookAuditSink(url string, queueSize int, spill *fileAuditSink) *webhookAuditSink {
+	r := &webhookAuditSink{
+		url:    url,
+		client: &http.Client{Timeout: 10 * time.Second},
+		wait:   5 * time.Second,
+		spill:  spill,
+		queue:  make(chan *auditEvent, queueSize),
+		done:   make(chan struct{}),
+	}
+	r.stop, r.abandon = context.WithCancel(context.Background())
+	go r.run()
+	return r
+}
+
+// Emit queues the event, waiting for room in the queue. The event is
+// spilled if the queue stays full or is closed.
+func (r *webhookAuditSink) Emit(e *auditEvent) error {
+	r.mu.RLock()
+	if r.closed {
+		r.mu.RUnlock()
+		return r.spillEvent(e, errors.New("audit webhook closed"))
+	}
+	t := time.NewTimer(r.wait)
+	defer t.Stop()
+	select {
+	case r.queue <- e:
+		r.mu.RUnlock()
+		return nil
+	case <-t.C:
+	}
+	r.mu.RUnlock()
+	return r.spillEvent(e, errors.New("audit webhook queue full"))
+}
+
+func (r *webhookAuditSink) run() {
+	defer close(r.done)
+	for e := range r.queue {
+		err := r.stop.Err()
+		if err == nil {
+			err = r.post(e)
+		}
+		if err != nil {
+			if err := r.spillEvent(e, err); err != nil {
+				logger.Error("audit", "event", e.Event, "upload_id", e.UploadID, "request_id", e.RequestID, "error", err)
+			}
+		}
+	}
+}
+
+// spillEvent appends the event not posted to the spill file, it returns
+// the cause if the event is lost.
+func (r *webhookAuditSink) spillEvent(e *auditEvent, cause error) error {
+	if r.spill == nil {
+		return cause
+	}
+	if err := r.spill.Emit(e); err != nil {
+		return fmt.Errorf("%v, not spilled: %v", cause, err)
+	}
+	logger.Warn("audit event spilled", "event", e.Event, "upload_id", e.UploadID, "error", cause)
+	return nil
+}
+
+// Close stops accepting events and waits for the queued ones to be posted
+// until ctx is done, the others are spilled.
+func (r *webhookAuditSink) Close(ctx context.Context) error {
+	r.mu.Lock()
+	if !r.closed {
+		r.closed = true
+		close(r.queue)
+	}
+	r.mu.Unlock()
+	var err error
+	select {
+	case <-r.done:
+	case <-ctx.Done():
+		err = fmt.Errorf("audit webhook: %v events not posted: %v", len(r.queue), ctx.Err())
+		r.abandon()
+		<-r.done
+	}
+	r.abandon()
+	if r.spill != nil {
+		r.spill.Close(ctx)
+	}
+	return err
+}
+
+func (r *webhookAuditSink) post(e *auditEvent) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, r.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := r.client.Do(req.WithContext(r.stop))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("audit webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// multiAuditSink emits the events to all the sinks.
+type multiAuditSink []auditSink
+
+func (r multiAuditSink) Emit(e *auditEvent) error {
+	var errs []string
+	for _, s := range r {
+		if err := s.Emit(e); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+func (r multiAuditSink) Close(ctx context.Context) error {
+	var errs []string
+	for _, s := range r {
+		if err := s.Close(ctx); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return fmt.Errorf("%v", errs)
+	}
+	return nil
+}
+
+// auditFromEnv configures the audit sinks from AUDIT_LOG_FILE and AUDIT_WEBHOOK_URL env,
+// with AUDIT_SPILL_FILE for the events the webhook doesn't take.
+func auditFromEnv() (auditSink, error) {
+	var sinks multiAuditSink
+	if filename := os.Getenv("AUDIT_LOG_FILE"); filename != "" {
+		s, err := newFileAuditSink(filename)
+		if err != nil {
+			return nil, err
+		}
+		sinks = append(sinks, s)
+	}
+	if url := os.Getenv("AUDIT_WEBHOOK_URL"); url != "" {
+		var spill *fileAuditSink
+		if filename := os.Getenv("AUDIT_SPILL_FILE"); filename != "" {
+			var err error
+			if spill, err = newFileAuditSink(filename); err != nil {
+				return nil, err
+			}
+		} else {
+			logger.Warn("AUDIT_SPILL_FILE not set, the audit events the webhook doesn't take are lost")
+		}
+		sinks = append(sinks, newWebhookAuditSink(url, webhookQueueSize, spill))
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	return sinks, nil
+}
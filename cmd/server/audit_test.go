@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+func TestAuditFile(t *testing.T) {
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "audit.jsonl")
+	s, err := newFileAuditSink(filename)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	started := time.Date(2019, 10, 1, 0, 0, 0, 0, time.UTC)
+	for _, e := range []*auditEvent{
+		{Event: auditUploadStarted, Key: "fox.txt", UploadID: "id"},
+		{Event: auditUploadCompleted, Key: "fox.txt", UploadID: "id", Size: 3, Started: &started},
+	} {
+		if err := s.Emit(e); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+	if err := s.Close(context.Background()); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer f.Close()
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		t.Logf("%s", scanner.Bytes())
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		lines = append(lines, line)
+	}
+	if len(lines) != 2 || lines[0]["event"] != auditUploadStarted || lines[1]["event"] != auditUploadCompleted {
+		t.FailNow()
+	}
+	// started is omitted if unknown
+	if _, ok := lines[0]["started"]; ok || lines[1]["started"] != "2019-10-01T00:00:00Z" {
+		t.FailNow()
+	}
+}
+
+func TestAuditWebhook(t *testing.T) {
+	var mu sync.Mutex
+	var events []auditEvent
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		var e auditEvent
+		if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		mu.Lock()
+		events = append(events, e)
+		mu.Unlock()
+	}))
+	defer s.Close()
+
+	sink := newWebhookAuditSink(s.URL, webhookQueueSize, nil)
+	// the events are queued while the webhook is blocked
+	start := time.Now()
+	for _, key := range []string{"fox.txt", "dog.txt"} {
+		if err := sink.Emit(&auditEvent{Event: auditUploadStarted, Key: key}); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+	if time.Since(start) > time.Second {
+		t.Log("emit blocked")
+		t.FailNow()
+	}
+	// the close waits for the deliveries
+	time.AfterFunc(50*time.Millisecond, func() { close(release) })
+	if err := sink.Close(context.Background()); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	t.Logf("events: %+v", events)
+	if len(events) != 2 || events[0].Key != "fox.txt" || events[1].Key != "dog.txt" {
+		t.FailNow()
+	}
+	if err := sink.Emit(&auditEvent{Event: auditUploadAborted}); err == nil {
+		t.Log("emitted after close")
+		t.FailNow()
+	}
+}
+
+func TestAuditWebhookSpill(t *testing.T) {
+	var posted int32
+	release := make(chan struct{})
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+			atomic.AddInt32(&posted, 1)
+		case <-r.Context().Done():
+		}
+	}))
+	defer s.Close()
+	defer close(release)
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	spill, err := newFileAuditSink(filepath.Join(dir, "spill.jsonl"))
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// the queue fills while the webhook is blocked, the events that don't
+	// fit are spilled, not dropped
+	sink := newWebhookAuditSink(s.URL, 1, spill)
+	sink.wait = 10 * time.Millisecond
+	keys := []string{"a.txt", "b.txt", "c.txt", "d.txt"}
+	for _, key := range keys {
+		if err := sink.Emit(&auditEvent{Event: auditUploadStarted, Key: key}); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+	lines := deadLetters(t, filepath.Join(dir, "spill.jsonl"))
+	t.Logf("spilled while full: %v", len(lines))
+	if len(lines) < 2 {
+		t.FailNow()
+	}
+
+	// the event in flight and the queued ones are spilled on a close timeout
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	err = sink.Close(ctx)
+	lines = deadLetters(t, filepath.Join(dir, "spill.jsonl"))
+	t.Logf("close: %v posted: %v spilled: %v", err, posted, lines)
+	if err == nil || atomic.LoadInt32(&posted) != 0 || len(lines) != len(keys) {
+		t.FailNow()
+	}
+	spilled := map[string]bool{}
+	for _, line := range lines {
+		spilled[line["key"].(string)] = true
+	}
+	for _, key := range keys {
+		if !spilled[key] {
+			t.Logf("%s lost", key)
+			t.FailNow()
+		}
+	}
+}
+
+func TestAuditUser(t *testing.T) {
+	defer func(trust bool) { trustProxy = trust }(trustProxy)
+
+	tests := []struct {
+		name  string
+		trust bool
+		set   func(r *http.Request)
+		user  string
+	}{
+		{"basic auth", true, func(r *http.Request) { r.SetBasicAuth("alice", "") }, "alice"},
+		{"header", true, func(r *http.Request) { r.Header.Set(HeaderUser, "bob") }, "bob"},
+		{"untrusted basic auth", false, func(r *http.Request) { r.SetBasicAuth("alice", "") }, ""},
+		{"untrusted header", false, func(r *http.Request) { r.Header.Set(HeaderUser, "bob") }, ""},
+	}
+	for _, test := range tests {
+		trustProxy = test.trust
+		r := httptest.NewRequest(http.MethodPost, PathStartUpload, nil)
+		test.set(r)
+		e := newAuditEvent(r, auditUploadStarted)
+		t.Logf("%s: %q", test.name, e.User)
+		if e.User != test.user {
+			t.FailNow()
+		}
+	}
+}
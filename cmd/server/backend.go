@@ -0,0 +1,81 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// backend stores the objects uploaded with the multipart upload protocol.
+// The requests and results are described with the S3 types, a backend
+// ignores the options it doesn't support. Its errors are awserr.Error with
+// the S3 error codes.
+type backend interface {
+	// CreateUpload starts a multipart upload and returns its id.
+	CreateUpload(ctx context.Context, input *s3.CreateMultipartUploadInput) (string, error)
+	// PresignPart returns the URL the client PUTs the part to and the
+	// headers it must send with it.
+	PresignPart(input *PutObjectInput, expire time.Duration) (string, http.Header, error)
+	// ListParts returns the parts uploaded, in order.
+	ListParts(ctx context.Context, key, uploadID string) ([]*s3.Part, error)
+	// CompleteUpload assembles the parts into the object.
+	CompleteUpload(ctx context.Context, input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error)
+	// AbortUpload discards the parts of the upload.
+	AbortUpload(ctx context.Context, input *s3.AbortMultipartUploadInput) error
+}
+
+// s3Backend stores the objects in the S3 bucket, the parts are PUT by the
+// clients to S3 with presigned URLs.
+type s3Backend struct {
+	svc *s3.S3
+}
+
+func (b *s3Backend) CreateUpload(ctx context.Context, input *s3.CreateMultipartUploadInput) (string, error) {
+	output, err := b.svc.CreateMultipartUploadWithContext(ctx, input)
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(output.UploadId), nil
+}
+
+func (b *s3Backend) PresignPart(input *PutObjectInput, expire time.Duration) (string, http.Header, error) {
+	return Presign(b.svc, input, expire)
+}
+
+func (b *s3Backend) ListParts(ctx context.Context, key, uploadID string) ([]*s3.Part, error) {
+	input := &s3.ListPartsInput{
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}
+	var parts []*s3.Part
+	for {
+		output, err := b.svc.ListPartsWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		parts = append(parts, output.Parts...)
+		if !aws.BoolValue(output.IsTruncated) {
+			return parts, nil
+		}
+		input.PartNumberMarker = output.NextPartNumberMarker
+	}
+}
+
+func (b *s3Backend) CompleteUpload(ctx context.Context, input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	return b.svc.CompleteMultipartUploadWithContext(ctx, input)
+}
+
+func (b *s3Backend) AbortUpload(ctx context.Context, input *s3.AbortMultipartUploadInput) error {
+	_, err := b.svc.AbortMultipartUploadWithContext(ctx, input)
+	return err
+}
+
+// errNotImplemented is returned for the options and operations the backend doesn't support.
+func errNotImplemented(what string) error {
+	return awserr.New("NotImplemented", what+" is not supported by the storage backend", nil)
+}
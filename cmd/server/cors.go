@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gostones/s3upload/internal"
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+// errCodeNoSuchCORSConfiguration is returned by GetBucketCors for a bucket without CORS.
+const errCodeNoSuchCORSConfiguration = "NoSuchCORSConfiguration"
+
+// corsConfig allows the web apps of other origins to call the API and,
+// applied on the bucket, to PUT the parts to the presigned URLs. The
+// upload page served by the server calls the API from its own origin but
+// its origin must be allowed on the bucket.
+type corsConfig struct {
+	origins []string // * for any, https://*.example.com for the subdomains
+	methods []string
+	headers []string
+	maxAge  time.Duration
+}
+
+// corsFromEnv is configured with CORS_ALLOWED_ORIGINS, CORS_ALLOWED_METHODS
+// and CORS_ALLOWED_HEADERS env, comma separated, and CORS_MAX_AGE, e.g. 1h.
+// CORS is disabled if no origin is allowed.
+func corsFromEnv() *corsConfig {
+	c := &corsConfig{
+		origins: splitList(os.Getenv("CORS_ALLOWED_ORIGINS")),
+		methods: splitList(os.Getenv("CORS_ALLOWED_METHODS")),
+		headers: splitList(os.Getenv("CORS_ALLOWED_HEADERS")),
+		maxAge:  durationFromEnv("CORS_MAX_AGE", 10*time.Minute),
+	}
+	// PUT and the digest headers are of the part PUTs of the local storage
+	if len(c.methods) == 0 {
+		c.methods = []string{http.MethodGet, http.MethodPost, http.MethodPut}
+	}
+	if len(c.headers) == 0 {
+		c.headers = []string{
+			"Content-Type",
+			"Content-MD5",
+			checksumHeader(internal.ChecksumSHA256),
+			checksumHeader(internal.ChecksumSHA1),
+			checksumHeader(internal.ChecksumCRC32),
+			checksumHeader(internal.ChecksumCRC32C),
+			HeaderRequestID,
+			HeaderUser,
+			HeaderSSECustomerAlgorithm,
+			HeaderSSECustomerKey,
+			HeaderSSECustomerKeyMD5,
+			HeaderCopySourceSSECustomerAlgorithm,
+			HeaderCopySourceSSECustomerKey,
+			HeaderCopySourceSSECustomerKeyMD5,
+		}
+	}
+	return c
+}
+
+// handler sets the CORS headers of the requests from the allowed origins
+// and answers their preflight requests. The responses vary by origin when
+// CORS is enabled, the caches must not serve one origin the response of another.
+func (c *corsConfig) handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(c.origins) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h := w.Header()
+		h.Add("Vary", "Origin")
+		origin := r.Header.Get("Origin")
+		if origin == "" || !c.allowedOrigin(origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		h.Set("Access-Control-Allow-Origin", origin)
+		h.Set("Access-Control-Expose-Headers", HeaderRequestID)
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			h.Add("Vary", "Access-Control-Request-Method")
+			h.Add("Vary", "Access-Control-Request-Headers")
+			h.Set("Access-Control-Allow-Methods", strings.Join(c.methods, ", "))
+			h.Set("Access-Control-Allow-Headers", strings.Join(c.headers, ", "))
+			if c.maxAge > 0 {
+				h.Set("Access-Control-Max-Age", strconv.Itoa(int(c.maxAge.Seconds())))
+			}
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (c *corsConfig) allowedOrigin(origin string) bool {
+	return matchOrigin(c.origins, origin)
+}
+
+// matchOrigin reports whether the origin matches one of the patterns, with
+// at most one * wildcard as S3 allows.
+func matchOrigin(patterns []string, origin string) bool {
+	for _, p := range patterns {
+		if p == "*" || strings.EqualFold(p, origin) {
+			return true
+		}
+		if ok, _ := path.Match(strings.ToLower(p), strings.ToLower(origin)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// bucketMethods are the methods of the presigned URLs: the part PUTs, the
+// range GETs of the downloads and their HEAD.
+var bucketMethods = []string{http.MethodPut, http.MethodGet, http.MethodHead}
+
+// bucketRule returns the bucket CORS rule allowing the presigned requests
+// from the origins and exposing the ETag of the parts to the browser.
+func (c *corsConfig) bucketRule(origins []string) *s3.CORSRule {
+	return &s3.CORSRule{
+		ID:             aws.String("s3upload"),
+		AllowedOrigins: aws.StringSlice(origins),
+		AllowedMethods: aws.StringSlice(bucketMethods),
+		AllowedHeaders: aws.StringSlice([]string{"*"}),
+		ExposeHeaders:  aws.StringSlice([]string{"ETag"}),
+		MaxAgeSeconds:  aws.Int64(int64(c.maxAge.Seconds())),
+	}
+}
+
+// uncovered returns the origins no rule allows the presigned requests from.
+func (c *corsConfig) uncovered(rules []*s3.CORSRule) []string {
+	var origins []string
+	for _, origin := range c.origins {
+		covered := false
+		for _, rule := range rules {
+			if ruleAllows(rule, origin) {
+				covered = true
+				break
+			}
+		}
+		if !covered {
+			origins = append(origins, origin)
+		}
+	}
+	return origins
+}
+
+// ruleAllows reports whether the rule allows the presigned requests from
+// the origin, any header, and exposes the ETag.
+func ruleAllows(rule *s3.CORSRule, origin string) bool {
+	if !matchOrigin(aws.StringValueSlice(rule.AllowedOrigins), origin) {
+		return false
+	}
+	methods := aws.StringValueSlice(rule.AllowedMethods)
+	for _, m := range bucketMethods {
+		if !contains(methods, m) {
+			return false
+		}
+	}
+	if !contains(aws.StringValueSlice(rule.AllowedHeaders), "*") {
+		return false
+	}
+	for _, h := range aws.StringValueSlice(rule.ExposeHeaders) {
+		if strings.EqualFold(h, "ETag") {
+			return true
+		}
+	}
+	return false
+}
+
+// checkBucket validates the CORS configuration of the bucket allows the
+// presigned requests from the origins. If apply is set a rule is added for
+// the origins not allowed, the existing rules are kept.
+func (c *corsConfig) checkBucket(ctx context.Context, svc *s3.S3, apply bool) error {
+	if len(c.origins) == 0 {
+		return nil
+	}
+	var rules []*s3.CORSRule
+	err := observeS3("GetBucketCors", func() error {
+		output, err := svc.GetBucketCorsWithContext(ctx, &s3.GetBucketCorsInput{Bucket: aws.String(bucketName)})
+		if e, ok := err.(awserr.Error); ok && e.Code() == errCodeNoSuchCORSConfiguration {
+			return nil
+		}
+		if err == nil {
+			rules = output.CORSRules
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	missing := c.uncovered(rules)
+	if len(missing) == 0 {
+		return nil
+	}
+	if !apply {
+		return fmt.Errorf("bucket CORS doesn't allow the presigned requests from %v", missing)
+	}
+	rules = append(rules, c.bucketRule(missing))
+	return observeS3("PutBucketCors", func() error {
+		_, err := svc.PutBucketCorsWithContext(ctx, &s3.PutBucketCorsInput{
+			Bucket:            aws.String(bucketName),
+			CORSConfiguration: &s3.CORSConfiguration{CORSRules: rules},
+		})
+		return err
+	})
+}
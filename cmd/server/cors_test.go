@@ -0,0 +1,145 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+func TestMatchOrigin(t *testing.T) {
+	patterns := []string{"https://app.example.com", "https://*.example.org", "http://localhost:*"}
+	for origin, match := range map[string]bool{
+		"https://app.example.com":     true,
+		"https://APP.example.com":     true,
+		"http://app.example.com":      false,
+		"https://www.example.com":     false,
+		"https://a.example.org":       true,
+		"https://example.org":         false,
+		"https://a.example.org.evil":  false,
+		"http://localhost:8080":       true,
+		"http://localhost.evil.com:1": false,
+		"":                            false,
+	} {
+		if ok := matchOrigin(patterns, origin); ok != match {
+			t.Logf("%q: %v", origin, ok)
+			t.FailNow()
+		}
+	}
+	if !matchOrigin([]string{"*"}, "https://any.com") || matchOrigin(nil, "https://any.com") {
+		t.FailNow()
+	}
+}
+
+func TestCORSHandler(t *testing.T) {
+	c := &corsConfig{
+		origins: []string{"https://app.example.com"},
+		methods: []string{http.MethodGet, http.MethodPost, http.MethodPut},
+		headers: []string{"Content-Type", "Content-MD5"},
+		maxAge:  time.Hour,
+	}
+	var served int
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		served++
+	})
+
+	tests := []struct {
+		name      string
+		cors      *corsConfig
+		method    string
+		origin    string
+		preflight bool
+		allowed   bool
+		served    bool
+		vary      bool
+	}{
+		{"same origin", c, http.MethodPost, "", false, false, true, true},
+		{"allowed", c, http.MethodPost, "https://app.example.com", false, true, true, true},
+		{"not allowed", c, http.MethodPost, "https://evil.com", false, false, true, true},
+		{"preflight", c, http.MethodOptions, "https://app.example.com", true, true, false, true},
+		{"preflight not allowed", c, http.MethodOptions, "https://evil.com", true, false, true, true},
+		{"disabled", &corsConfig{}, http.MethodPost, "https://app.example.com", false, false, true, false},
+	}
+	for _, test := range tests {
+		served = 0
+		r := httptest.NewRequest(test.method, PathStartUpload, nil)
+		if test.origin != "" {
+			r.Header.Set("Origin", test.origin)
+		}
+		if test.preflight {
+			r.Header.Set("Access-Control-Request-Method", http.MethodPut)
+			r.Header.Set("Access-Control-Request-Headers", "content-md5")
+		}
+		w := httptest.NewRecorder()
+		test.cors.handler(next).ServeHTTP(w, r)
+		header := w.Header()
+		t.Logf("%s: %v %v", test.name, w.Code, header)
+		if (header.Get("Access-Control-Allow-Origin") == test.origin && test.origin != "") != test.allowed {
+			t.FailNow()
+		}
+		if (served == 1) != test.served {
+			t.FailNow()
+		}
+		if (header.Get("Vary") == "Origin") != test.vary {
+			t.FailNow()
+		}
+		if test.preflight && test.allowed {
+			if w.Code != http.StatusNoContent ||
+				header.Get("Access-Control-Allow-Methods") != "GET, POST, PUT" ||
+				header.Get("Access-Control-Allow-Headers") != "Content-Type, Content-MD5" ||
+				header.Get("Access-Control-Max-Age") != "3600" {
+				t.FailNow()
+			}
+		}
+	}
+}
+
+func TestCORSDefaults(t *testing.T) {
+	c := corsFromEnv()
+	t.Logf("methods: %v headers: %v", c.methods, c.headers)
+	if !contains(c.methods, http.MethodPut) || !contains(c.headers, "Content-MD5") || !contains(c.headers, "X-Amz-Checksum-sha256") {
+		t.FailNow()
+	}
+}
+
+func TestCORSBucket(t *testing.T) {
+	c := &corsConfig{origins: []string{"https://app.example.com", "https://*.example.org"}, maxAge: time.Minute}
+	rule := func(origins, methods, headers, expose string) *s3.CORSRule {
+		return &s3.CORSRule{
+			AllowedOrigins: aws.StringSlice(strings.Split(origins, ",")),
+			AllowedMethods: aws.StringSlice(strings.Split(methods, ",")),
+			AllowedHeaders: aws.StringSlice(strings.Split(headers, ",")),
+			ExposeHeaders:  aws.StringSlice(strings.Split(expose, ",")),
+		}
+	}
+
+	tests := []struct {
+		name      string
+		rules     []*s3.CORSRule
+		uncovered []string
+	}{
+		{"no rule", nil, c.origins},
+		{"any origin", []*s3.CORSRule{rule("*", "PUT,GET,HEAD", "*", "ETag")}, nil},
+		{"one origin", []*s3.CORSRule{rule("https://app.example.com", "PUT,GET,HEAD", "*", "etag")}, []string{"https://*.example.org"}},
+		{"two rules", []*s3.CORSRule{
+			rule("https://app.example.com", "PUT,GET,HEAD", "*", "ETag"),
+			rule("https://*.example.org", "GET,HEAD,PUT", "*", "x-amz-request-id,ETag"),
+		}, nil},
+		{"no PUT", []*s3.CORSRule{rule("*", "GET,HEAD", "*", "ETag")}, c.origins},
+		{"headers listed", []*s3.CORSRule{rule("*", "PUT,GET,HEAD", "Content-MD5", "ETag")}, c.origins},
+		{"ETag not exposed", []*s3.CORSRule{rule("*", "PUT,GET,HEAD", "*", "x-amz-request-id")}, c.origins},
+		{"the rule added", []*s3.CORSRule{c.bucketRule(c.origins)}, nil},
+	}
+	for _, test := range tests {
+		uncovered := c.uncovered(test.rules)
+		t.Logf("%s: %v", test.name, uncovered)
+		if strings.Join(uncovered, ",") != strings.Join(test.uncovered, ",") {
+			t.FailNow()
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gostones/s3upload/internal/logging"
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+// maxPartNumber is the S3 limit on the number of parts of a multipart upload.
+const maxPartNumber = 10000
+
+// requestError is a client error detected validating a request.
+type requestError struct {
+	message string
+}
+
+func (e *requestError) Error() string {
+	return e.message
+}
+
+func badRequest(message string) error {
+	return &requestError{message: message}
+}
+
+// s3Status maps the S3 error codes to the status returned to the client.
+var s3Status = map[string]int{
+	ErrCodeNoSuchUpload:     http.StatusNotFound,
+	s3.ErrCodeNoSuchKey:     http.StatusNotFound,
+	s3.ErrCodeNoSuchBucket:  http.StatusNotFound,
+	ErrCodeInvalidPart:      http.StatusBadRequest,
+	ErrCodeInvalidPartOrder: http.StatusBadRequest,
+	ErrCodeEntityTooSmall:   http.StatusBadRequest,
+	"EntityTooLarge":        http.StatusBadRequest,
+	"BadDigest":             http.StatusBadRequest,
+	"InvalidArgument":       http.StatusBadRequest,
+	ErrCodeInvalidRequest:   http.StatusBadRequest,
+	"KeyTooLongError":       http.StatusBadRequest,
+	"MalformedXML":          http.StatusBadRequest,
+	ErrCodeAccessDenied:     http.StatusForbidden,
+	"InvalidAccessKeyId":    http.StatusForbidden,
+	"SignatureDoesNotMatch": http.StatusForbidden,
+	"NotImplemented":        http.StatusNotImplemented,
+	"SlowDown":              http.StatusServiceUnavailable,
+	"ServiceUnavailable":    http.StatusServiceUnavailable,
+	"RequestTimeout":        http.StatusGatewayTimeout,
+}
+
+// writeError writes the error envelope with the status and code derived from err.
+func writeError(w http.ResponseWriter, r *http.Request, err error) {
+	status, code := errorStatus(err)
+	l := logging.FromContext(r.Context())
+	if status >= 500 {
+		l.Error("request failed", "status", status, "code", code, "error", err)
+	} else {
+		l.Warn("request failed", "status", status, "code", code, "error", err)
+	}
+	writeErrorCode(w, status, code, err.Error())
+}
+
+// writeErrorCode writes the error envelope.
+func writeErrorCode(w http.ResponseWriter, status int, code, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(&ErrorResponse{
+		Error: ErrorDetail{
+			Code:    code,
+			Message: message,
+		},
+	})
+}
+
+// errorStatus returns the HTTP status and error code for err.
+func errorStatus(err error) (int, string) {
+	switch e := err.(type) {
+	case *requestError:
+		return http.StatusBadRequest, ErrCodeInvalidRequest
+	case awserr.Error:
+		if status, ok := s3Status[e.Code()]; ok {
+			return status, e.Code()
+		}
+		// other client errors of S3 are caused by the request, anything else is an outage
+		if rf, ok := err.(awserr.RequestFailure); ok && rf.StatusCode() >= 400 && rf.StatusCode() < 500 {
+			return rf.StatusCode(), e.Code()
+		}
+		return http.StatusBadGateway, e.Code()
+	}
+	return http.StatusInternalServerError, ErrCodeInternalError
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+func TestErrorStatus(t *testing.T) {
+	tests := []struct {
+		name   string
+		err    error
+		status int
+		code   string
+	}{
+		{"bad request", badRequest("fileName is required"), http.StatusBadRequest, ErrCodeInvalidRequest},
+		{"no such upload", awserr.New(ErrCodeNoSuchUpload, "", nil), http.StatusNotFound, ErrCodeNoSuchUpload},
+		{"no such key", awserr.New(s3.ErrCodeNoSuchKey, "", nil), http.StatusNotFound, s3.ErrCodeNoSuchKey},
+		{"invalid part", awserr.New(ErrCodeInvalidPart, "", nil), http.StatusBadRequest, ErrCodeInvalidPart},
+		{"too small", awserr.New(ErrCodeEntityTooSmall, "", nil), http.StatusBadRequest, ErrCodeEntityTooSmall},
+		{"access denied", awserr.New(ErrCodeAccessDenied, "", nil), http.StatusForbidden, ErrCodeAccessDenied},
+		{"not implemented", awserr.New("NotImplemented", "", nil), http.StatusNotImplemented, "NotImplemented"},
+		{"slow down", awserr.New("SlowDown", "", nil), http.StatusServiceUnavailable, "SlowDown"},
+		{"timeout", awserr.New("RequestTimeout", "", nil), http.StatusGatewayTimeout, "RequestTimeout"},
+		{"other client error", awserr.NewRequestFailure(awserr.New("InvalidRange", "", nil), http.StatusRequestedRangeNotSatisfiable, "id"), http.StatusRequestedRangeNotSatisfiable, "InvalidRange"},
+		{"other server error", awserr.NewRequestFailure(awserr.New("InternalError", "", nil), http.StatusInternalServerError, "id"), http.StatusBadGateway, "InternalError"},
+		{"network", awserr.New("RequestError", "send request failed", nil), http.StatusBadGateway, "RequestError"},
+		{"other", errors.New("disk full"), http.StatusInternalServerError, ErrCodeInternalError},
+	}
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		writeError(w, httptest.NewRequest(http.MethodPost, PathStartUpload, nil), test.err)
+		var e ErrorResponse
+		err := json.NewDecoder(w.Body).Decode(&e)
+		t.Logf("%s: %v %+v %v", test.name, w.Code, e, err)
+		if err != nil || w.Code != test.status || e.Error.Code != test.code || e.Error.Message != test.err.Error() {
+			t.FailNow()
+		}
+		if w.Header().Get("Content-Type") != "application/json" {
+			t.FailNow()
+		}
+	}
+}
+
+func TestNotFound(t *testing.T) {
+	ts := httptest.NewServer(newRouter(newServer(nil, newUploadStore(""), nil, nil)))
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL + "/v2/start-upload")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	var e ErrorResponse
+	err = json.NewDecoder(resp.Body).Decode(&e)
+	t.Logf("%v %+v %v", resp.StatusCode, e, err)
+	if err != nil || resp.StatusCode != http.StatusNotFound || e.Error.Code != ErrCodeNotFound || e.Error.Message != "no such endpoint: /v2/start-upload" {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,707 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gostones/s3upload/internal"
+	"github.com/gostones/s3upload/internal/logging"
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+// server implements the upload API handlers.
+type server struct {
+	backend backend
+	svc     *s3.S3 // nil if the backend is not S3
+	store   *uploadStore
+	audit   auditSink // nil if not configured
+	notify  *notifier // nil if not configured
+
+	// set on shutdown, no new upload is accepted while draining
+	draining int32
+}
+
+func newServer(b backend, store *uploadStore, audit auditSink, notify *notifier) *server {
+	s := &server{
+		backend: b,
+		store:   store,
+		audit:   audit,
+		notify:  notify,
+	}
+	if sb, ok := b.(*s3Backend); ok {
+		s.svc = sb.svc
+	}
+	return s
+}
+
+// notifyEvent sends the upload event to the webhooks if configured.
+func (s *server) notifyEvent(r *http.Request, event, key, uploadID, etag string, cause error) {
+	if s.notify == nil {
+		return
+	}
+	e := &UploadEvent{
+		Event:    event,
+		Time:     time.Now().UTC().Format(time.RFC3339),
+		Bucket:   bucketName,
+		Key:      key,
+		UploadID: uploadID,
+		ETag:     etag,
+		Uploader: requestUser(r),
+	}
+	if session := s.store.Get(uploadID); session != nil {
+		e.Size = session.Size
+		e.Metadata = session.Metadata
+	}
+	if cause != nil {
+		e.Error = cause.Error()
+	}
+	s.notify.Notify(e)
+}
+
+// drain stops accepting new uploads.
+func (s *server) drain() {
+	atomic.StoreInt32(&s.draining, 1)
+}
+
+func (s *server) startUpload(w http.ResponseWriter, r *http.Request) {
+	if atomic.LoadInt32(&s.draining) == 1 {
+		w.Header().Set("Retry-After", "30")
+		writeErrorCode(w, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "server is shutting down")
+		return
+	}
+	q, err := parseStartUploadRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	customer, err := parseSSECustomer(r.Header)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	uploadID, err := s.createUpload(r, q, customer)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeStartUploadResponse(w, uploadID)
+}
+
+// createUpload starts the upload of the object requested, it is tracked
+// until completed or aborted.
+func (s *server) createUpload(r *http.Request, q *StartUploadRequest, customer *sseCustomer) (string, error) {
+	l := logging.FromContext(r.Context())
+	input := &s3.CreateMultipartUploadInput{
+		Bucket:      aws.String(bucketName),
+		Key:         aws.String(q.FileName),
+		ContentType: aws.String(q.FileType),
+	}
+	setObjectOptions(input, q)
+	if err := uploadEncryption.apply(input, q, customer); err != nil {
+		return "", err
+	}
+	var uploadID string
+	err := observeS3("CreateMultipartUpload", func() (err error) {
+		uploadID, err = s.backend.CreateUpload(r.Context(), input)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	uploadsStarted.Inc()
+	bytesDeclared.Add(float64(q.FileSize))
+	l.Info("upload started", "key", q.FileName, "content_type", q.FileType, "size", q.FileSize, "upload_id", uploadID,
+		"sse", aws.StringValue(input.ServerSideEncryption), "sse_customer", customer != nil)
+	session := &uploadSession{
+		UploadID:    uploadID,
+		Bucket:      bucketName,
+		Key:         q.FileName,
+		ContentType: q.FileType,
+		Size:        q.FileSize,
+		Metadata:    q.Metadata,
+		Started:     time.Now(),
+	}
+	s.store.Add(session)
+
+	e := newAuditEvent(r, auditUploadStarted)
+	e.Bucket, e.Key, e.UploadID, e.Size = bucketName, q.FileName, uploadID, q.FileSize
+	s.emitAudit(r, e)
+	return uploadID, nil
+}
+
+// setObjectOptions sets the headers, metadata and tags of the object requested by the client.
+func setObjectOptions(input *s3.CreateMultipartUploadInput, q *StartUploadRequest) {
+	optional := func(v string) *string {
+		if v == "" {
+			return nil
+		}
+		return aws.String(v)
+	}
+	input.CacheControl = optional(q.CacheControl)
+	input.ContentDisposition = optional(q.ContentDisposition)
+	input.ContentEncoding = optional(q.ContentEncoding)
+	input.StorageClass = optional(q.StorageClass)
+	input.ChecksumAlgorithm = optional(q.ChecksumAlgorithm)
+	if len(q.Metadata) > 0 {
+		input.Metadata = aws.StringMap(q.Metadata)
+	}
+	if len(q.Tags) > 0 {
+		tags := url.Values{}
+		for k, v := range q.Tags {
+			tags.Set(k, v)
+		}
+		input.Tagging = aws.String(tags.Encode())
+	}
+}
+
+func (s *server) getUploadURL(w http.ResponseWriter, r *http.Request) {
+	q, err := parseGetUploadRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	customer, err := parseSSECustomer(r.Header)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	l := logging.FromContext(r.Context())
+	input := &PutObjectInput{
+		Bucket:     bucketName,
+		Key:        q.FileName,
+		UploadID:   q.UploadID,
+		PartNumber: q.PartNumber,
+		MD5:        q.MD5,
+
+		ChecksumAlgorithm: q.ChecksumAlgorithm,
+		Checksum:          q.Checksum,
+	}
+	if customer != nil {
+		input.SSECustomerAlgorithm = customer.algorithm
+		input.SSECustomerKey = customer.key
+		input.SSECustomerKeyMD5 = customer.keyMD5
+	}
+	u, signed, err := s.backend.PresignPart(input, time.Minute*15)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	presignsIssued.Inc()
+	l.Debug("part presigned", "key", q.FileName, "upload_id", q.UploadID, "part", q.PartNumber, "url", logging.RedactURL(u))
+	writeGetUploadResponse(w, u, signed)
+}
+
+// getDownloadURL presigns the GET of an object or of a range of it. The
+// object is described with a HEAD unless a range is requested, the URL is
+// then bound to its ETag so the ranges of a download are of one version.
+func (s *server) getDownloadURL(w http.ResponseWriter, r *http.Request) {
+	if s.svc == nil {
+		writeError(w, r, errNotImplemented("get-download-url"))
+		return
+	}
+	q, err := parseGetDownloadRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	customer, err := parseSSECustomer(r.Header)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	l := logging.FromContext(r.Context())
+	input := &s3.GetObjectInput{
+		Bucket: aws.String(bucketName),
+		Key:    aws.String(q.FileName),
+	}
+	if customer != nil {
+		input.SSECustomerAlgorithm = aws.String(customer.algorithm)
+		input.SSECustomerKey = aws.String(customer.key)
+		input.SSECustomerKeyMD5 = aws.String(customer.keyMD5)
+	}
+
+	var resp GetDownloadURLResponse
+	if q.Range == "" {
+		head := &s3.HeadObjectInput{
+			Bucket:               input.Bucket,
+			Key:                  input.Key,
+			ChecksumMode:         aws.String("ENABLED"),
+			SSECustomerAlgorithm: input.SSECustomerAlgorithm,
+			SSECustomerKey:       input.SSECustomerKey,
+			SSECustomerKeyMD5:    input.SSECustomerKeyMD5,
+		}
+		var output *s3.HeadObjectOutput
+		err = observeS3("HeadObject", func() (err error) {
+			output, err = s.svc.HeadObjectWithContext(r.Context(), head)
+			return err
+		})
+		if err != nil {
+			writeError(w, r, err)
+			return
+		}
+		resp.Size = aws.Int64Value(output.ContentLength)
+		resp.ETag = aws.StringValue(output.ETag)
+		resp.ContentType = aws.StringValue(output.ContentType)
+		resp.ServerSideEncryption = aws.StringValue(output.ServerSideEncryption)
+		resp.Checksums = objectChecksums(output)
+		for k, v := range output.Metadata {
+			if resp.Metadata == nil {
+				resp.Metadata = make(map[string]string)
+			}
+			resp.Metadata[strings.ToLower(k)] = aws.StringValue(v)
+		}
+		if q.IfMatch == "" {
+			q.IfMatch = resp.ETag
+		}
+		// the composite digests of a multipart object are of its parts
+		resp.PartSizes = s.partSizes(r, head, resp.ETag)
+
+		e := newAuditEvent(r, auditDownload)
+		e.Bucket, e.Key, e.Size, e.ETag = bucketName, q.FileName, resp.Size, resp.ETag
+		s.emitAudit(r, e)
+	} else {
+		input.Range = aws.String(q.Range)
+	}
+	if q.IfMatch != "" {
+		input.IfMatch = aws.String(q.IfMatch)
+	}
+
+	req, _ := s.svc.GetObjectRequest(input)
+	u, signed, err := req.PresignRequest(time.Minute * 15)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	downloadsPresigned.Inc()
+	l.Debug("download presigned", "key", q.FileName, "range", q.Range, "url", logging.RedactURL(u))
+	resp.PresignedURL = u
+	resp.Headers = signedHeaders(signed)
+	writeJSON(w, &resp)
+}
+
+// partHeads is the number of concurrent HEADs of the parts of an object.
+const partHeads = 8
+
+// partSizes returns the sizes of the parts of a multipart object, nil if
+// not multipart or unknown. The parts are not of the same size if the
+// object is composed of copies.
+func (s *server) partSizes(r *http.Request, head *s3.HeadObjectInput, etag string) []int64 {
+	i := strings.LastIndex(etag, "-")
+	if i < 0 {
+		return nil
+	}
+	parts, err := strconv.Atoi(strings.Trim(etag[i+1:], `"`))
+	if err != nil || parts < 1 || parts > maxPartNumber {
+		return nil
+	}
+	sizes := make([]int64, parts)
+	errs := make([]error, parts)
+	sem := make(chan struct{}, partHeads)
+	var wg sync.WaitGroup
+	for n := range sizes {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(n int) {
+			defer func() { <-sem; wg.Done() }()
+			input := *head
+			input.PartNumber = aws.Int64(int64(n + 1))
+			input.IfMatch = aws.String(etag)
+			input.ChecksumMode = nil
+			errs[n] = observeS3("HeadObject", func() error {
+				output, err := s.svc.HeadObjectWithContext(r.Context(), &input)
+				if err == nil {
+					sizes[n] = aws.Int64Value(output.ContentLength)
+				}
+				return err
+			})
+		}(n)
+	}
+	wg.Wait()
+	for n, err := range errs {
+		if err != nil {
+			logging.FromContext(r.Context()).Warn("part sizes unknown", "key", aws.StringValue(head.Key), "part", n+1, "error", err)
+			return nil
+		}
+	}
+	return sizes
+}
+
+// objectChecksums returns the base64 coded checksums of the object by algorithm.
+func objectChecksums(output *s3.HeadObjectOutput) map[string]string {
+	checksums := make(map[string]string)
+	for alg, v := range map[string]*string{
+		internal.ChecksumSHA256: output.ChecksumSHA256,
+		internal.ChecksumSHA1:   output.ChecksumSHA1,
+		internal.ChecksumCRC32:  output.ChecksumCRC32,
+		internal.ChecksumCRC32C: output.ChecksumCRC32C,
+	} {
+		if v != nil && *v != "" {
+			checksums[alg] = *v
+		}
+	}
+	if len(checksums) == 0 {
+		return nil
+	}
+	return checksums
+}
+
+// copyUploadPart copies a range of an object of the bucket as a part of the
+// upload, the data is not read by the server.
+func (s *server) copyUploadPart(w http.ResponseWriter, r *http.Request) {
+	if s.svc == nil {
+		writeError(w, r, errNotImplemented("copy-upload-part"))
+		return
+	}
+	q, err := parseCopyUploadPartRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	customer, err := parseSSECustomer(r.Header)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	source, err := parseCopySourceSSECustomer(r.Header)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	result, err := s.copyPart(r, q, customer, source)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeCopyUploadPartResponse(w, aws.StringValue(result.ETag), copiedChecksum(result, q.ChecksumAlgorithm))
+}
+
+// copyPart copies the range of the source object as the part of the upload.
+func (s *server) copyPart(r *http.Request, q *CopyUploadPartRequest, customer, source *sseCustomer) (*s3.CopyPartResult, error) {
+	l := logging.FromContext(r.Context())
+	input := &s3.UploadPartCopyInput{
+		Bucket:     aws.String(bucketName),
+		Key:        aws.String(q.FileName),
+		UploadId:   aws.String(q.UploadID),
+		PartNumber: aws.Int64(q.PartNumber),
+		CopySource: aws.String(url.PathEscape(bucketName + "/" + q.Source)),
+	}
+	if q.Range != "" {
+		input.CopySourceRange = aws.String(q.Range)
+	}
+	if customer != nil {
+		input.SSECustomerAlgorithm = aws.String(customer.algorithm)
+		input.SSECustomerKey = aws.String(customer.key)
+		input.SSECustomerKeyMD5 = aws.String(customer.keyMD5)
+	}
+	if source != nil {
+		input.CopySourceSSECustomerAlgorithm = aws.String(source.algorithm)
+		input.CopySourceSSECustomerKey = aws.String(source.key)
+		input.CopySourceSSECustomerKeyMD5 = aws.String(source.keyMD5)
+	}
+	var output *s3.UploadPartCopyOutput
+	err := observeS3("UploadPartCopy", func() (err error) {
+		output, err = s.svc.UploadPartCopyWithContext(r.Context(), input)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	partsCopied.Inc()
+	result := output.CopyPartResult
+	l.Info("part copied", "key", q.FileName, "upload_id", q.UploadID, "part", q.PartNumber, "source", q.Source, "range", q.Range)
+
+	e := newAuditEvent(r, auditPartCopied)
+	e.Bucket, e.Key, e.UploadID, e.ETag, e.Source = bucketName, q.FileName, q.UploadID, aws.StringValue(result.ETag), q.Source
+	s.emitAudit(r, e)
+	return result, nil
+}
+
+// partCopies is the number of concurrent copies of the parts of a composed object.
+const partCopies = 8
+
+// abortTimeout bounds the abort of a failed compose, its request may be canceled.
+const abortTimeout = 30 * time.Second
+
+// composeUpload creates the object from the parts in order, the ranges of
+// the sources are copied by the storage and the parts uploaded by the
+// client are kept as is. The upload is started unless the request names
+// one, and aborted if a part fails then.
+func (s *server) composeUpload(w http.ResponseWriter, r *http.Request) {
+	q, err := parseComposeUploadRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	for _, p := range q.Parts {
+		if p.Source != "" && s.svc == nil {
+			writeError(w, r, errNotImplemented("copy of the sources"))
+			return
+		}
+	}
+	customer, err := parseSSECustomer(r.Header)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	source, err := parseCopySourceSSECustomer(r.Header)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	uploadID := q.UploadID
+	if uploadID == "" {
+		if atomic.LoadInt32(&s.draining) == 1 {
+			w.Header().Set("Retry-After", "30")
+			writeErrorCode(w, http.StatusServiceUnavailable, ErrCodeServiceUnavailable, "server is shutting down")
+			return
+		}
+		if uploadID, err = s.createUpload(r, &q.Params, customer); err != nil {
+			writeError(w, r, err)
+			return
+		}
+	}
+
+	complete := &CompleteUploadParams{
+		FileName:          q.Params.FileName,
+		Parts:             make([]CompleteUploadPart, len(q.Parts)),
+		UploadID:          uploadID,
+		ChecksumAlgorithm: q.Params.ChecksumAlgorithm,
+	}
+	errs := make([]error, len(q.Parts))
+	sem := make(chan struct{}, partCopies)
+	var wg sync.WaitGroup
+	for i, p := range q.Parts {
+		n := int64(i + 1)
+		if p.Source == "" {
+			complete.Parts[i] = CompleteUploadPart{ETag: p.ETag, PartNumber: n, Checksum: p.Checksum}
+			continue
+		}
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, p ComposeUploadPart) {
+			defer func() { <-sem; wg.Done() }()
+			result, err := s.copyPart(r, &CopyUploadPartRequest{
+				FileName:   complete.FileName,
+				UploadID:   uploadID,
+				PartNumber: n,
+				Source:     p.Source,
+				Range:      p.Range,
+			}, customer, source)
+			if err != nil {
+				errs[i] = err
+				return
+			}
+			complete.Parts[i] = CompleteUploadPart{
+				ETag:       aws.StringValue(result.ETag),
+				PartNumber: n,
+				Checksum:   copiedChecksum(result, complete.ChecksumAlgorithm),
+			}
+		}(i, p)
+	}
+	wg.Wait()
+	err = firstError(errs)
+	var output *s3.CompleteMultipartUploadOutput
+	if err == nil {
+		output, err = s.finishUpload(r, complete)
+	}
+	if err != nil {
+		if q.UploadID == "" {
+			// the upload is of the request, the client can't abort it
+			ctx, cancel := context.WithTimeout(context.Background(), abortTimeout)
+			defer cancel()
+			if err := s.cancelUpload(ctx, r, complete.FileName, uploadID); err != nil {
+				logging.FromContext(r.Context()).Warn("compose not aborted", "key", complete.FileName, "upload_id", uploadID, "error", err)
+			}
+		}
+		writeError(w, r, err)
+		return
+	}
+	writeCompleteUploadResponse(w, *output.Location, *output.Bucket, *output.Key, *output.ETag)
+}
+
+// firstError returns the first error not nil.
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// copiedChecksum returns the checksum of the copied part with the algorithm.
+func copiedChecksum(result *s3.CopyPartResult, alg string) string {
+	switch alg {
+	case internal.ChecksumSHA256:
+		return aws.StringValue(result.ChecksumSHA256)
+	case internal.ChecksumSHA1:
+		return aws.StringValue(result.ChecksumSHA1)
+	case internal.ChecksumCRC32:
+		return aws.StringValue(result.ChecksumCRC32)
+	case internal.ChecksumCRC32C:
+		return aws.StringValue(result.ChecksumCRC32C)
+	}
+	return ""
+}
+
+func (s *server) completeUpload(w http.ResponseWriter, r *http.Request) {
+	q, err := parseCompleteUploadRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	output, err := s.finishUpload(r, &q.Params)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeCompleteUploadResponse(w, *output.Location, *output.Bucket, *output.Key, *output.ETag)
+}
+
+// finishUpload completes the upload from its parts, the failure is notified.
+func (s *server) finishUpload(r *http.Request, q *CompleteUploadParams) (*s3.CompleteMultipartUploadOutput, error) {
+	l := logging.FromContext(r.Context())
+
+	var completedParts []*s3.CompletedPart
+	for _, p := range q.Parts {
+		part := &s3.CompletedPart{
+			ETag:       aws.String(p.ETag),
+			PartNumber: aws.Int64(p.PartNumber),
+		}
+		setPartChecksum(part, q.ChecksumAlgorithm, p.Checksum)
+		completedParts = append(completedParts, part)
+	}
+	input := &s3.CompleteMultipartUploadInput{
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(q.FileName),
+		UploadId: aws.String(q.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{
+			Parts: completedParts,
+		},
+	}
+	var output *s3.CompleteMultipartUploadOutput
+	err := observeS3("CompleteMultipartUpload", func() (err error) {
+		output, err = s.backend.CompleteUpload(r.Context(), input)
+		return err
+	})
+	if err != nil {
+		s.notifyEvent(r, eventUploadFailed, q.FileName, q.UploadID, "", err)
+		return nil, err
+	}
+	uploadsCompleted.Inc()
+
+	e := newAuditEvent(r, auditUploadCompleted)
+	e.Bucket, e.Key, e.UploadID, e.ETag = bucketName, q.FileName, q.UploadID, aws.StringValue(output.ETag)
+	if session := s.store.Get(q.UploadID); session != nil {
+		started := session.Started
+		e.Size, e.Started = session.Size, &started
+	}
+	s.emitAudit(r, e)
+	s.notifyEvent(r, eventUploadCompleted, q.FileName, q.UploadID, e.ETag, nil)
+	s.store.Remove(q.UploadID)
+	l.Info("upload completed", "key", q.FileName, "upload_id", q.UploadID, "parts", len(q.Parts), "etag", aws.StringValue(output.ETag))
+	return output, nil
+}
+
+// setPartChecksum sets the checksum of the part uploaded with the algorithm.
+func setPartChecksum(part *s3.CompletedPart, alg, checksum string) {
+	switch alg {
+	case internal.ChecksumSHA256:
+		part.ChecksumSHA256 = aws.String(checksum)
+	case internal.ChecksumSHA1:
+		part.ChecksumSHA1 = aws.String(checksum)
+	case internal.ChecksumCRC32:
+		part.ChecksumCRC32 = aws.String(checksum)
+	case internal.ChecksumCRC32C:
+		part.ChecksumCRC32C = aws.String(checksum)
+	}
+}
+
+func (s *server) abortUpload(w http.ResponseWriter, r *http.Request) {
+	q, err := parseAbortUploadRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	if err := s.cancelUpload(r.Context(), r, q.FileName, q.UploadID); err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// cancelUpload aborts the upload with the context, r is the request of the
+// audit event.
+func (s *server) cancelUpload(ctx context.Context, r *http.Request, key, uploadID string) error {
+	l := logging.FromContext(r.Context())
+	input := &s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	}
+	err := observeS3("AbortMultipartUpload", func() error {
+		return s.backend.AbortUpload(ctx, input)
+	})
+	if err != nil {
+		return err
+	}
+	uploadsAborted.Inc()
+
+	e := newAuditEvent(r, auditUploadAborted)
+	e.Bucket, e.Key, e.UploadID = bucketName, key, uploadID
+	if session := s.store.Get(uploadID); session != nil {
+		started := session.Started
+		e.Size, e.Started = session.Size, &started
+	}
+	s.emitAudit(r, e)
+	s.notifyEvent(r, eventUploadAborted, key, uploadID, "", nil)
+	s.store.Remove(uploadID)
+	l.Info("upload aborted", "key", key, "upload_id", uploadID)
+	return nil
+}
+
+// listParts lists the parts uploaded, a client resuming an upload skips them.
+func (s *server) listParts(w http.ResponseWriter, r *http.Request) {
+	q, err := parseListPartsRequest(r)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	var parts []*s3.Part
+	err = observeS3("ListParts", func() (err error) {
+		parts, err = s.backend.ListParts(r.Context(), q.FileName, q.UploadID)
+		return err
+	})
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	writeListPartsResponse(w, parts)
+}
+
+// partChecksums returns the base64 coded checksums of the part by algorithm.
+func partChecksums(part *s3.Part) map[string]string {
+	checksums := make(map[string]string)
+	for alg, v := range map[string]*string{
+		internal.ChecksumSHA256: part.ChecksumSHA256,
+		internal.ChecksumSHA1:   part.ChecksumSHA1,
+		internal.ChecksumCRC32:  part.ChecksumCRC32,
+		internal.ChecksumCRC32C: part.ChecksumCRC32C,
+	} {
+		if v != nil && *v != "" {
+			checksums[alg] = *v
+		}
+	}
+	if len(checksums) == 0 {
+		return nil
+	}
+	return checksums
+}
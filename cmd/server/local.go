@@ -0,0 +1,575 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/fnv"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gorilla/mux"
+	"github.com/gostones/s3upload/internal"
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+// localPartPath is the endpoint of the part PUTs of the local backend.
+const localPartPath = "/local/part"
+
+// localPartPort is the port of the part PUTs, served apart from the API
+// without its read and write timeouts as a part can take minutes to send.
+const localPartPort = port + 1
+
+// S3 limits on the size of the parts, all but the last must be at least minPartSize.
+const (
+	minPartSize = 5 << 20
+	maxPartSize = 5 << 30
+)
+
+var validUploadID = regexp.MustCompile(`^[0-9a-f]{32}$`)
+
+// localBackend stores the objects in a directory, for development and
+// tests without S3. The server accepts the PUT of the parts itself at the
+// URLs it issues, signed with HMAC-SHA256 and expiring as the presigned
+// URLs of S3. The directory has:
+//
+//	objects/<key>             the completed objects
+//	meta/<key>.json           their content type, metadata and ETag
+//	uploads/<uploadId>/       the upload and its parts, <n> and <n>.json
+type localBackend struct {
+	dir     string
+	baseURL string // of the part server as seen by the clients
+	secret  []byte
+	locks   [64]sync.Mutex // of the uploads by the hash of their ID
+}
+
+// localUpload describes a multipart upload of the local backend.
+type localUpload struct {
+	Key               string            `json:"key"`
+	ContentType       string            `json:"contentType"`
+	Metadata          map[string]string `json:"metadata,omitempty"`
+	ChecksumAlgorithm string            `json:"checksumAlgorithm,omitempty"`
+	Started           time.Time         `json:"started"`
+}
+
+// localPart describes an uploaded part, the ETag is the hex coded MD5.
+type localPart struct {
+	ETag     string `json:"etag"`
+	Size     int64  `json:"size"`
+	Checksum string `json:"checksum,omitempty"` // base64 coded, with the algorithm of the upload
+}
+
+// localObject describes a completed object.
+type localObject struct {
+	ContentType string            `json:"contentType"`
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Size        int64             `json:"size"`
+	ETag        string            `json:"etag"`
+}
+
+// localFromEnv is configured with LOCAL_STORAGE_DIR env, default data,
+// LOCAL_STORAGE_URL, the url of the server the clients PUT the parts to,
+// and LOCAL_STORAGE_SECRET, the key signing the part URLs. A random key is
+// generated if not set, the URLs issued are then invalid after a restart.
+func localFromEnv() (*localBackend, error) {
+	dir := os.Getenv("LOCAL_STORAGE_DIR")
+	if dir == "" {
+		dir = "data"
+	}
+	baseURL := os.Getenv("LOCAL_STORAGE_URL")
+	if baseURL == "" {
+		baseURL = fmt.Sprintf("http://localhost:%v", localPartPort)
+	}
+	secret := []byte(os.Getenv("LOCAL_STORAGE_SECRET"))
+	if len(secret) == 0 {
+		logger.Warn("LOCAL_STORAGE_SECRET not set, the part URLs are invalid after a restart")
+		secret = make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return nil, err
+		}
+	}
+	return newLocalBackend(dir, baseURL, secret)
+}
+
+func newLocalBackend(dir, baseURL string, secret []byte) (*localBackend, error) {
+	for _, d := range []string{"objects", "meta", "uploads"} {
+		if err := os.MkdirAll(filepath.Join(dir, d), 0755); err != nil {
+			return nil, err
+		}
+	}
+	return &localBackend{
+		dir:     dir,
+		baseURL: strings.TrimSuffix(baseURL, "/"),
+		secret:  secret,
+	}, nil
+}
+
+// lock locks the parts of the upload, a part is written with its
+// description and the parts are listed and assembled consistently.
+func (b *localBackend) lock(uploadID string) func() {
+	h := fnv.New32a()
+	h.Write([]byte(uploadID))
+	mu := &b.locks[h.Sum32()%uint32(len(b.locks))]
+	mu.Lock()
+	return mu.Unlock
+}
+
+// partName returns the file name of the part, the part number without
+// sign or leading zeros.
+func partName(partNumber string) (string, error) {
+	if err := validatePartNumber(partNumber); err != nil {
+		return "", err
+	}
+	n, _ := strconv.Atoi(partNumber)
+	return strconv.Itoa(n), nil
+}
+
+func errNoSuchUpload(uploadID string) error {
+	return awserr.New(ErrCodeNoSuchUpload, fmt.Sprintf("no such upload: %s", uploadID), nil)
+}
+
+// objectPath returns the path of the object, the key must be a clean relative path.
+func (b *localBackend) objectPath(key string) (string, error) {
+	if key == "" || strings.HasSuffix(key, "/") || path.Clean("/" + key)[1:] != key {
+		return "", awserr.New("InvalidArgument", fmt.Sprintf("invalid key for the local storage: %q", key), nil)
+	}
+	return filepath.Join(b.dir, "objects", filepath.FromSlash(key)), nil
+}
+
+// upload returns the directory and the description of the upload of the key.
+func (b *localBackend) upload(key, uploadID string) (string, *localUpload, error) {
+	if !validUploadID.MatchString(uploadID) {
+		return "", nil, errNoSuchUpload(uploadID)
+	}
+	dir := filepath.Join(b.dir, "uploads", uploadID)
+	data, err := ioutil.ReadFile(filepath.Join(dir, "upload.json"))
+	if os.IsNotExist(err) {
+		return "", nil, errNoSuchUpload(uploadID)
+	}
+	if err != nil {
+		return "", nil, err
+	}
+	var u localUpload
+	if err := json.Unmarshal(data, &u); err != nil {
+		return "", nil, err
+	}
+	if key != "" && u.Key != key {
+		return "", nil, errNoSuchUpload(uploadID)
+	}
+	return dir, &u, nil
+}
+
+func (b *localBackend) CreateUpload(ctx context.Context, input *s3.CreateMultipartUploadInput) (string, error) {
+	key := aws.StringValue(input.Key)
+	if _, err := b.objectPath(key); err != nil {
+		return "", err
+	}
+	if input.SSECustomerKey != nil {
+		return "", errNotImplemented("SSE-C")
+	}
+	id := make([]byte, 16)
+	if _, err := rand.Read(id); err != nil {
+		return "", err
+	}
+	uploadID := hex.EncodeToString(id)
+	u := &localUpload{
+		Key:               key,
+		ContentType:       aws.StringValue(input.ContentType),
+		Metadata:          aws.StringValueMap(input.Metadata),
+		ChecksumAlgorithm: aws.StringValue(input.ChecksumAlgorithm),
+		Started:           time.Now().UTC(),
+	}
+	dir := filepath.Join(b.dir, "uploads", uploadID)
+	if err := os.Mkdir(dir, 0755); err != nil {
+		return "", err
+	}
+	return uploadID, writeJSONFile(filepath.Join(dir, "upload.json"), u)
+}
+
+// sign returns the hex coded signature of the part URL and the headers
+// the client must send.
+func (b *localBackend) sign(fields ...string) string {
+	mac := hmac.New(sha256.New, b.secret)
+	mac.Write([]byte(strings.Join(fields, "\n")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (b *localBackend) PresignPart(input *PutObjectInput, expire time.Duration) (string, http.Header, error) {
+	if input.SSECustomerKey != "" {
+		return "", nil, errNotImplemented("SSE-C")
+	}
+	partNumber, err := partName(input.PartNumber)
+	if err != nil {
+		return "", nil, err
+	}
+	expires := strconv.FormatInt(time.Now().Add(expire).Unix(), 10)
+	headers := http.Header{}
+	if input.MD5 != "" {
+		headers.Set("Content-MD5", input.MD5)
+	}
+	if input.Checksum != "" {
+		headers.Set(checksumHeader(input.ChecksumAlgorithm), input.Checksum)
+	}
+	q := url.Values{}
+	q.Set("key", input.Key)
+	q.Set("uploadId", input.UploadID)
+	q.Set("partNumber", partNumber)
+	q.Set("expires", expires)
+	var alg string
+	if input.Checksum != "" {
+		alg = input.ChecksumAlgorithm
+		q.Set("checksumAlgorithm", alg)
+	}
+	q.Set("signature", b.sign(input.Key, input.UploadID, partNumber, expires, input.MD5, alg, input.Checksum))
+	return b.baseURL + localPartPath + "?" + q.Encode(), headers, nil
+}
+
+func checksumHeader(alg string) string {
+	return "X-Amz-Checksum-" + strings.ToLower(alg)
+}
+
+// handler routes the part PUTs to the URLs the backend signs.
+func (b *localBackend) handler() http.Handler {
+	r := mux.NewRouter()
+	r.HandleFunc(localPartPath, b.putPart).Methods(http.MethodPut)
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeErrorCode(w, http.StatusNotFound, ErrCodeNotFound, fmt.Sprintf("no such endpoint: %s", r.URL.Path))
+	})
+	return r
+}
+
+// putPart stores a part PUT to a URL issued by PresignPart, verifying its
+// signature, expiry and checksums.
+func (b *localBackend) putPart(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	key, uploadID, partNumber, expires := q.Get("key"), q.Get("uploadId"), q.Get("partNumber"), q.Get("expires")
+	alg := q.Get("checksumAlgorithm")
+	contentMD5 := r.Header.Get("Content-MD5")
+	var checksum string
+	if alg != "" {
+		checksum = r.Header.Get(checksumHeader(alg))
+	}
+	sig := b.sign(key, uploadID, partNumber, expires, contentMD5, alg, checksum)
+	if !hmac.Equal([]byte(sig), []byte(q.Get("signature"))) {
+		writeError(w, r, awserr.New("SignatureDoesNotMatch", "the signature of the part URL or its headers doesn't match", nil))
+		return
+	}
+	if t, err := strconv.ParseInt(expires, 10, 64); err != nil || time.Now().Unix() > t {
+		writeError(w, r, awserr.New(ErrCodeAccessDenied, "the part URL has expired", nil))
+		return
+	}
+	name, err := partName(partNumber)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	dir, _, err := b.upload(key, uploadID)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+
+	part, err := b.writePart(dir, uploadID, name, r.Body, contentMD5, alg, checksum)
+	if err != nil {
+		writeError(w, r, err)
+		return
+	}
+	w.Header().Set("ETag", `"`+part.ETag+`"`)
+	if checksum != "" {
+		w.Header().Set(checksumHeader(alg), checksum)
+	}
+}
+
+// writePart writes the part and its description to the upload directory
+// hashing it as written. The part replaces one uploaded before only if it
+// matches the base64 coded Content-MD5 and checksum, if set.
+func (b *localBackend) writePart(dir, uploadID, name string, body io.Reader, contentMD5, alg, checksum string) (*localPart, error) {
+	f, err := ioutil.TempFile(dir, "part")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	sum := md5.New()
+	hashes := []io.Writer{f, sum}
+	var h hash.Hash
+	if alg != "" {
+		if h, err = internal.NewHash(alg); err != nil {
+			return nil, awserr.New("InvalidArgument", err.Error(), nil)
+		}
+		hashes = append(hashes, h)
+	}
+	n, err := io.Copy(io.MultiWriter(hashes...), io.LimitReader(body, maxPartSize+1))
+	if err != nil {
+		return nil, err
+	}
+	if n > maxPartSize {
+		return nil, awserr.New("EntityTooLarge", fmt.Sprintf("part exceeds %v bytes", int64(maxPartSize)), nil)
+	}
+	part := &localPart{
+		ETag: hex.EncodeToString(sum.Sum(nil)),
+		Size: n,
+	}
+	if h != nil {
+		part.Checksum = base64.StdEncoding.EncodeToString(h.Sum(nil))
+	}
+	if contentMD5 != "" && base64.StdEncoding.EncodeToString(sum.Sum(nil)) != contentMD5 {
+		return nil, awserr.New("BadDigest", "the Content-MD5 doesn't match the part", nil)
+	}
+	if checksum != "" && checksum != part.Checksum {
+		return nil, awserr.New("BadDigest", fmt.Sprintf("the %s checksum doesn't match the part", alg), nil)
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+
+	// the upload may have been completed or aborted while receiving the part
+	defer b.lock(uploadID)()
+	if _, err := os.Stat(filepath.Join(dir, "upload.json")); err != nil {
+		return nil, errNoSuchUpload(uploadID)
+	}
+	if err := os.Rename(f.Name(), filepath.Join(dir, name)); err != nil {
+		return nil, err
+	}
+	if err := writeJSONFile(filepath.Join(dir, name+".json"), part); err != nil {
+		return nil, err
+	}
+	return part, nil
+}
+
+func (b *localBackend) ListParts(ctx context.Context, key, uploadID string) ([]*s3.Part, error) {
+	defer b.lock(uploadID)()
+	dir, u, err := b.upload(key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	return b.listParts(dir, u)
+}
+
+// listParts lists the parts in the upload directory, the upload is locked.
+func (b *localBackend) listParts(dir string, u *localUpload) ([]*s3.Part, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	var parts []*s3.Part
+	for _, fi := range files {
+		n, err := strconv.ParseInt(strings.TrimSuffix(fi.Name(), ".json"), 10, 64)
+		if err != nil || !strings.HasSuffix(fi.Name(), ".json") {
+			continue
+		}
+		var p localPart
+		if err := readJSONFile(filepath.Join(dir, fi.Name()), &p); err != nil {
+			return nil, err
+		}
+		part := &s3.Part{
+			PartNumber: aws.Int64(n),
+			ETag:       aws.String(`"` + p.ETag + `"`),
+			Size:       aws.Int64(p.Size),
+		}
+		setListedChecksum(part, u.ChecksumAlgorithm, p.Checksum)
+		parts = append(parts, part)
+	}
+	sort.Slice(parts, func(i, j int) bool { return *parts[i].PartNumber < *parts[j].PartNumber })
+	return parts, nil
+}
+
+// setListedChecksum sets the checksum of the part listed with the algorithm.
+func setListedChecksum(part *s3.Part, alg, checksum string) {
+	if checksum == "" {
+		return
+	}
+	switch alg {
+	case internal.ChecksumSHA256:
+		part.ChecksumSHA256 = aws.String(checksum)
+	case internal.ChecksumSHA1:
+		part.ChecksumSHA1 = aws.String(checksum)
+	case internal.ChecksumCRC32:
+		part.ChecksumCRC32 = aws.String(checksum)
+	case internal.ChecksumCRC32C:
+		part.ChecksumCRC32C = aws.String(checksum)
+	}
+}
+
+func (b *localBackend) CompleteUpload(ctx context.Context, input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	key, uploadID := aws.StringValue(input.Key), aws.StringValue(input.UploadId)
+	defer b.lock(uploadID)()
+	dir, u, err := b.upload(key, uploadID)
+	if err != nil {
+		return nil, err
+	}
+	listed, err := b.listParts(dir, u)
+	if err != nil {
+		return nil, err
+	}
+	uploaded := make(map[int64]*s3.Part)
+	for _, p := range listed {
+		uploaded[*p.PartNumber] = p
+	}
+
+	// the parts are checked as S3 does before assembling the object
+	var parts []*s3.CompletedPart
+	if input.MultipartUpload != nil {
+		parts = input.MultipartUpload.Parts
+	}
+	if len(parts) == 0 {
+		return nil, awserr.New("MalformedXML", "the upload needs at least one part", nil)
+	}
+	var prev int64
+	for _, p := range parts {
+		n := aws.Int64Value(p.PartNumber)
+		if n <= prev {
+			return nil, awserr.New(ErrCodeInvalidPartOrder, "the parts must be in ascending order", nil)
+		}
+		prev = n
+		up, ok := uploaded[n]
+		if !ok || strings.Trim(aws.StringValue(p.ETag), `"`) != strings.Trim(aws.StringValue(up.ETag), `"`) {
+			return nil, awserr.New(ErrCodeInvalidPart, fmt.Sprintf("part %v was not uploaded or its ETag doesn't match", n), nil)
+		}
+		if want := completedChecksum(p, u.ChecksumAlgorithm); want != "" && want != partChecksums(up)[u.ChecksumAlgorithm] {
+			return nil, awserr.New(ErrCodeInvalidPart, fmt.Sprintf("the checksum of part %v doesn't match", n), nil)
+		}
+	}
+	for _, p := range parts[:len(parts)-1] {
+		if n := aws.Int64Value(p.PartNumber); aws.Int64Value(uploaded[n].Size) < minPartSize {
+			return nil, awserr.New(ErrCodeEntityTooSmall, fmt.Sprintf("part %v is smaller than %v bytes", n, minPartSize), nil)
+		}
+	}
+
+	objectPath, err := b.objectPath(key)
+	if err != nil {
+		return nil, err
+	}
+	obj, err := b.assemble(dir, objectPath, parts)
+	if err != nil {
+		return nil, err
+	}
+	obj.ContentType, obj.Metadata = u.ContentType, u.Metadata
+	if err := writeJSONFile(filepath.Join(b.dir, "meta", filepath.FromSlash(key)+".json"), obj); err != nil {
+		return nil, err
+	}
+	if err := os.RemoveAll(dir); err != nil {
+		return nil, err
+	}
+	return &s3.CompleteMultipartUploadOutput{
+		Location: aws.String(b.location(key)),
+		Bucket:   aws.String(bucketName),
+		Key:      aws.String(key),
+		ETag:     aws.String(obj.ETag),
+	}, nil
+}
+
+// location returns the URL of the object, it is not served.
+func (b *localBackend) location(key string) string {
+	return b.baseURL + (&url.URL{Path: "/local/objects/" + key}).EscapedPath()
+}
+
+// assemble concatenates the parts into the object and returns its size
+// and ETag, the MD5 of the MD5s of the parts as S3.
+func (b *localBackend) assemble(dir, objectPath string, parts []*s3.CompletedPart) (*localObject, error) {
+	if err := os.MkdirAll(filepath.Dir(objectPath), 0755); err != nil {
+		return nil, err
+	}
+	f, err := ioutil.TempFile(filepath.Dir(objectPath), ".upload")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	obj := &localObject{}
+	etags := md5.New()
+	for _, p := range parts {
+		n := strconv.FormatInt(aws.Int64Value(p.PartNumber), 10)
+		part, err := os.Open(filepath.Join(dir, n))
+		if err != nil {
+			return nil, err
+		}
+		size, err := io.Copy(f, part)
+		part.Close()
+		if err != nil {
+			return nil, err
+		}
+		obj.Size += size
+		sum, _ := hex.DecodeString(strings.Trim(aws.StringValue(p.ETag), `"`))
+		etags.Write(sum)
+	}
+	if err := f.Close(); err != nil {
+		return nil, err
+	}
+	if err := os.Rename(f.Name(), objectPath); err != nil {
+		return nil, err
+	}
+	obj.ETag = fmt.Sprintf(`"%s-%v"`, hex.EncodeToString(etags.Sum(nil)), len(parts))
+	return obj, nil
+}
+
+// completedChecksum returns the checksum of the part sent by the client with the algorithm.
+func completedChecksum(p *s3.CompletedPart, alg string) string {
+	switch alg {
+	case internal.ChecksumSHA256:
+		return aws.StringValue(p.ChecksumSHA256)
+	case internal.ChecksumSHA1:
+		return aws.StringValue(p.ChecksumSHA1)
+	case internal.ChecksumCRC32:
+		return aws.StringValue(p.ChecksumCRC32)
+	case internal.ChecksumCRC32C:
+		return aws.StringValue(p.ChecksumCRC32C)
+	}
+	return ""
+}
+
+func (b *localBackend) AbortUpload(ctx context.Context, input *s3.AbortMultipartUploadInput) error {
+	defer b.lock(aws.StringValue(input.UploadId))()
+	dir, _, err := b.upload(aws.StringValue(input.Key), aws.StringValue(input.UploadId))
+	if err != nil {
+		return err
+	}
+	return os.RemoveAll(dir)
+}
+
+// writeJSONFile replaces the file with v encoded, not leaving it half written.
+func writeJSONFile(filename string, v interface{}) error {
+	if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+func readJSONFile(filename string, v interface{}) error {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(data, v)
+}
@@ -0,0 +1,456 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/gostones/s3upload/internal"
+	. "github.com/gostones/s3upload/internal/types"
+	"github.com/gostones/s3upload/pkg/uploader"
+)
+
+// newLocalServer runs the server with the local backend in a temporary
+// directory, and its part server.
+func newLocalServer(t *testing.T) (*httptest.Server, *localBackend, func()) {
+	dir := tempDir(t)
+	b, err := newLocalBackend(dir, "", []byte("secret"))
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	srv := newServer(b, newUploadStore(""), nil, nil)
+	ts := httptest.NewServer(requestLogger(newRouter(srv)))
+	ps := httptest.NewServer(requestLogger(b.handler()))
+	b.baseURL = ps.URL
+	return ts, b, func() {
+		ts.Close()
+		ps.Close()
+		os.RemoveAll(b.dir)
+	}
+}
+
+func base64MD5(b []byte) string {
+	sum := md5.Sum(b)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func base64SHA256(b []byte) string {
+	sum := sha256.Sum256(b)
+	return base64.StdEncoding.EncodeToString(sum[:])
+}
+
+// put PUTs the body to the url and returns the status and the error code.
+func put(t *testing.T, u string, headers http.Header, body []byte) (int, string) {
+	req, err := http.NewRequest(http.MethodPut, u, bytes.NewReader(body))
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	for k := range headers {
+		req.Header.Set(k, headers.Get(k))
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer resp.Body.Close()
+	var e ErrorResponse
+	json.NewDecoder(resp.Body).Decode(&e)
+	return resp.StatusCode, e.Error.Code
+}
+
+func startLocalUpload(t *testing.T, b *localBackend, key, alg string) string {
+	input := &s3.CreateMultipartUploadInput{Key: aws.String(key)}
+	if alg != "" {
+		input.ChecksumAlgorithm = aws.String(alg)
+	}
+	uploadID, err := b.CreateUpload(context.Background(), input)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return uploadID
+}
+
+func TestLocalUpload(t *testing.T) {
+	ts, b, closeServer := newLocalServer(t)
+	defer closeServer()
+
+	content := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 250000)
+	u := uploader.New(uploader.Options{
+		BaseURL:           ts.URL,
+		ChunkSize:         minPartSize,
+		ChecksumAlgorithm: internal.ChecksumSHA256,
+		Metadata:          map[string]string{"project": "fox"},
+	})
+	result, err := u.Upload(context.Background(), bytes.NewReader(content), int64(len(content)), "animals/fox.txt")
+	t.Logf("result: %+v error: %v", result, err)
+	if err != nil {
+		t.FailNow()
+	}
+	if !strings.HasSuffix(result.ETag, `-3"`) || result.Location != b.baseURL+"/local/objects/animals/fox.txt" {
+		t.FailNow()
+	}
+	object, err := ioutil.ReadFile(filepath.Join(b.dir, "objects", "animals", "fox.txt"))
+	if err != nil || !bytes.Equal(object, content) {
+		t.Log(err)
+		t.FailNow()
+	}
+	var meta localObject
+	if err := readJSONFile(filepath.Join(b.dir, "meta", "animals", "fox.txt.json"), &meta); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	t.Logf("meta: %+v", meta)
+	if meta.ETag != result.ETag || meta.Size != int64(len(content)) || meta.Metadata["project"] != "fox" {
+		t.FailNow()
+	}
+	uploads, _ := ioutil.ReadDir(filepath.Join(b.dir, "uploads"))
+	if len(uploads) != 0 {
+		t.Log("upload not removed")
+		t.FailNow()
+	}
+}
+
+func TestLocalPutPart(t *testing.T) {
+	_, b, closeServer := newLocalServer(t)
+	defer closeServer()
+	uploadID := startLocalUpload(t, b, "fox.txt", internal.ChecksumSHA256)
+
+	good := []byte("The quick brown fox")
+	bad := []byte("The quick brown dog")
+	presign := func(expire time.Duration, body []byte) (string, http.Header) {
+		u, headers, err := b.PresignPart(&PutObjectInput{
+			Key:               "fox.txt",
+			UploadID:          uploadID,
+			PartNumber:        "1",
+			MD5:               base64MD5(body),
+			ChecksumAlgorithm: internal.ChecksumSHA256,
+			Checksum:          base64SHA256(body),
+		}, expire)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		return u, headers
+	}
+	u, headers := presign(time.Minute, good)
+	if status, code := put(t, u, headers, good); status != http.StatusOK {
+		t.Logf("put: %v %v", status, code)
+		t.FailNow()
+	}
+
+	tests := []struct {
+		name   string
+		url    func() (string, http.Header)
+		body   []byte
+		status int
+		code   string
+	}{
+		{"bad signature", func() (string, http.Header) {
+			u, headers := presign(time.Minute, good)
+			return strings.Replace(u, "signature=", "signature=0", 1), headers
+		}, good, http.StatusForbidden, "SignatureDoesNotMatch"},
+		{"header not signed", func() (string, http.Header) {
+			u, headers := presign(time.Minute, good)
+			headers.Set("Content-MD5", base64MD5(bad))
+			return u, headers
+		}, bad, http.StatusForbidden, "SignatureDoesNotMatch"},
+		{"expired", func() (string, http.Header) {
+			return presign(-time.Minute, good)
+		}, good, http.StatusForbidden, ErrCodeAccessDenied},
+		{"bad digest", func() (string, http.Header) {
+			return presign(time.Minute, good)
+		}, bad, http.StatusBadRequest, "BadDigest"},
+		{"bad checksum", func() (string, http.Header) {
+			// the MD5 only is of the body
+			u, headers, _ := b.PresignPart(&PutObjectInput{
+				Key:               "fox.txt",
+				UploadID:          uploadID,
+				PartNumber:        "1",
+				MD5:               base64MD5(bad),
+				ChecksumAlgorithm: internal.ChecksumSHA256,
+				Checksum:          base64SHA256(good),
+			}, time.Minute)
+			return u, headers
+		}, bad, http.StatusBadRequest, "BadDigest"},
+		{"no such upload", func() (string, http.Header) {
+			u, headers, _ := b.PresignPart(&PutObjectInput{Key: "fox.txt", UploadID: strings.Repeat("0", 32), PartNumber: "1"}, time.Minute)
+			return u, headers
+		}, good, http.StatusNotFound, ErrCodeNoSuchUpload},
+	}
+	for _, test := range tests {
+		u, headers := test.url()
+		status, code := put(t, u, headers, test.body)
+		t.Logf("%s: %v %v", test.name, status, code)
+		if status != test.status || code != test.code {
+			t.FailNow()
+		}
+	}
+
+	// the failed retries didn't replace the part uploaded
+	parts, err := b.ListParts(context.Background(), "fox.txt", uploadID)
+	if err != nil || len(parts) != 1 || aws.StringValue(parts[0].ChecksumSHA256) != base64SHA256(good) {
+		t.Log(err)
+		t.FailNow()
+	}
+	_, err = b.CompleteUpload(context.Background(), &s3.CompleteMultipartUploadInput{
+		Key:             aws.String("fox.txt"),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: []*s3.CompletedPart{{PartNumber: aws.Int64(1), ETag: parts[0].ETag}}},
+	})
+	object, _ := ioutil.ReadFile(filepath.Join(b.dir, "objects", "fox.txt"))
+	if err != nil || !bytes.Equal(object, good) {
+		t.Log(err)
+		t.FailNow()
+	}
+}
+
+func TestLocalPartNumber(t *testing.T) {
+	_, b, closeServer := newLocalServer(t)
+	defer closeServer()
+	uploadID := startLocalUpload(t, b, "fox.txt", "")
+
+	body := []byte("The quick brown fox")
+	for _, partNumber := range []string{"01", "+1"} {
+		// signed as sent, stored as part 1
+		expires := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+		q := url.Values{}
+		q.Set("key", "fox.txt")
+		q.Set("uploadId", uploadID)
+		q.Set("partNumber", partNumber)
+		q.Set("expires", expires)
+		q.Set("signature", b.sign("fox.txt", uploadID, partNumber, expires, "", "", ""))
+		status, code := put(t, b.baseURL+localPartPath+"?"+q.Encode(), nil, body)
+		t.Logf("%s: %v %v", partNumber, status, code)
+		if status != http.StatusOK {
+			t.FailNow()
+		}
+	}
+	u, _, err := b.PresignPart(&PutObjectInput{Key: "fox.txt", UploadID: uploadID, PartNumber: "002"}, time.Minute)
+	if err != nil || !strings.Contains(u, "partNumber=2&") {
+		t.Log(u, err)
+		t.FailNow()
+	}
+	files, _ := ioutil.ReadDir(filepath.Join(b.dir, "uploads", uploadID))
+	var names []string
+	for _, fi := range files {
+		names = append(names, fi.Name())
+	}
+	t.Logf("files: %v", names)
+	if strings.Join(names, ",") != "1,1.json,upload.json" {
+		t.FailNow()
+	}
+	parts, err := b.ListParts(context.Background(), "fox.txt", uploadID)
+	if err != nil || len(parts) != 1 {
+		t.Log(err)
+		t.FailNow()
+	}
+	_, err = b.CompleteUpload(context.Background(), &s3.CompleteMultipartUploadInput{
+		Key:             aws.String("fox.txt"),
+		UploadId:        aws.String(uploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: []*s3.CompletedPart{{PartNumber: aws.Int64(1), ETag: parts[0].ETag}}},
+	})
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+}
+
+func TestLocalConcurrentPut(t *testing.T) {
+	_, b, closeServer := newLocalServer(t)
+	defer closeServer()
+	uploadID := startLocalUpload(t, b, "fox.txt", "")
+
+	// the same part is PUT with different content at once, the part listed
+	// is the one stored
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			body := bytes.Repeat([]byte{byte('a' + i)}, 100000*(i+1))
+			u, headers, err := b.PresignPart(&PutObjectInput{Key: "fox.txt", UploadID: uploadID, PartNumber: "1", MD5: base64MD5(body)}, time.Minute)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			req, _ := http.NewRequest(http.MethodPut, u, bytes.NewReader(body))
+			for k := range headers {
+				req.Header.Set(k, headers.Get(k))
+			}
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp.Body.Close()
+		}(i)
+	}
+	wg.Wait()
+	parts, err := b.ListParts(context.Background(), "fox.txt", uploadID)
+	if err != nil || len(parts) != 1 {
+		t.Log(err)
+		t.FailNow()
+	}
+	stored, _ := ioutil.ReadFile(filepath.Join(b.dir, "uploads", uploadID, "1"))
+	sum := md5.Sum(stored)
+	t.Logf("listed: %v %v stored: %v", aws.StringValue(parts[0].ETag), aws.Int64Value(parts[0].Size), len(stored))
+	if aws.StringValue(parts[0].ETag) != `"`+hex.EncodeToString(sum[:])+`"` || aws.Int64Value(parts[0].Size) != int64(len(stored)) {
+		t.FailNow()
+	}
+}
+
+func TestLocalComplete(t *testing.T) {
+	_, b, closeServer := newLocalServer(t)
+	defer closeServer()
+	uploadID := startLocalUpload(t, b, "fox.txt", "")
+
+	bodies := [][]byte{bytes.Repeat([]byte("a"), minPartSize), []byte("b"), []byte("c")}
+	etags := make([]string, len(bodies))
+	for i, body := range bodies {
+		u, headers, err := b.PresignPart(&PutObjectInput{Key: "fox.txt", UploadID: uploadID, PartNumber: strconv.Itoa(i + 1)}, time.Minute)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		if status, code := put(t, u, headers, body); status != http.StatusOK {
+			t.Logf("put: %v %v", status, code)
+			t.FailNow()
+		}
+		sum := md5.Sum(body)
+		etags[i] = `"` + hex.EncodeToString(sum[:]) + `"`
+	}
+	part := func(n int64, etag string) *s3.CompletedPart {
+		return &s3.CompletedPart{PartNumber: aws.Int64(n), ETag: aws.String(etag)}
+	}
+
+	tests := []struct {
+		name   string
+		parts  []*s3.CompletedPart
+		status int
+		code   string
+	}{
+		{"part order", []*s3.CompletedPart{part(2, etags[1]), part(1, etags[0])}, http.StatusBadRequest, ErrCodeInvalidPartOrder},
+		{"wrong etag", []*s3.CompletedPart{part(1, etags[1]), part(2, etags[1])}, http.StatusBadRequest, ErrCodeInvalidPart},
+		{"missing part", []*s3.CompletedPart{part(1, etags[0]), part(4, etags[1])}, http.StatusBadRequest, ErrCodeInvalidPart},
+		{"too small", []*s3.CompletedPart{part(2, etags[1]), part(3, etags[2])}, http.StatusBadRequest, ErrCodeEntityTooSmall},
+		{"no such upload", nil, http.StatusNotFound, ErrCodeNoSuchUpload},
+		{"no parts", nil, http.StatusBadRequest, "MalformedXML"},
+		{"completed", []*s3.CompletedPart{part(1, etags[0]), part(3, etags[2])}, 0, ""},
+	}
+	for _, test := range tests {
+		id := uploadID
+		if test.code == ErrCodeNoSuchUpload {
+			id = strings.Repeat("0", 32)
+		}
+		output, err := b.CompleteUpload(context.Background(), &s3.CompleteMultipartUploadInput{
+			Key:             aws.String("fox.txt"),
+			UploadId:        aws.String(id),
+			MultipartUpload: &s3.CompletedMultipartUpload{Parts: test.parts},
+		})
+		t.Logf("%s: %v", test.name, err)
+		if test.code == "" {
+			if err != nil || aws.StringValue(output.ETag) == "" {
+				t.FailNow()
+			}
+			continue
+		}
+		if status, code := errorStatus(err); status != test.status || code != test.code {
+			t.FailNow()
+		}
+	}
+	object, _ := ioutil.ReadFile(filepath.Join(b.dir, "objects", "fox.txt"))
+	if !bytes.Equal(object, append(append([]byte{}, bodies[0]...), bodies[2]...)) {
+		t.FailNow()
+	}
+}
+
+func TestLocalObjectKey(t *testing.T) {
+	b := &localBackend{dir: "data"}
+	for key, valid := range map[string]bool{
+		"fox.txt":          true,
+		"animals/fox.txt":  true,
+		"":                 false,
+		"animals/":         false,
+		"../fox.txt":       false,
+		"animals/../x.txt": false,
+		"/fox.txt":         false,
+		"animals//fox.txt": false,
+	} {
+		_, err := b.objectPath(key)
+		if (err == nil) != valid {
+			t.Logf("key %q: %v", key, err)
+			t.FailNow()
+		}
+	}
+	if u := (&localBackend{baseURL: "http://localhost:4000"}).location("a b/c?.txt"); u != "http://localhost:4000/local/objects/a%20b/c%3F.txt" {
+		t.Log(u)
+		t.FailNow()
+	}
+}
+
+func TestLocalCompose(t *testing.T) {
+	ts, b, closeServer := newLocalServer(t)
+	defer closeServer()
+
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+	head := bytes.Repeat([]byte("The quick brown fox "), minPartSize/20)
+	tail := []byte("jumps over the lazy dog")
+	filename := filepath.Join(dir, "segments")
+	if err := ioutil.WriteFile(filename, append(append([]byte{}, head...), tail...), 0644); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// the parts uploaded are completed by the compose
+	u := uploader.New(uploader.Options{BaseURL: ts.URL, ChecksumAlgorithm: internal.ChecksumSHA256})
+	result, err := u.Compose(context.Background(), "fox.txt",
+		uploader.ComposePart{File: &uploader.Range{Filename: filename, Length: int64(len(head))}},
+		uploader.ComposePart{File: &uploader.Range{Filename: filename, Offset: int64(len(head)), Length: -1}},
+	)
+	t.Logf("result: %+v error: %v", result, err)
+	if err != nil || !strings.HasSuffix(result.ETag, `-2"`) {
+		t.FailNow()
+	}
+	object, _ := ioutil.ReadFile(filepath.Join(b.dir, "objects", "fox.txt"))
+	if !bytes.Equal(object, append(append([]byte{}, head...), tail...)) {
+		t.FailNow()
+	}
+
+	// the local backend can't copy
+	_, err = u.Compose(context.Background(), "fox.txt", uploader.ComposePart{Source: "fox.txt", Length: 1})
+	t.Logf("error: %v", err)
+	e, ok := err.(*uploader.Error)
+	if !ok || e.Op != uploader.OpCompose {
+		t.FailNow()
+	}
+	if se, ok := e.Err.(*uploader.StatusError); !ok || se.StatusCode != http.StatusNotImplemented {
+		t.FailNow()
+	}
+	uploads, _ := ioutil.ReadDir(filepath.Join(b.dir, "uploads"))
+	if len(uploads) != 0 {
+		t.Log("upload not removed")
+		t.FailNow()
+	}
+}
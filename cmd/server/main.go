@@ -1,11 +1,13 @@
 package main
 
 import (
-	"encoding/json"
+	"context"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
+	"os/signal"
+	"strings"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
@@ -14,6 +16,9 @@ import (
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/gorilla/mux"
+	"github.com/gostones/s3upload/internal/logging"
+	. "github.com/gostones/s3upload/internal/types"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
 const port = 4000
@@ -24,6 +29,8 @@ var secretAccessKey = "" // Set AWS_SECRET_ACCESS_KEY env with your secret acces
 
 var bucketName = "" // Set AWS_BUCKET_NAME env with your S3 bucket name
 
+var logger = logging.Default
+
 // Change endpoint/region to your region
 const (
 	endpoint         = "http://s3-us-west-2.amazonaws.com"
@@ -32,106 +39,6 @@ const (
 	signatureVersion = "v4"
 )
 
-type startUploadRequest struct {
-	FileName string `json:"fileName"`
-	FileType string `json:"fileType"`
-}
-
-func parseStartUploadRequest(r *http.Request) *startUploadRequest {
-	q := r.URL.Query()
-	return &startUploadRequest{
-		FileName: q.Get("fileName"),
-		FileType: q.Get("fileType"),
-	}
-}
-
-type startUploadResponse struct {
-	UploadID string `json:"uploadId"`
-}
-
-func writeStartUploadResponse(w http.ResponseWriter, uploadId string) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(&startUploadResponse{
-		UploadID: uploadId,
-	})
-}
-
-type getUploadRequest struct {
-	FileName   string `json:"fileName"`
-	PartNumber string `json:"partNumber"`
-	UploadID   string `json:"uploadId"`
-	MD5        string `json:"md5"`
-}
-
-func parseGetUploadRequest(r *http.Request) *getUploadRequest {
-	q := r.URL.Query()
-	return &getUploadRequest{
-		FileName:   q.Get("fileName"),
-		PartNumber: q.Get("partNumber"),
-		UploadID:   q.Get("uploadId"),
-		MD5:        q.Get("md5"),
-	}
-}
-
-type getUploadResponse struct {
-	PresignedURL string `json:"presignedUrl"`
-}
-
-func writeGetUploadResponse(w http.ResponseWriter, pURL string) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(&getUploadResponse{
-		PresignedURL: pURL,
-	})
-}
-
-type completeUploadRequest struct {
-	Params completeUploadParams `json:"params"`
-}
-
-type completeUploadParams struct {
-	FileName string               `json:"fileName"`
-	Parts    []completeUploadPart `json:"parts"`
-	UploadID string               `json:"uploadId"`
-}
-
-type completeUploadPart struct {
-	ETag       string
-	PartNumber int64
-}
-
-func parseCompleteUploadRequest(r *http.Request) *completeUploadRequest {
-	var j completeUploadRequest
-	decoder := json.NewDecoder(r.Body)
-	err := decoder.Decode(&j)
-	if err != nil {
-		return nil
-	}
-	return &j
-}
-
-type completeUploadResponse struct {
-	Data completeUploadData `json:"data"`
-}
-
-type completeUploadData struct {
-	Location string
-	Bucket   string
-	Key      string
-	ETag     string
-}
-
-func writeCompleteUploadResponse(w http.ResponseWriter, location, bucket, key, etag string) {
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(&completeUploadResponse{
-		Data: completeUploadData{
-			Location: location,
-			Bucket:   bucket,
-			Key:      key,
-			ETag:     etag,
-		},
-	})
-}
-
 func credentailFromEnv() {
 	accessKeyID = os.Getenv("AWS_ACCESS_KEY_ID")
 	secretAccessKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
@@ -144,7 +51,7 @@ func config() *aws.Config {
 	creds := credentials.NewStaticCredentials(accessKeyID, secretAccessKey, "")
 	_, err := creds.Get()
 	if err != nil {
-		fmt.Printf("bad credentials: %s", err)
+		logger.Warn("bad credentials", "error", err)
 	}
 	cfg := aws.Config{
 		Credentials:      creds,
@@ -163,6 +70,15 @@ type PutObjectInput struct {
 	UploadID   string
 	PartNumber string
 	MD5        string // base64 coded MD5 checksum
+
+	// customer provided key (SSE-C), the client must send the same headers
+	SSECustomerAlgorithm string
+	SSECustomerKey       string // base64 encoded
+	SSECustomerKeyMD5    string
+
+	// base64 coded checksum of the part, sent as x-amz-checksum-* header
+	ChecksumAlgorithm string
+	Checksum          string
 }
 
 // PutObjectRequest generates a "aws/request.Request" representing the
@@ -186,102 +102,214 @@ func PutObjectRequest(svc *s3.S3, input *PutObjectInput) (*request.Request, *s3.
 	return req, output
 }
 
-// Presign returns the signed URL for the input.
-func Presign(svc *s3.S3, input *PutObjectInput, expire time.Duration) (string, error) {
+// Presign returns the signed URL for the input and the signed headers
+// the client must send with the request.
+func Presign(svc *s3.S3, input *PutObjectInput, expire time.Duration) (string, http.Header, error) {
 	req, _ := PutObjectRequest(svc, input)
 	if input.MD5 != "" {
 		req.HTTPRequest.Header.Set("Content-MD5", input.MD5)
 	}
-	url, err := req.Presign(expire)
+	if input.SSECustomerKey != "" {
+		req.HTTPRequest.Header.Set(HeaderSSECustomerAlgorithm, input.SSECustomerAlgorithm)
+		req.HTTPRequest.Header.Set(HeaderSSECustomerKey, input.SSECustomerKey)
+		req.HTTPRequest.Header.Set(HeaderSSECustomerKeyMD5, input.SSECustomerKeyMD5)
+	}
+	if input.Checksum != "" {
+		req.HTTPRequest.Header.Set("x-amz-checksum-"+strings.ToLower(input.ChecksumAlgorithm), input.Checksum)
+	}
+	url, signed, err := req.PresignRequest(expire)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	return url, nil
+	return url, signed, nil
 }
 
-func main() {
-	cfg := config()
-	svc := s3.New(session.New(), cfg)
+// durationFromEnv reads a duration such as "30s" from the environment variable.
+func durationFromEnv(key string, def time.Duration) time.Duration {
+	v := os.Getenv(key)
+	if v == "" {
+		return def
+	}
+	d, err := time.ParseDuration(v)
+	if err != nil {
+		logger.Warn("invalid duration, using default", "env", key, "error", err, "default", def)
+		return def
+	}
+	return d
+}
 
-	//
+// newRouter routes the API of the server.
+func newRouter(srv *server) *mux.Router {
 	r := mux.NewRouter()
+	for path, h := range map[string]http.HandlerFunc{
+		PathStartUpload:    srv.startUpload,
+		PathGetUploadURL:   srv.getUploadURL,
+		PathCompleteUpload: srv.completeUpload,
+		PathAbortUpload:    srv.abortUpload,
+		PathCopyUploadPart: srv.copyUploadPart,
+		PathComposeUpload:  srv.composeUpload,
+		PathGetDownloadURL: srv.getDownloadURL,
+		PathListParts:      srv.listParts,
+	} {
+		r.HandleFunc(path, h)
+		// the unversioned endpoints are kept for the existing clients
+		r.HandleFunc(strings.TrimPrefix(path, "/"+APIVersion), h)
+	}
 
-	r.HandleFunc("/start-upload", func(w http.ResponseWriter, r *http.Request) {
-		q := parseStartUploadRequest(r)
-		log.Printf("start-upload request: %v\n", q)
-		input := &s3.CreateMultipartUploadInput{
-			Bucket:      aws.String(bucketName),
-			Key:         aws.String(q.FileName),
-			ContentType: aws.String(q.FileType),
-		}
-		output, err := svc.CreateMultipartUpload(input)
-		if err != nil {
-			log.Println(err)
-			// no access to original status code, return 500
-			http.Error(w, fmt.Sprintf("can't obtain upload id: %v", err), http.StatusInternalServerError)
-			return
-		}
-		uploadID := *output.UploadId
-		log.Printf("start-upload uploadID: %v\n", uploadID)
-		writeStartUploadResponse(w, uploadID)
-	})
+	r.Handle("/metrics", promhttp.Handler())
 
-	r.HandleFunc("/get-upload-url", func(w http.ResponseWriter, r *http.Request) {
-		q := parseGetUploadRequest(r)
-		log.Printf("get-upload-url request: %v\n", q)
-		input := &PutObjectInput{
-			Bucket:     bucketName,
-			Key:        q.FileName,
-			UploadID:   q.UploadID,
-			PartNumber: q.PartNumber,
-			MD5:        q.MD5,
-		}
-		u, err := Presign(svc, input, time.Minute*15)
-		if err != nil {
-			fmt.Fprintf(w, "can't presign url %s\n", err.Error())
-			return
-		}
-		log.Printf("get-upload-url url: %v\n", u)
-		writeGetUploadResponse(w, u)
+	// the browser uploader
+	r.HandleFunc("/upload", uploadPage).Methods(http.MethodGet)
+
+	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "ok")
 	})
 
-	r.HandleFunc("/complete-upload", func(w http.ResponseWriter, r *http.Request) {
-		q := parseCompleteUploadRequest(r)
-		log.Printf("complete-upload request: %v\n", q)
+	r.NotFoundHandler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeErrorCode(w, http.StatusNotFound, ErrCodeNotFound, fmt.Sprintf("no such endpoint: %s", r.URL.Path))
+	})
+	return r
+}
 
-		var completedParts []*s3.CompletedPart
-		for _, p := range q.Params.Parts {
-			completedParts = append(completedParts, &s3.CompletedPart{
-				ETag:       aws.String(p.ETag),
-				PartNumber: aws.Int64(p.PartNumber),
-			})
+func main() {
+	// Set LOG_LEVEL env to debug, info, warn or error
+	if v := os.Getenv("LOG_LEVEL"); v != "" {
+		level, err := logging.ParseLevel(v)
+		if err != nil {
+			logger.Warn("invalid LOG_LEVEL", "error", err)
 		}
-		input := &s3.CompleteMultipartUploadInput{
-			Bucket:   aws.String(bucketName),
-			Key:      aws.String(q.Params.FileName),
-			UploadId: aws.String(q.Params.UploadID),
-			MultipartUpload: &s3.CompletedMultipartUpload{
-				Parts: completedParts,
-			},
+		logger = logging.New(os.Stderr, level)
+	}
+
+	// Set STORAGE_BACKEND=local env to store the objects on disk, without S3
+	var b backend
+	var local *localBackend
+	if os.Getenv("STORAGE_BACKEND") == "local" {
+		var err error
+		if local, err = localFromEnv(); err != nil {
+			logger.Error("can't open local storage", "error", err)
+			os.Exit(1)
 		}
-		output, err := svc.CompleteMultipartUpload(input)
-		if err != nil {
-			fmt.Fprintf(w, "can't complete upload %s\n", err.Error())
-			return
+		if bucketName = os.Getenv("AWS_BUCKET_NAME"); bucketName == "" {
+			bucketName = "local"
 		}
-		log.Printf("complete-upload request: %v\n", *output)
+		b = local
+	} else {
+		b = &s3Backend{svc: s3.New(session.New(), config())}
+	}
 
-		writeCompleteUploadResponse(w, *output.Location, *output.Bucket, *output.Key, *output.ETag)
-	})
+	// Set SERVER_STATE_FILE env to keep track of in-flight uploads across restarts
+	store := newUploadStore(os.Getenv("SERVER_STATE_FILE"))
+	if err := store.Load(); err != nil {
+		logger.Error("can't load upload state", "error", err)
+	}
+	// Set AUDIT_LOG_FILE and/or AUDIT_WEBHOOK_URL env to record the upload lifecycle
+	audit, err := auditFromEnv()
+	if err != nil {
+		logger.Error("can't open audit log", "error", err)
+		os.Exit(1)
+	}
+	// Set SSE_MODE and SSE_KMS_KEY_ID(S) env to encrypt the uploads
+	if uploadEncryption, err = encryptionFromEnv(); err != nil {
+		logger.Error("invalid server-side encryption", "error", err)
+		os.Exit(1)
+	}
+	// Set NOTIFY_WEBHOOK_URLS env to notify the completion of uploads
+	notify := notifierFromEnv()
+	srv := newServer(b, store, audit, notify)
+	registerMetrics(store)
+
+	// Set CORS_CONFIGURE_BUCKET=true env to add the CORS rule the browsers
+	// need to the bucket, it is only checked otherwise
+	cors := corsFromEnv()
+	if srv.svc != nil {
+		if err := cors.checkBucket(context.Background(), srv.svc, os.Getenv("CORS_CONFIGURE_BUCKET") == "true"); err != nil {
+			logger.Warn("bucket CORS", "error", err)
+		}
+	}
 
-	r.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
-		fmt.Fprintf(w, "ok")
-	})
+	r := newRouter(srv)
 
-	hostport := fmt.Sprintf(":%v", port)
-	fmt.Println("listening on port", hostport)
-	if err := http.ListenAndServe(hostport, r); err != nil {
-		panic(err)
+	// Timeouts are configurable with SERVER_*_TIMEOUT env, e.g. SERVER_WRITE_TIMEOUT=2m
+	hs := &http.Server{
+		Addr:              fmt.Sprintf(":%v", port),
+		Handler:           requestLogger(cors.handler(r)),
+		ReadHeaderTimeout: durationFromEnv("SERVER_READ_HEADER_TIMEOUT", 10*time.Second),
+		ReadTimeout:       durationFromEnv("SERVER_READ_TIMEOUT", 30*time.Second),
+		WriteTimeout:      durationFromEnv("SERVER_WRITE_TIMEOUT", 60*time.Second),
+		IdleTimeout:       durationFromEnv("SERVER_IDLE_TIMEOUT", 120*time.Second),
+	}
+	// The part PUTs of the local storage have their own server, without the
+	// read and write timeouts of the API
+	var ps *http.Server
+	if local != nil {
+		ps = &http.Server{
+			Addr:              fmt.Sprintf(":%v", localPartPort),
+			Handler:           requestLogger(cors.handler(local.handler())),
+			ReadHeaderTimeout: hs.ReadHeaderTimeout,
+			IdleTimeout:       hs.IdleTimeout,
+		}
+	}
+	shutdownTimeout := durationFromEnv("SERVER_SHUTDOWN_TIMEOUT", 30*time.Second)
+	notifyShutdownTimeout := durationFromEnv("NOTIFY_SHUTDOWN_TIMEOUT", 10*time.Second)
+	auditShutdownTimeout := durationFromEnv("AUDIT_SHUTDOWN_TIMEOUT", 10*time.Second)
+
+	// On SIGTERM or interrupt stop accepting new uploads, drain the in-flight
+	// requests and save the upload state before exit.
+	done := make(chan struct{})
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+		s := <-sig
+		logger.Info("shutting down", "signal", s)
+		srv.drain()
+
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := hs.Shutdown(ctx); err != nil {
+			logger.Error("shutdown", "error", err)
+		}
+		if ps != nil {
+			if err := ps.Shutdown(ctx); err != nil {
+				logger.Error("shutdown", "error", err)
+			}
+		}
+		if notify != nil {
+			// the deliveries get their own time, not what is left of the shutdown
+			nctx, ncancel := context.WithTimeout(context.Background(), notifyShutdownTimeout)
+			if err := notify.Close(nctx); err != nil {
+				logger.Error("webhook deliveries abandoned to the dead letter file", "error", err)
+			}
+			ncancel()
+		}
+		if audit != nil {
+			actx, acancel := context.WithTimeout(context.Background(), auditShutdownTimeout)
+			if err := audit.Close(actx); err != nil {
+				logger.Error("audit", "error", err)
+			}
+			acancel()
+		}
+		if err := store.Flush(); err != nil {
+			logger.Error("can't save upload state", "error", err)
+		}
+		close(done)
+	}()
+
+	if ps != nil {
+		go func() {
+			logger.Info("listening for parts", "addr", ps.Addr)
+			if err := ps.ListenAndServe(); err != http.ErrServerClosed {
+				logger.Error("listen", "error", err)
+				os.Exit(1)
+			}
+		}()
+	}
+	logger.Info("listening", "addr", hs.Addr)
+	if err := hs.ListenAndServe(); err != http.ErrServerClosed {
+		logger.Error("listen", "error", err)
+		os.Exit(1)
 	}
+	<-done
+	logger.Info("shutdown complete", "uploads_in_progress", store.Len())
 }
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+const metricsNamespace = "s3upload"
+
+var (
+	uploadsStarted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploads_started_total",
+		Help:      "Number of multipart uploads started.",
+	})
+	uploadsCompleted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploads_completed_total",
+		Help:      "Number of multipart uploads completed.",
+	})
+	uploadsAborted = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "uploads_aborted_total",
+		Help:      "Number of multipart uploads aborted.",
+	})
+	presignsIssued = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "presigns_issued_total",
+		Help:      "Number of presigned part upload URLs issued.",
+	})
+	downloadsPresigned = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "downloads_presigned_total",
+		Help:      "Number of presigned object and range download URLs issued.",
+	})
+	partsCopied = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "parts_copied_total",
+		Help:      "Number of parts copied from existing objects.",
+	})
+	bytesDeclared = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "bytes_declared_total",
+		Help:      "Sum of the file sizes declared by the clients on start-upload.",
+	})
+	s3Duration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "s3_request_duration_seconds",
+		Help:      "Latency of the S3 API calls by operation.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"operation"})
+	s3Errors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "s3_errors_total",
+		Help:      "Number of failed S3 API calls by operation and error code.",
+	}, []string{"operation", "code"})
+)
+
+// registerMetrics registers the server metrics with the default registry.
+// The in-flight upload sessions are read from the store at scrape time.
+func registerMetrics(store *uploadStore) {
+	prometheus.MustRegister(
+		uploadsStarted,
+		uploadsCompleted,
+		uploadsAborted,
+		presignsIssued,
+		downloadsPresigned,
+		partsCopied,
+		bytesDeclared,
+		s3Duration,
+		s3Errors,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "upload_sessions_in_flight",
+			Help:      "Number of multipart uploads started and not yet completed or aborted.",
+		}, func() float64 {
+			return float64(store.Len())
+		}),
+	)
+}
+
+// observeS3 calls fn recording its latency and error code under the S3 operation name.
+func observeS3(op string, fn func() error) error {
+	start := time.Now()
+	err := fn()
+	s3Duration.WithLabelValues(op).Observe(time.Since(start).Seconds())
+	if err != nil {
+		code := "Unknown"
+		if e, ok := err.(awserr.Error); ok {
+			code = e.Code()
+		}
+		s3Errors.WithLabelValues(op, code).Inc()
+	}
+	return err
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"net/http"
+	"regexp"
+	"time"
+
+	"github.com/gostones/s3upload/internal/logging"
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+// validRequestID limits the correlation ids accepted from the clients.
+var validRequestID = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// statusRecorder records the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// requestLogger assigns each request a correlation id, taken from the
+// X-Request-Id header of the client if valid, and makes a logger carrying
+// it available to the handlers with logging.FromContext.
+func requestLogger(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(HeaderRequestID)
+		if !validRequestID.MatchString(id) {
+			id = logging.NewRequestID()
+		}
+		w.Header().Set(HeaderRequestID, id)
+
+		l := logger.With("request_id", id)
+		ctx := logging.WithRequestID(r.Context(), id)
+		ctx = logging.NewContext(ctx, l)
+
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(ctx))
+
+		l.Info("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"status", rec.status,
+			"duration", time.Since(start),
+			"remote", r.RemoteAddr,
+		)
+	})
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+// Notification event types.
+const (
+	eventUploadCompleted = "upload.completed"
+	eventUploadFailed    = "upload.failed"
+	eventUploadAborted   = "upload.aborted"
+)
+
+// notifier delivers the upload events to the webhooks in the background,
+// retrying with exponential backoff and appending the undeliverable events
+// to the dead letter file. Each webhook has its own queue and worker so a
+// slow one doesn't delay the others.
+type notifier struct {
+	urls       []string
+	secret     []byte
+	retries    int
+	backoff    time.Duration
+	deadLetter string
+	client     *http.Client
+
+	mu     sync.Mutex // closed and the queues
+	closed bool
+	queues map[string]chan *delivery
+
+	// canceled when Close gives up, the pending deliveries are then dead lettered
+	stop    context.Context
+	abandon context.CancelFunc
+	wg      sync.WaitGroup
+
+	deadMu sync.Mutex // dead letter file
+}
+
+type delivery struct {
+	url   string
+	event string
+	body  []byte
+}
+
+const notifyQueueSize = 1000
+
+func newNotifier(urls []string, secret string) *notifier {
+	n := &notifier{
+		urls:    urls,
+		secret:  []byte(secret),
+		retries: 5,
+		backoff: time.Second,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		queues:  make(map[string]chan *delivery),
+	}
+	n.stop, n.abandon = context.WithCancel(context.Background())
+	for _, u := range urls {
+		if _, ok := n.queues[u]; ok {
+			continue
+		}
+		queue := make(chan *delivery, notifyQueueSize)
+		n.queues[u] = queue
+		n.wg.Add(1)
+		go n.run(queue)
+	}
+	return n
+}
+
+// notifierFromEnv configures the webhooks from NOTIFY_WEBHOOK_URLS (comma separated),
+// NOTIFY_WEBHOOK_SECRET, NOTIFY_MAX_RETRIES and NOTIFY_DEAD_LETTER_FILE env.
+func notifierFromEnv() *notifier {
+	var urls []string
+	for _, u := range strings.Split(os.Getenv("NOTIFY_WEBHOOK_URLS"), ",") {
+		if u = strings.TrimSpace(u); u != "" {
+			urls = append(urls, u)
+		}
+	}
+	if len(urls) == 0 {
+		return nil
+	}
+	n := newNotifier(urls, os.Getenv("NOTIFY_WEBHOOK_SECRET"))
+	if v, err := strconv.Atoi(os.Getenv("NOTIFY_MAX_RETRIES")); err == nil && v >= 0 {
+		n.retries = v
+	}
+	n.deadLetter = os.Getenv("NOTIFY_DEAD_LETTER_FILE")
+	return n
+}
+
+// Notify queues the event for all the webhooks. It never blocks the caller,
+// the event goes to the dead letter file if the queue is full or the
+// notifier is closed.
+func (n *notifier) Notify(e *UploadEvent) {
+	body, err := json.Marshal(e)
+	if err != nil {
+		logger.Error("notify", "event", e.Event, "error", err)
+		return
+	}
+	for u, queue := range n.queues {
+		d := &delivery{url: u, event: e.Event, body: body}
+		if err := n.enqueue(queue, d); err != nil {
+			n.dead(d, err)
+		}
+	}
+}
+
+func (n *notifier) enqueue(queue chan *delivery, d *delivery) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if n.closed {
+		return fmt.Errorf("notifier closed")
+	}
+	select {
+	case queue <- d:
+		return nil
+	default:
+		return fmt.Errorf("queue full")
+	}
+}
+
+// Close stops accepting events and waits for the queued deliveries until
+// ctx is done, the deliveries still pending are then dead lettered.
+func (n *notifier) Close(ctx context.Context) error {
+	n.mu.Lock()
+	if !n.closed {
+		n.closed = true
+		for _, queue := range n.queues {
+			close(queue)
+		}
+	}
+	n.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		n.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		// the workers fail the remaining deliveries at once
+		n.abandon()
+		<-done
+		return ctx.Err()
+	}
+}
+
+func (n *notifier) run(queue <-chan *delivery) {
+	defer n.wg.Done()
+	for d := range queue {
+		if err := n.deliver(d); err != nil {
+			n.dead(d, err)
+		}
+	}
+}
+
+// deliver posts the event until it is accepted, the retries are exhausted
+// or the notifier gives up on shutdown.
+func (n *notifier) deliver(d *delivery) error {
+	var err error
+	backoff := n.backoff
+	for attempt := 0; attempt <= n.retries; attempt++ {
+		if attempt > 0 {
+			select {
+			case <-time.After(backoff):
+			case <-n.stop.Done():
+				return fmt.Errorf("shutdown: %v", err)
+			}
+			backoff *= 2
+		}
+		if err = n.post(n.stop, d); err == nil {
+			return nil
+		}
+		if n.stop.Err() != nil {
+			return fmt.Errorf("shutdown: %v", err)
+		}
+		logger.Warn("webhook delivery failed", "url", d.url, "event", d.event, "attempt", attempt+1, "error", err)
+	}
+	return err
+}
+
+// sign returns the signature of the body at the timestamp.
+func (n *notifier) sign(timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, n.secret)
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (n *notifier) post(ctx context.Context, d *delivery) error {
+	req, err := http.NewRequest("POST", d.url, bytes.NewReader(d.body))
+	if err != nil {
+		return err
+	}
+	req = req.WithContext(ctx)
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set(HeaderEvent, d.event)
+	req.Header.Set(HeaderTimestamp, timestamp)
+	if len(n.secret) > 0 {
+		req.Header.Set(HeaderSignature, "sha256="+n.sign(timestamp, d.body))
+	}
+	resp, err := n.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook: %s", resp.Status)
+	}
+	return nil
+}
+
+// dead appends the undeliverable event to the dead letter file.
+func (n *notifier) dead(d *delivery, cause error) {
+	logger.Error("webhook delivery abandoned", "url", d.url, "event", d.event, "error", cause)
+	if n.deadLetter == "" {
+		return
+	}
+	line, _ := json.Marshal(&struct {
+		Time    time.Time       `json:"time"`
+		URL     string          `json:"url"`
+		Error   string          `json:"error"`
+		Payload json.RawMessage `json:"payload"`
+	}{time.Now().UTC(), d.url, cause.Error(), d.body})
+
+	n.deadMu.Lock()
+	defer n.deadMu.Unlock()
+	f, err := os.OpenFile(n.deadLetter, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		logger.Error("dead letter", "error", err)
+		return
+	}
+	defer f.Close()
+	if _, err := f.Write(append(line, '\n')); err != nil {
+		logger.Error("dead letter", "error", err)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+// deadLetters returns the lines of the dead letter file.
+func deadLetters(t *testing.T, filename string) []map[string]interface{} {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer f.Close()
+	var lines []map[string]interface{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		var line map[string]interface{}
+		if err := json.Unmarshal(scanner.Bytes(), &line); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		lines = append(lines, line)
+	}
+	return lines
+}
+
+func tempDir(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "s3upload")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return dir
+}
+
+func TestNotifySignature(t *testing.T) {
+	var mu sync.Mutex
+	var received []*http.Request
+	var bodies [][]byte
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		received = append(received, r)
+		bodies = append(bodies, body)
+		mu.Unlock()
+	}))
+	defer s.Close()
+
+	n := newNotifier([]string{s.URL}, "secret")
+	n.Notify(&UploadEvent{Event: eventUploadCompleted, Key: "fox.txt", UploadID: "id"})
+	if err := n.Close(context.Background()); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if len(received) != 1 {
+		t.Logf("received: %v", len(received))
+		t.FailNow()
+	}
+	r, body := received[0], bodies[0]
+	t.Logf("headers: %v body: %s", r.Header, body)
+	if r.Header.Get(HeaderEvent) != eventUploadCompleted {
+		t.FailNow()
+	}
+	if r.Header.Get(HeaderSignature) != "sha256="+n.sign(r.Header.Get(HeaderTimestamp), body) {
+		t.FailNow()
+	}
+	// the signature covers the timestamp
+	if n.sign("0", body) == n.sign(r.Header.Get(HeaderTimestamp), body) {
+		t.FailNow()
+	}
+	var e UploadEvent
+	if err := json.Unmarshal(body, &e); err != nil || e.Key != "fox.txt" {
+		t.Log(err)
+		t.FailNow()
+	}
+}
+
+func TestNotifyRetry(t *testing.T) {
+	var attempts int32
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&attempts, 1) < 3 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer s.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	n := newNotifier([]string{s.URL}, "")
+	n.backoff = time.Millisecond
+	n.deadLetter = filepath.Join(dir, "dead.jsonl")
+	n.Notify(&UploadEvent{Event: eventUploadCompleted})
+	if err := n.Close(context.Background()); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	t.Logf("attempts: %v", attempts)
+	if attempts != 3 || len(deadLetters(t, n.deadLetter)) != 0 {
+		t.FailNow()
+	}
+}
+
+func TestNotifyDeadLetter(t *testing.T) {
+	var attempts int32
+	failing := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&attempts, 1)
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	defer failing.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	n := newNotifier([]string{failing.URL}, "")
+	n.retries = 2
+	n.backoff = time.Millisecond
+	n.deadLetter = filepath.Join(dir, "dead.jsonl")
+	n.Notify(&UploadEvent{Event: eventUploadFailed, Key: "fox.txt"})
+	if err := n.Close(context.Background()); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	// events after close are dead lettered, not sent on the closed queue
+	n.Notify(&UploadEvent{Event: eventUploadAborted, Key: "dog.txt"})
+
+	lines := deadLetters(t, n.deadLetter)
+	t.Logf("attempts: %v dead letters: %v", attempts, lines)
+	if attempts != 3 || len(lines) != 2 {
+		t.FailNow()
+	}
+	if lines[0]["url"] != failing.URL || lines[0]["payload"].(map[string]interface{})["key"] != "fox.txt" {
+		t.FailNow()
+	}
+	if lines[1]["error"] != "notifier closed" {
+		t.FailNow()
+	}
+}
+
+func TestNotifyCloseTimeout(t *testing.T) {
+	// a slow webhook doesn't delay the others
+	release := make(chan struct{})
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer slow.Close()
+	defer close(release)
+	var delivered int32
+	fast := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&delivered, 1)
+	}))
+	defer fast.Close()
+	dir := tempDir(t)
+	defer os.RemoveAll(dir)
+
+	n := newNotifier([]string{slow.URL, fast.URL}, "")
+	n.deadLetter = filepath.Join(dir, "dead.jsonl")
+	for i := 0; i < 3; i++ {
+		n.Notify(&UploadEvent{Event: eventUploadCompleted})
+	}
+	for i := 0; i < 100 && atomic.LoadInt32(&delivered) < 3; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err := n.Close(ctx)
+	lines := deadLetters(t, n.deadLetter)
+	t.Logf("close: %v in %v delivered: %v dead letters: %v", err, time.Since(start), delivered, len(lines))
+	if err == nil || delivered != 3 || time.Since(start) > 5*time.Second {
+		t.FailNow()
+	}
+	// the event in flight and the queued ones of the slow webhook
+	if len(lines) != 3 {
+		t.FailNow()
+	}
+	for _, line := range lines {
+		if line["url"] != slow.URL {
+			t.FailNow()
+		}
+	}
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+// S3 limits on the user metadata and the object tags.
+const (
+	maxMetadataSize = 2048
+	maxTags         = 10
+	maxTagKeyLen    = 128
+	maxTagValueLen  = 256
+)
+
+// storageClasses are the storage classes of S3.
+var storageClasses = []string{
+	"STANDARD",
+	"REDUCED_REDUNDANCY",
+	"STANDARD_IA",
+	"ONEZONE_IA",
+	"INTELLIGENT_TIERING",
+	"GLACIER",
+	"DEEP_ARCHIVE",
+}
+
+var validMetaKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// policy restricts the metadata, tags and storage classes a client may set
+// and the objects it may copy or download. An empty list allows any valid value.
+type policy struct {
+	metaKeys         []string
+	tagKeys          []string
+	storageClasses   []string
+	copyPrefixes     []string // key prefixes of the objects copied
+	downloadPrefixes []string // key prefixes of the objects downloaded
+}
+
+// uploadPolicy is configured with POLICY_ALLOWED_META_KEYS, POLICY_ALLOWED_TAG_KEYS,
+// POLICY_ALLOWED_STORAGE_CLASSES, POLICY_ALLOWED_COPY_PREFIXES and
+// POLICY_ALLOWED_DOWNLOAD_PREFIXES env, comma separated.
+var uploadPolicy = policyFromEnv()
+
+func policyFromEnv() *policy {
+	return &policy{
+		metaKeys:       splitList(os.Getenv("POLICY_ALLOWED_META_KEYS")),
+		tagKeys:        splitList(os.Getenv("POLICY_ALLOWED_TAG_KEYS")),
+		storageClasses: splitList(os.Getenv("POLICY_ALLOWED_STORAGE_CLASSES")),
+		copyPrefixes:   splitList(os.Getenv("POLICY_ALLOWED_COPY_PREFIXES")),
+
+		downloadPrefixes: splitList(os.Getenv("POLICY_ALLOWED_DOWNLOAD_PREFIXES")),
+	}
+}
+
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
+func allowed(list []string, v string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, a := range list {
+		if strings.EqualFold(a, v) {
+			return true
+		}
+	}
+	return false
+}
+
+func contains(list []string, v string) bool {
+	for _, a := range list {
+		if a == v {
+			return true
+		}
+	}
+	return false
+}
+
+func (p *policy) validate(req *StartUploadRequest) error {
+	size := 0
+	for k, v := range req.Metadata {
+		if !validMetaKey.MatchString(k) {
+			return badRequest(fmt.Sprintf("invalid metadata key: %q", k))
+		}
+		if !allowed(p.metaKeys, k) {
+			return badRequest(fmt.Sprintf("metadata key not allowed: %q", k))
+		}
+		size += len(k) + len(v)
+	}
+	if size > maxMetadataSize {
+		return badRequest(fmt.Sprintf("metadata exceeds %v bytes", maxMetadataSize))
+	}
+
+	if len(req.Tags) > maxTags {
+		return badRequest(fmt.Sprintf("more than %v tags", maxTags))
+	}
+	for k, v := range req.Tags {
+		if k == "" || len(k) > maxTagKeyLen || len(v) > maxTagValueLen {
+			return badRequest(fmt.Sprintf("invalid tag: %q", k))
+		}
+		if !allowed(p.tagKeys, k) {
+			return badRequest(fmt.Sprintf("tag key not allowed: %q", k))
+		}
+	}
+
+	if c := req.StorageClass; c != "" {
+		if !contains(storageClasses, c) {
+			return badRequest(fmt.Sprintf("invalid storage class: %q", c))
+		}
+		if !allowed(p.storageClasses, c) {
+			return badRequest(fmt.Sprintf("storage class not allowed: %q", c))
+		}
+	}
+	return nil
+}
+
+// validateCopySource checks the object may be copied into an upload.
+func (p *policy) validateCopySource(key string) error {
+	if !hasPrefix(p.copyPrefixes, key) {
+		return badRequest(fmt.Sprintf("copy source not allowed: %q", key))
+	}
+	return nil
+}
+
+// validateDownload checks the object may be downloaded.
+func (p *policy) validateDownload(key string) error {
+	if !hasPrefix(p.downloadPrefixes, key) {
+		return badRequest(fmt.Sprintf("download not allowed: %q", key))
+	}
+	return nil
+}
+
+// hasPrefix reports whether key has one of the prefixes, true if none.
+func hasPrefix(prefixes []string, key string) bool {
+	if len(prefixes) == 0 {
+		return true
+	}
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(key, prefix) {
+			return true
+		}
+	}
+	return false
+}
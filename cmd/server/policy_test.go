@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+func TestPolicyValidate(t *testing.T) {
+	tags := func(n int) map[string]string {
+		m := make(map[string]string)
+		for i := 0; i < n; i++ {
+			m[fmt.Sprintf("tag%v", i)] = "v"
+		}
+		return m
+	}
+	restricted := &policy{
+		metaKeys:       []string{"project", "owner"},
+		tagKeys:        []string{"team"},
+		storageClasses: []string{"STANDARD", "STANDARD_IA"},
+	}
+
+	tests := []struct {
+		name  string
+		p     *policy
+		req   StartUploadRequest
+		valid bool
+	}{
+		{"empty", &policy{}, StartUploadRequest{}, true},
+		{"metadata", &policy{}, StartUploadRequest{Metadata: map[string]string{"project-id_2": "fox"}}, true},
+		{"metadata key with space", &policy{}, StartUploadRequest{Metadata: map[string]string{"project id": "fox"}}, false},
+		{"metadata key with dot", &policy{}, StartUploadRequest{Metadata: map[string]string{"project.id": "fox"}}, false},
+		{"metadata of 2 KB", &policy{}, StartUploadRequest{Metadata: map[string]string{"k": strings.Repeat("v", maxMetadataSize-1)}}, true},
+		{"metadata over 2 KB", &policy{}, StartUploadRequest{Metadata: map[string]string{"k": strings.Repeat("v", maxMetadataSize)}}, false},
+		{"allowed metadata key", restricted, StartUploadRequest{Metadata: map[string]string{"Project": "fox"}}, true},
+		{"metadata key not allowed", restricted, StartUploadRequest{Metadata: map[string]string{"secret": "fox"}}, false},
+		{"10 tags", &policy{}, StartUploadRequest{Tags: tags(maxTags)}, true},
+		{"11 tags", &policy{}, StartUploadRequest{Tags: tags(maxTags + 1)}, false},
+		{"empty tag key", &policy{}, StartUploadRequest{Tags: map[string]string{"": "v"}}, false},
+		{"long tag key", &policy{}, StartUploadRequest{Tags: map[string]string{strings.Repeat("k", maxTagKeyLen+1): "v"}}, false},
+		{"long tag value", &policy{}, StartUploadRequest{Tags: map[string]string{"k": strings.Repeat("v", maxTagValueLen+1)}}, false},
+		{"allowed tag key", restricted, StartUploadRequest{Tags: map[string]string{"team": "a"}}, true},
+		{"tag key not allowed", restricted, StartUploadRequest{Tags: map[string]string{"cost": "a"}}, false},
+		{"storage class", &policy{}, StartUploadRequest{StorageClass: "GLACIER"}, true},
+		{"invalid storage class", &policy{}, StartUploadRequest{StorageClass: "standard"}, false},
+		{"allowed storage class", restricted, StartUploadRequest{StorageClass: "STANDARD_IA"}, true},
+		{"storage class not allowed", restricted, StartUploadRequest{StorageClass: "GLACIER"}, false},
+	}
+	for _, test := range tests {
+		err := test.p.validate(&test.req)
+		t.Logf("%s: %v", test.name, err)
+		if (err == nil) != test.valid {
+			t.FailNow()
+		}
+		if err != nil {
+			if status, code := errorStatus(err); status != 400 || code != ErrCodeInvalidRequest {
+				t.FailNow()
+			}
+		}
+	}
+}
+
+func TestPolicyPrefixes(t *testing.T) {
+	p := &policy{copyPrefixes: []string{"templates/"}, downloadPrefixes: []string{"public/", "shared/"}}
+	for _, test := range []struct {
+		name  string
+		err   error
+		valid bool
+	}{
+		{"copy", p.validateCopySource("templates/fox.txt"), true},
+		{"copy not allowed", p.validateCopySource("private/fox.txt"), false},
+		{"download", p.validateDownload("shared/fox.txt"), true},
+		{"download not allowed", p.validateDownload("templates/fox.txt"), false},
+		{"any copy", (&policy{}).validateCopySource("private/fox.txt"), true},
+		{"any download", (&policy{}).validateDownload("private/fox.txt"), true},
+	} {
+		t.Logf("%s: %v", test.name, test.err)
+		if (test.err == nil) != test.valid {
+			t.FailNow()
+		}
+	}
+}
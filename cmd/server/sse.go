@@ -0,0 +1,163 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+// Server-side encryption of the objects.
+const (
+	sseNone = ""
+	sseS3   = s3.ServerSideEncryptionAes256
+	sseKMS  = s3.ServerSideEncryptionAwsKms
+	sseC    = "SSE-C" // customer provided key, never sent to S3 as is
+)
+
+// sseStrength orders the encryption modes, a client may not request less
+// than the mode configured on the server.
+var sseStrength = map[string]int{
+	sseNone: 0,
+	sseS3:   1,
+	sseC:    1,
+	sseKMS:  2,
+}
+
+// kmsKey is the KMS key of the objects under a key prefix.
+type kmsKey struct {
+	prefix string
+	keyID  string
+}
+
+// encryption is the server-side encryption applied to the uploads.
+type encryption struct {
+	mode    string   // default and minimum mode
+	keyID   string   // default KMS key, the bucket key of S3 if empty
+	kmsKeys []kmsKey // per destination KMS keys, longest prefix first
+}
+
+// uploadEncryption is configured with SSE_MODE env (AES256 or aws:kms),
+// SSE_KMS_KEY_ID and SSE_KMS_KEY_IDS, a comma separated list of prefix=keyId
+// to encrypt each destination with its own key, e.g.
+// SSE_KMS_KEY_IDS=finance/=alias/finance,hr/=alias/hr
+// The server doesn't start with an invalid configuration.
+var uploadEncryption = &encryption{}
+
+func encryptionFromEnv() (*encryption, error) {
+	e := &encryption{
+		mode:  os.Getenv("SSE_MODE"),
+		keyID: os.Getenv("SSE_KMS_KEY_ID"),
+	}
+	if e.mode != sseNone && e.mode != sseS3 && e.mode != sseKMS {
+		return nil, fmt.Errorf("invalid SSE_MODE %q, must be %s or %s", e.mode, sseS3, sseKMS)
+	}
+	for _, v := range splitList(os.Getenv("SSE_KMS_KEY_IDS")) {
+		kv := strings.SplitN(v, "=", 2)
+		if len(kv) != 2 || kv[1] == "" {
+			return nil, fmt.Errorf("invalid SSE_KMS_KEY_IDS entry %q, must be prefix=keyId", v)
+		}
+		e.kmsKeys = append(e.kmsKeys, kmsKey{prefix: kv[0], keyID: kv[1]})
+	}
+	sort.SliceStable(e.kmsKeys, func(i, j int) bool {
+		return len(e.kmsKeys[i].prefix) > len(e.kmsKeys[j].prefix)
+	})
+	return e, nil
+}
+
+// kmsKeyID returns the KMS key of the object key.
+func (e *encryption) kmsKeyID(key string) string {
+	for _, k := range e.kmsKeys {
+		if strings.HasPrefix(key, k.prefix) {
+			return k.keyID
+		}
+	}
+	return e.keyID
+}
+
+// apply sets the encryption of the upload requested by the client,
+// the configured mode if none is requested.
+func (e *encryption) apply(input *s3.CreateMultipartUploadInput, q *StartUploadRequest, c *sseCustomer) error {
+	mode := q.ServerSideEncryption
+	if c != nil {
+		if mode != sseNone {
+			return badRequest("serverSideEncryption can't be combined with a customer key")
+		}
+		mode = sseC
+	}
+	if mode == sseNone {
+		mode = e.mode
+	}
+	if _, ok := sseStrength[mode]; !ok {
+		return badRequest(fmt.Sprintf("invalid serverSideEncryption: %q", mode))
+	}
+	if sseStrength[mode] < sseStrength[e.mode] {
+		return badRequest(fmt.Sprintf("server policy requires %s encryption", e.mode))
+	}
+
+	switch mode {
+	case sseS3:
+		input.ServerSideEncryption = aws.String(sseS3)
+	case sseKMS:
+		input.ServerSideEncryption = aws.String(sseKMS)
+		if id := e.kmsKeyID(q.FileName); id != "" {
+			input.SSEKMSKeyId = aws.String(id)
+		}
+	case sseC:
+		input.SSECustomerAlgorithm = aws.String(c.algorithm)
+		input.SSECustomerKey = aws.String(c.key)
+		input.SSECustomerKeyMD5 = aws.String(c.keyMD5)
+	}
+	return nil
+}
+
+// sseCustomer is the customer provided key (SSE-C) of an upload. The server
+// doesn't keep the key, the client sends it with every request.
+type sseCustomer struct {
+	algorithm string
+	key       string // base64 encoded
+	keyMD5    string // base64 encoded MD5 of the raw key
+}
+
+// parseSSECustomer reads the customer key from the request headers,
+// nil if the request has none.
+func parseSSECustomer(h http.Header) (*sseCustomer, error) {
+	return newSSECustomer(h.Get(HeaderSSECustomerAlgorithm), h.Get(HeaderSSECustomerKey), h.Get(HeaderSSECustomerKeyMD5))
+}
+
+// parseCopySourceSSECustomer reads the customer key of the source object of
+// a copy from the request headers, nil if the request has none.
+func parseCopySourceSSECustomer(h http.Header) (*sseCustomer, error) {
+	return newSSECustomer(h.Get(HeaderCopySourceSSECustomerAlgorithm), h.Get(HeaderCopySourceSSECustomerKey), h.Get(HeaderCopySourceSSECustomerKeyMD5))
+}
+
+// newSSECustomer validates the customer key, nil if none is set.
+func newSSECustomer(algorithm, key, keyMD5 string) (*sseCustomer, error) {
+	c := &sseCustomer{
+		algorithm: algorithm,
+		key:       key,
+		keyMD5:    keyMD5,
+	}
+	if c.algorithm == "" && c.key == "" && c.keyMD5 == "" {
+		return nil, nil
+	}
+	if c.algorithm != sseS3 {
+		return nil, badRequest(fmt.Sprintf("unsupported customer key algorithm: %q", c.algorithm))
+	}
+	raw, err := base64.StdEncoding.DecodeString(c.key)
+	if err != nil || len(raw) != 32 {
+		return nil, badRequest("customer key must be a base64 encoded 256-bit key")
+	}
+	sum := md5.Sum(raw)
+	if c.keyMD5 != base64.StdEncoding.EncodeToString(sum[:]) {
+		return nil, badRequest("customer key MD5 doesn't match the key")
+	}
+	return c, nil
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+func TestEncryptionFromEnv(t *testing.T) {
+	defer os.Unsetenv("SSE_MODE")
+	defer os.Unsetenv("SSE_KMS_KEY_ID")
+	defer os.Unsetenv("SSE_KMS_KEY_IDS")
+
+	tests := []struct {
+		name   string
+		mode   string
+		keyIDs string
+		valid  bool
+		keys   map[string]string // KMS key of the object keys
+	}{
+		{"none", "", "", true, map[string]string{"fox.txt": "alias/default"}},
+		{"AES256", sseS3, "", true, nil},
+		{"kms", sseKMS, "finance/=alias/finance, finance/2019/=alias/2019", true, map[string]string{
+			"fox.txt":              "alias/default",
+			"finance/fox.txt":      "alias/finance",
+			"finance/2019/fox.txt": "alias/2019",
+		}},
+		{"invalid mode", "aws:kms:dsse", "", false, nil},
+		{"lowercase mode", "aes256", "", false, nil},
+		{"entry without key", sseKMS, "finance/=", false, nil},
+		{"entry without =", sseKMS, "finance/", false, nil},
+	}
+	for _, test := range tests {
+		os.Setenv("SSE_MODE", test.mode)
+		os.Setenv("SSE_KMS_KEY_ID", "alias/default")
+		os.Setenv("SSE_KMS_KEY_IDS", test.keyIDs)
+		e, err := encryptionFromEnv()
+		t.Logf("%s: %+v %v", test.name, e, err)
+		if (err == nil) != test.valid {
+			t.FailNow()
+		}
+		if err != nil {
+			continue
+		}
+		if e.mode != test.mode {
+			t.FailNow()
+		}
+		for key, keyID := range test.keys {
+			if id := e.kmsKeyID(key); id != keyID {
+				t.Logf("%s: %s", key, id)
+				t.FailNow()
+			}
+		}
+	}
+}
+
+// customerKey returns a customer key and its MD5, base64 encoded.
+func customerKey(raw []byte) (string, string) {
+	sum := md5.Sum(raw)
+	return base64.StdEncoding.EncodeToString(raw), base64.StdEncoding.EncodeToString(sum[:])
+}
+
+func TestNewSSECustomer(t *testing.T) {
+	key, keyMD5 := customerKey(bytes.Repeat([]byte{1}, 32))
+	shortKey, shortKeyMD5 := customerKey(bytes.Repeat([]byte{1}, 16))
+	_, otherMD5 := customerKey(bytes.Repeat([]byte{2}, 32))
+
+	tests := []struct {
+		name      string
+		algorithm string
+		key       string
+		keyMD5    string
+		valid     bool
+		none      bool
+	}{
+		{"none", "", "", "", true, true},
+		{"valid", sseS3, key, keyMD5, true, false},
+		{"no algorithm", "", key, keyMD5, false, false},
+		{"kms algorithm", sseKMS, key, keyMD5, false, false},
+		{"128-bit key", sseS3, shortKey, shortKeyMD5, false, false},
+		{"not base64", sseS3, "not a key!", keyMD5, false, false},
+		{"wrong MD5", sseS3, key, otherMD5, false, false},
+		{"no MD5", sseS3, key, "", false, false},
+	}
+	for _, test := range tests {
+		c, err := newSSECustomer(test.algorithm, test.key, test.keyMD5)
+		t.Logf("%s: %+v %v", test.name, c, err)
+		if (err == nil) != test.valid || (c == nil) != (test.none || !test.valid) {
+			t.FailNow()
+		}
+		if err != nil {
+			if status, code := errorStatus(err); status != 400 || code != ErrCodeInvalidRequest {
+				t.FailNow()
+			}
+		}
+	}
+}
+
+func TestEncryptionApply(t *testing.T) {
+	key, keyMD5 := customerKey(bytes.Repeat([]byte{1}, 32))
+	customer := &sseCustomer{algorithm: sseS3, key: key, keyMD5: keyMD5}
+	kms := &encryption{mode: sseKMS, keyID: "alias/default", kmsKeys: []kmsKey{{prefix: "finance/", keyID: "alias/finance"}}}
+
+	tests := []struct {
+		name      string
+		e         *encryption
+		file      string
+		requested string
+		customer  *sseCustomer
+		valid     bool
+		sse       string // ServerSideEncryption of the upload
+		keyID     string
+	}{
+		{"none", &encryption{}, "fox.txt", "", nil, true, "", ""},
+		{"server default", &encryption{mode: sseS3}, "fox.txt", "", nil, true, sseS3, ""},
+		{"requested", &encryption{}, "fox.txt", sseKMS, nil, true, sseKMS, ""},
+		{"stronger", &encryption{mode: sseS3}, "fox.txt", sseKMS, nil, true, sseKMS, ""},
+		{"weaker", kms, "fox.txt", sseS3, nil, false, "", ""},
+		{"invalid", &encryption{}, "fox.txt", "aes256", nil, false, "", ""},
+		{"default kms key", kms, "fox.txt", "", nil, true, sseKMS, "alias/default"},
+		{"prefix kms key", kms, "finance/fox.txt", "", nil, true, sseKMS, "alias/finance"},
+		{"customer key", &encryption{mode: sseS3}, "fox.txt", "", customer, true, "", ""},
+		{"customer key under kms", kms, "fox.txt", "", customer, false, "", ""},
+		{"customer key and mode", &encryption{}, "fox.txt", sseS3, customer, false, "", ""},
+	}
+	for _, test := range tests {
+		input := &s3.CreateMultipartUploadInput{}
+		err := test.e.apply(input, &StartUploadRequest{FileName: test.file, ServerSideEncryption: test.requested}, test.customer)
+		t.Logf("%s: %v %v", test.name, input, err)
+		if (err == nil) != test.valid {
+			t.FailNow()
+		}
+		if err != nil {
+			continue
+		}
+		if aws.StringValue(input.ServerSideEncryption) != test.sse || aws.StringValue(input.SSEKMSKeyId) != test.keyID {
+			t.FailNow()
+		}
+		if (test.customer != nil) != (aws.StringValue(input.SSECustomerKeyMD5) == keyMD5) {
+			t.FailNow()
+		}
+	}
+}
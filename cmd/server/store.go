@@ -0,0 +1,110 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"sync"
+	"time"
+)
+
+// uploadSession is a multipart upload started and not yet completed or aborted.
+type uploadSession struct {
+	UploadID    string            `json:"uploadId"`
+	Bucket      string            `json:"bucket"`
+	Key         string            `json:"key"`
+	ContentType string            `json:"contentType"`
+	Size        int64             `json:"size"` // declared by the client, 0 if unknown
+	Metadata    map[string]string `json:"metadata,omitempty"`
+	Started     time.Time         `json:"started"`
+}
+
+// uploadStore keeps track of the in-flight upload sessions.
+// The sessions are saved to file on shutdown and loaded on startup so they
+// survive a restart of the server.
+type uploadStore struct {
+	sync.Mutex
+
+	filename string
+	sessions map[string]*uploadSession
+}
+
+func newUploadStore(filename string) *uploadStore {
+	return &uploadStore{
+		filename: filename,
+		sessions: make(map[string]*uploadSession),
+	}
+}
+
+// Load reads the sessions saved by Flush. A missing file is not an error.
+func (r *uploadStore) Load() error {
+	if r.filename == "" {
+		return nil
+	}
+	b, err := ioutil.ReadFile(r.filename)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var sessions []*uploadSession
+	if err := json.Unmarshal(b, &sessions); err != nil {
+		return err
+	}
+
+	r.Lock()
+	defer r.Unlock()
+	for _, s := range sessions {
+		r.sessions[s.UploadID] = s
+	}
+	return nil
+}
+
+// Flush saves the sessions to file.
+func (r *uploadStore) Flush() error {
+	if r.filename == "" {
+		return nil
+	}
+	r.Lock()
+	sessions := make([]*uploadSession, 0, len(r.sessions))
+	for _, s := range r.sessions {
+		sessions = append(sessions, s)
+	}
+	r.Unlock()
+
+	b, err := json.MarshalIndent(sessions, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write and rename so a crash never leaves a truncated file
+	tmp := r.filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, r.filename)
+}
+
+func (r *uploadStore) Add(s *uploadSession) {
+	r.Lock()
+	r.sessions[s.UploadID] = s
+	r.Unlock()
+}
+
+func (r *uploadStore) Get(uploadID string) *uploadSession {
+	r.Lock()
+	defer r.Unlock()
+	return r.sessions[uploadID]
+}
+
+func (r *uploadStore) Remove(uploadID string) {
+	r.Lock()
+	delete(r.sessions, uploadID)
+	r.Unlock()
+}
+
+func (r *uploadStore) Len() int {
+	r.Lock()
+	defer r.Unlock()
+	return len(r.sessions)
+}
@@ -0,0 +1,332 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+
+	. "github.com/gostones/s3upload/internal/types"
+)
+
+// uploadPage serves the browser uploader. The page uses the versioned API
+// of the server it is loaded from, the bucket must allow the PUT of the
+// parts and expose the ETag header to its origin (see cors.go).
+func uploadPage(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write([]byte(uploadHTML))
+}
+
+// uploadHTML is the browser uploader: the file is sliced into parts with
+// the File API, the parts are PUT in parallel to presigned URLs with their
+// SHA-256 checksums if the page is in a secure context, and the progress
+// of the upload is kept in localStorage to resume it after a reload.
+var uploadHTML = strings.Replace(`<!DOCTYPE html>
+<html lang="en">
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Upload</title>
+<style>
+body { font-family: sans-serif; max-width: 40em; margin: 2em auto; padding: 0 1em; color: #222; }
+label { display: block; margin: 0.8em 0 0.2em; }
+input[type=text], input[type=number] { width: 100%; box-sizing: border-box; padding: 0.3em; }
+button { margin: 1em 0.5em 0 0; padding: 0.4em 1.2em; }
+progress { width: 100%; height: 1.5em; margin-top: 1em; }
+#status { margin-top: 0.5em; white-space: pre-wrap; }
+.error { color: #b00; }
+</style>
+</head>
+<body>
+<h1>Upload</h1>
+<label for="file">File</label>
+<input type="file" id="file">
+<label for="key">Object key</label>
+<input type="text" id="key" placeholder="default to the file name">
+<label for="chunk">Part size in MiB</label>
+<input type="number" id="chunk" min="5" value="16">
+<label for="parallel">Parallel parts</label>
+<input type="number" id="parallel" min="1" max="16" value="4">
+<button id="upload">Upload</button>
+<button id="abort" disabled>Abort</button>
+<progress id="progress" max="1" value="0"></progress>
+<div id="status"></div>
+<script>
+(function () {
+  "use strict";
+
+  var api = "/{{version}}";
+  var retries = 3;
+  var $ = function (id) { return document.getElementById(id); };
+  var current = null; // the upload in progress
+
+  function status(msg, error) {
+    $("status").textContent = msg;
+    $("status").className = error ? "error" : "";
+  }
+
+  // stateKey identifies the file across reloads.
+  function stateKey(file) {
+    return "s3upload:" + [file.name, file.size, file.lastModified].join(":");
+  }
+
+  function loadState(file) {
+    try {
+      return JSON.parse(localStorage.getItem(stateKey(file)));
+    } catch (e) {
+      return null;
+    }
+  }
+
+  function saveState(file, state) {
+    localStorage.setItem(stateKey(file), JSON.stringify(state));
+  }
+
+  function requestID() {
+    var b = new Uint8Array(8);
+    crypto.getRandomValues(b);
+    return Array.prototype.map.call(b, function (x) { return ("0" + x.toString(16)).slice(-2); }).join("");
+  }
+
+  // the requests of the page are traced with the same id, a resumed upload
+  // is of a new session
+  var sessionID = requestID();
+
+  // call sends a request to the server API and returns the decoded JSON.
+  function call(method, path, params, body) {
+    var url = api + path;
+    if (params) {
+      url += "?" + Object.keys(params).map(function (k) {
+        return encodeURIComponent(k) + "=" + encodeURIComponent(params[k]);
+      }).join("&");
+    }
+    var init = { method: method, headers: { "Accept": "application/json", "X-Request-Id": sessionID } };
+    if (body) {
+      init.headers["Content-Type"] = "application/json";
+      init.body = JSON.stringify(body);
+    }
+    return fetch(url, init).then(function (resp) {
+      return resp.text().then(function (text) {
+        var data = text ? JSON.parse(text) : {};
+        if (!resp.ok) {
+          var msg = data.error ? data.error.code + ": " + data.error.message : resp.status + " " + resp.statusText;
+          var err = new Error(path + ": " + msg);
+          err.code = data.error && data.error.code;
+          throw err;
+        }
+        return data;
+      });
+    });
+  }
+
+  function sha256(blob) {
+    if (!window.crypto || !crypto.subtle) {
+      return Promise.resolve("");
+    }
+    return blob.arrayBuffer().then(function (buf) {
+      return crypto.subtle.digest("SHA-256", buf);
+    }).then(function (sum) {
+      return btoa(String.fromCharCode.apply(null, new Uint8Array(sum)));
+    });
+  }
+
+  // put uploads the blob to the presigned url of the upload c reporting
+  // the bytes sent, it is aborted with the upload.
+  function put(c, u, blob, onprogress) {
+    return new Promise(function (resolve, reject) {
+      var xhr = new XMLHttpRequest();
+      c.xhrs.push(xhr);
+      xhr.open("PUT", u.presignedUrl);
+      Object.keys(u.headers || {}).forEach(function (k) {
+        xhr.setRequestHeader(k, u.headers[k]);
+      });
+      xhr.upload.onprogress = function (e) { onprogress(e.loaded); };
+      xhr.onload = function () {
+        var etag = xhr.getResponseHeader("ETag");
+        if (xhr.status !== 200) {
+          reject(new Error("put part: " + xhr.status + " " + xhr.statusText));
+        } else if (!etag) {
+          reject(new Error("put part: the ETag header is not exposed by the bucket CORS configuration"));
+        } else {
+          resolve(etag);
+        }
+      };
+      xhr.onerror = function () { reject(new Error("put part: network error")); };
+      xhr.onabort = function () { reject(new Error("aborted")); };
+      xhr.send(blob);
+    });
+  }
+
+  // uploadPart uploads the part n of the upload c. The upload is captured,
+  // not read from current that a new upload replaces.
+  function uploadPart(c, n, sent) {
+    var file = c.file, state = c.state;
+    var start = (n - 1) * state.chunkSize;
+    var blob = file.slice(start, Math.min(start + state.chunkSize, file.size));
+    return sha256(blob).then(function (checksum) {
+      var params = { fileName: state.key, partNumber: n, uploadId: state.uploadId };
+      if (state.checksumAlgorithm) {
+        params.checksumAlgorithm = state.checksumAlgorithm;
+        params.checksum = checksum;
+      }
+      var attempt = function (i) {
+        if (c.aborted || c.stopped) {
+          return Promise.reject(new Error("aborted"));
+        }
+        return call("GET", "/get-upload-url", params).then(function (u) {
+          return put(c, u, blob, function (loaded) { sent(n, loaded); });
+        }).catch(function (err) {
+          if (c.aborted || c.stopped || i >= retries) {
+            throw err;
+          }
+          sent(n, 0);
+          return new Promise(function (resolve) { setTimeout(resolve, 1000 << i); }).then(function () {
+            return attempt(i + 1);
+          });
+        });
+      };
+      return attempt(0).then(function (etag) {
+        state.parts[n] = { ETag: etag, PartNumber: n, Checksum: checksum || undefined };
+        // the state of an aborted upload is removed, not saved again
+        if (!c.aborted) {
+          saveState(file, state);
+        }
+      });
+    });
+  }
+
+  function upload() {
+    var file = $("file").files[0];
+    if (!file) {
+      status("Choose a file.", true);
+      return;
+    }
+    var state = loadState(file);
+    var resumed = !!state;
+    if (!state) {
+      state = {
+        key: $("key").value || file.name,
+        chunkSize: Math.max(5, parseInt($("chunk").value, 10) || 16) * 1024 * 1024,
+        checksumAlgorithm: window.crypto && crypto.subtle ? "SHA256" : "",
+        parts: {}
+      };
+    }
+    var count = Math.max(1, Math.ceil(file.size / state.chunkSize));
+    var parallel = Math.max(1, parseInt($("parallel").value, 10) || 4);
+    var c = current = { file: file, state: state, xhrs: [], aborted: false, stopped: false };
+    $("upload").disabled = true;
+    $("abort").disabled = false;
+
+    // progress of the parts in flight, the parts done count in full
+    var inflight = {};
+    var sent = function (n, loaded) {
+      inflight[n] = loaded;
+      var total = 0;
+      Object.keys(state.parts).forEach(function (k) {
+        var start = (k - 1) * state.chunkSize;
+        total += Math.min(state.chunkSize, file.size - start);
+      });
+      Object.keys(inflight).forEach(function (k) {
+        if (!state.parts[k]) {
+          total += inflight[k];
+        }
+      });
+      $("progress").value = file.size ? total / file.size : 1;
+      status((resumed ? "Resuming " : "Uploading ") + state.key + ": " + Math.round(100 * total / (file.size || 1)) + "%");
+    };
+
+    var start = state.uploadId ? Promise.resolve() : call("POST", "/start-upload", null, {
+      fileName: state.key,
+      fileType: file.type || "application/octet-stream",
+      fileSize: file.size,
+      checksumAlgorithm: state.checksumAlgorithm || undefined
+    }).then(function (data) {
+      state.uploadId = data.uploadId;
+      if (c.aborted) {
+        // aborted while starting, before abort() knew the upload
+        call("POST", "/abort-upload", { fileName: state.key, uploadId: state.uploadId }).catch(function () {});
+        return;
+      }
+      saveState(file, state);
+    });
+
+    start.then(function () {
+      var next = 1;
+      var worker = function () {
+        while (next <= count && state.parts[next]) {
+          next++;
+        }
+        if (next > count || c.aborted || c.stopped) {
+          return Promise.resolve();
+        }
+        return uploadPart(c, next++, sent).then(worker);
+      };
+      // a part out of retries stops the other workers, the upload is over
+      // once they are all done
+      var failure = null;
+      var stop = function (err) {
+        if (!failure) {
+          failure = err;
+          c.stopped = true;
+          c.xhrs.forEach(function (xhr) { xhr.abort(); });
+        }
+      };
+      var workers = [];
+      for (var i = 0; i < parallel; i++) {
+        workers.push(worker().catch(stop));
+      }
+      sent(0, 0);
+      return Promise.all(workers).then(function () {
+        if (failure) {
+          throw failure;
+        }
+      });
+    }).then(function () {
+      if (c.aborted) {
+        throw new Error("aborted");
+      }
+      var parts = Object.keys(state.parts).map(function (k) { return state.parts[k]; });
+      parts.sort(function (a, b) { return a.PartNumber - b.PartNumber; });
+      return call("POST", "/complete-upload", null, {
+        params: {
+          fileName: state.key,
+          uploadId: state.uploadId,
+          parts: parts,
+          checksumAlgorithm: state.checksumAlgorithm || undefined
+        }
+      });
+    }).then(function (data) {
+      localStorage.removeItem(stateKey(file));
+      $("progress").value = 1;
+      status("Uploaded " + data.data.Key + " (" + data.data.ETag + ")");
+    }).catch(function (err) {
+      if (err.code === "NoSuchUpload") {
+        // expired or aborted on the server, start over next time
+        localStorage.removeItem(stateKey(file));
+      }
+      status(err.message + (c.aborted ? "" : "\nUpload again to resume."), true);
+    }).then(function () {
+      $("upload").disabled = false;
+      $("abort").disabled = true;
+    });
+  }
+
+  function abort() {
+    if (!current) {
+      return;
+    }
+    var c = current;
+    c.aborted = true;
+    c.xhrs.forEach(function (xhr) { xhr.abort(); });
+    localStorage.removeItem(stateKey(c.file));
+    if (c.state.uploadId) {
+      call("POST", "/abort-upload", { fileName: c.state.key, uploadId: c.state.uploadId }).catch(function () {});
+    }
+  }
+
+  $("upload").onclick = upload;
+  $("abort").onclick = abort;
+})();
+</script>
+</body>
+</html>
+`, "{{version}}", APIVersion, 1)
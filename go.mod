@@ -3,11 +3,10 @@ module github.com/gostones/s3upload
 go 1.12
 
 require (
-	github.com/aws/aws-sdk-go v1.23.22
-	github.com/davecgh/go-spew v1.1.1 // indirect
+	github.com/aws/aws-sdk-go v1.44.0
 	github.com/go-resty/resty/v2 v2.0.0
 	github.com/gorilla/mux v1.7.3
-	github.com/gostones/s3 v1.1.2-0.20190916195816-f16f269ca189
-	github.com/smartystreets/gunit v1.0.4 // indirect
-	github.com/stretchr/testify v1.4.0 // indirect
+	github.com/klauspost/compress v1.9.1
+	github.com/prometheus/client_golang v1.2.1
+	golang.org/x/crypto v0.0.0-20191011191535-87dc89f01550
 )
@@ -0,0 +1,34 @@
+//go:build (linux && amd64) || (linux && arm64)
+// +build linux,amd64 linux,arm64
+
+package internal
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	fadvSequential = 2 // POSIX_FADV_SEQUENTIAL
+	fadvWillNeed   = 3 // POSIX_FADV_WILLNEED
+)
+
+// adviseSequential hints the kernel to read ahead the file or the mapping.
+func adviseSequential(f *os.File, b []byte) {
+	if f != nil {
+		fadvise(f, 0, 0, fadvSequential)
+	}
+	if len(b) > 0 {
+		syscall.Madvise(b, syscall.MADV_SEQUENTIAL)
+	}
+}
+
+// adviseWillNeed hints the kernel to read n bytes of the file at off.
+func adviseWillNeed(f *os.File, off, n int64) {
+	fadvise(f, off, n, fadvWillNeed)
+}
+
+// fadvise is posix_fadvise(2), the hints are best effort.
+func fadvise(f *os.File, off, n int64, advice int) {
+	syscall.Syscall6(syscall.SYS_FADVISE64, f.Fd(), uintptr(off), uintptr(n), uintptr(advice), 0, 0)
+}
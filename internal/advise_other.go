@@ -0,0 +1,14 @@
+//go:build !linux || (!amd64 && !arm64)
+// +build !linux !amd64,!arm64
+
+package internal
+
+import (
+	"os"
+)
+
+// adviseSequential is a no-op without fadvise.
+func adviseSequential(f *os.File, b []byte) {}
+
+// adviseWillNeed is a no-op without fadvise.
+func adviseWillNeed(f *os.File, off, n int64) {}
@@ -0,0 +1,132 @@
+package internal
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+)
+
+// Checksum algorithms, named as the ChecksumAlgorithm of S3.
+const (
+	ChecksumMD5    = "MD5"
+	ChecksumSHA256 = "SHA256"
+	ChecksumSHA1   = "SHA1"
+	ChecksumCRC32  = "CRC32"
+	ChecksumCRC32C = "CRC32C"
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+// NewHash returns the hash of the checksum algorithm.
+func NewHash(alg string) (hash.Hash, error) {
+	switch alg {
+	case ChecksumMD5:
+		return md5.New(), nil
+	case ChecksumSHA256:
+		return sha256.New(), nil
+	case ChecksumSHA1:
+		return sha1.New(), nil
+	case ChecksumCRC32:
+		return crc32.NewIEEE(), nil
+	case ChecksumCRC32C:
+		return crc32.New(castagnoli), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum algorithm: %q", alg)
+}
+
+// Checksum computes the digests of several algorithms in a single pass.
+type Checksum struct {
+	algs   []string
+	hashes []hash.Hash
+	w      io.Writer
+}
+
+// NewChecksum returns a Checksum of the algorithms.
+func NewChecksum(algs ...string) (*Checksum, error) {
+	c := &Checksum{algs: algs}
+	var ws []io.Writer
+	for _, alg := range algs {
+		h, err := NewHash(alg)
+		if err != nil {
+			return nil, err
+		}
+		c.hashes = append(c.hashes, h)
+		ws = append(ws, h)
+	}
+	c.w = io.MultiWriter(ws...)
+	return c, nil
+}
+
+// ChecksumOf returns the digests of the content of r.
+func ChecksumOf(r io.Reader, algs ...string) (*Checksum, error) {
+	c, err := NewChecksum(algs...)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(c, r); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// ChecksumParts returns the digests of the content of ra and of its parts
+// of the sizes, in a single pass.
+func ChecksumParts(ra io.ReaderAt, sizes []int64, algs ...string) (*Checksum, []*Checksum, error) {
+	file, err := NewChecksum(algs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	parts := make([]*Checksum, len(sizes))
+	var off int64
+	for i, n := range sizes {
+		if parts[i], err = NewChecksum(algs...); err != nil {
+			return nil, nil, err
+		}
+		w := io.MultiWriter(file, parts[i])
+		if _, err := io.Copy(w, sectionReader(ra, off, n)); err != nil {
+			return nil, nil, err
+		}
+		off += n
+	}
+	return file, parts, nil
+}
+
+func (r *Checksum) Write(p []byte) (int, error) {
+	return r.w.Write(p)
+}
+
+// Sum returns the digest of the algorithm, nil if not computed.
+func (r *Checksum) Sum(alg string) []byte {
+	for i, a := range r.algs {
+		if a == alg {
+			return r.hashes[i].Sum(nil)
+		}
+	}
+	return nil
+}
+
+// Base64 returns the base64 encoded digest of the algorithm as in the
+// Content-MD5 and x-amz-checksum-* headers, empty if not computed.
+func (r *Checksum) Base64(alg string) string {
+	sum := r.Sum(alg)
+	if sum == nil {
+		return ""
+	}
+	return base64.StdEncoding.EncodeToString(sum)
+}
+
+// Hex returns the hex encoded digest of the algorithm, empty if not computed.
+func (r *Checksum) Hex(alg string) string {
+	return hex.EncodeToString(r.Sum(alg))
+}
+
+// Algorithms returns the algorithms of the checksum.
+func (r *Checksum) Algorithms() []string {
+	return r.algs
+}
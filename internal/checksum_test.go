@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestChecksum(t *testing.T) {
+	content := []byte("The quick brown fox jumps over the lazy dog")
+	expected := map[string]string{
+		ChecksumMD5:    "9e107d9d372bb6826bd81d3542a419d6",
+		ChecksumSHA256: "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592",
+		ChecksumSHA1:   "2fd4e1c67a2d28fced849ee1bb76e7391b93eb12",
+		ChecksumCRC32:  "414fa339",
+		ChecksumCRC32C: "22620404",
+	}
+	var algs []string
+	for alg := range expected {
+		algs = append(algs, alg)
+	}
+	c, err := ChecksumOf(bytes.NewReader(content), algs...)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	for alg, hex := range expected {
+		t.Logf("%s: %s %s", alg, c.Hex(alg), c.Base64(alg))
+		if c.Hex(alg) != hex {
+			t.FailNow()
+		}
+	}
+	if c.Sum("SHA512") != nil || c.Base64("SHA512") != "" {
+		t.FailNow()
+	}
+	if _, err := NewChecksum("SHA512"); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestFileChunkChecksum(t *testing.T) {
+	fc := NewFileChunk("./testdata/file.txt", 3)
+	if err := fc.Open(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer fc.Close()
+
+	file, chunks, err := fc.Checksum(ChecksumMD5, ChecksumCRC32C)
+	if err != nil || len(chunks) != fc.Chunk() {
+		t.Log(err)
+		t.FailNow()
+	}
+	if file.Hex(ChecksumMD5) != "9fef2c497c7c0e915d22017ddd2d7cc3" {
+		t.FailNow()
+	}
+	fc.Map(func(i int, r *ChunkReader) error {
+		c, err := r.Checksum(ChecksumMD5, ChecksumCRC32C)
+		if err != nil || c.Hex(ChecksumMD5) != chunks[i].Hex(ChecksumMD5) || c.Base64(ChecksumCRC32C) != chunks[i].Base64(ChecksumCRC32C) {
+			t.Logf("chunk: %v error: %v", i, err)
+			t.FailNow()
+		}
+		return nil
+	})
+}
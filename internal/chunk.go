@@ -2,7 +2,9 @@ package internal
 
 import (
 	"bufio"
+	"context"
 	"io"
+	"io/ioutil"
 	"os"
 	"sync"
 )
@@ -12,11 +14,21 @@ type FileChunk struct {
 	chunksize int64
 
 	file        *os.File
+	state       *FileState // of the file when opened
+	readMode    string
+	fr          *FileReader
+	ranged      bool // only offset+length bytes of the file are chunked
+	offset      int64
+	length      int64
+	ra          io.ReaderAt
+	stream      io.Reader // chunked as read if not nil, ra is not used
 	name        string
 	contentType string
 	chunk       int     // number of chunk
 	size        int64   // file size
 	count       Counter // bytes read
+	limiter     *Limiter
+	cipher      *Cipher
 }
 
 func NewFileChunk(filename string, chunksize int64) *FileChunk {
@@ -26,6 +38,28 @@ func NewFileChunk(filename string, chunksize int64) *FileChunk {
 	}
 }
 
+// NewReaderChunk returns a FileChunk over size bytes of ra. It needs no Open.
+func NewReaderChunk(ra io.ReaderAt, size int64, name string, chunksize int64) *FileChunk {
+	r := &FileChunk{
+		filename:  name,
+		chunksize: chunksize,
+	}
+	r.init(ra, name, size)
+	return r
+}
+
+// NewStreamChunk returns a FileChunk over a stream of unknown length, e.g.
+// compressed on the fly. The chunks are read in order into memory one at a
+// time, the size and the number of chunks are known once mapped.
+func NewStreamChunk(stream io.Reader, name string, chunksize int64) *FileChunk {
+	return &FileChunk{
+		filename:  name,
+		chunksize: chunksize,
+		stream:    stream,
+		name:      name,
+	}
+}
+
 func (r *FileChunk) Open() error {
 	file, err := os.Open(r.filename)
 	if err != nil {
@@ -33,28 +67,68 @@ func (r *FileChunk) Open() error {
 	}
 	fi, err := file.Stat()
 	if err != nil {
+		file.Close()
+		return err
+	}
+
+	r.file = file
+	r.state = NewFileState(fi)
+	if r.readMode == ReadModeReadAt && !r.ranged {
+		r.init(file, fi.Name(), fi.Size())
+		return nil
+	}
+	fr, err := NewFileReader(file, r.readMode)
+	if err != nil {
+		file.Close()
 		return err
 	}
-	size := fi.Size()
-	name := fi.Name()
+	ra := fr
+	if r.ranged {
+		if ra, err = fr.Range(r.offset, r.length); err != nil {
+			fr.Close()
+			file.Close()
+			return err
+		}
+	}
+	r.fr = fr
+	r.init(ra, fi.Name(), ra.Size())
+	return nil
+}
+
+// SetRange chunks only length bytes of the file at offset, the rest of the
+// file if length is negative. It must be called before Open.
+func (r *FileChunk) SetRange(offset, length int64) {
+	r.ranged = true
+	r.offset = offset
+	r.length = length
+}
+
+// SetReadMode sets how the file is read, ReadModeMmap or ReadModeReadahead.
+// It must be called before Open.
+func (r *FileChunk) SetReadMode(mode string) {
+	r.readMode = mode
+}
+
+func (r *FileChunk) init(ra io.ReaderAt, name string, size int64) {
 	chunk := int(size / r.chunksize)
 	if size%r.chunksize != 0 {
 		chunk++
 	}
-	contentType, _ := ContentType(file)
-	file.Seek(0, io.SeekStart)
+	contentType, _ := ContentType(io.NewSectionReader(ra, 0, size))
 
-	r.file = file
+	r.ra = ra
 	r.name = name
 	r.size = size
 	r.chunk = chunk
 	r.contentType = contentType
-	return nil
 }
 
 // Map ranges over the chunks calling the function with the chunk number and a reader.
 // Fail fast if the function returns error.
 func (r *FileChunk) Map(fn func(int, *ChunkReader) error) []error {
+	if r.stream != nil {
+		return r.mapStream(context.Background(), fn)
+	}
 	readers := r.Readers()
 	n := len(readers)
 	var errs = make([]error, n)
@@ -67,8 +141,34 @@ func (r *FileChunk) Map(fn func(int, *ChunkReader) error) []error {
 	return errs
 }
 
+// MapContext is like Map but stops before the next chunk once ctx is done,
+// recording the context error for that chunk.
+func (r *FileChunk) MapContext(ctx context.Context, fn func(int, *ChunkReader) error) []error {
+	if r.stream != nil {
+		return r.mapStream(ctx, fn)
+	}
+	readers := r.Readers()
+	n := len(readers)
+	var errs = make([]error, n)
+	for i, rd := range readers {
+		if err := ctx.Err(); err != nil {
+			errs[i] = err
+			break
+		}
+		if err := fn(i, rd.WithContext(ctx)); err != nil {
+			errs[i] = err
+			break
+		}
+	}
+	return errs
+}
+
 // MapAsync ranges over the chunks calling the function in separate go routines with the chunk number and a reader.
+// A stream is mapped in order.
 func (r *FileChunk) MapAsync(fn func(int, *ChunkReader) error) []error {
+	if r.stream != nil {
+		return r.mapStream(context.Background(), fn)
+	}
 	var wg sync.WaitGroup
 	readers := r.Readers()
 	n := len(readers)
@@ -87,10 +187,67 @@ func (r *FileChunk) MapAsync(fn func(int, *ChunkReader) error) []error {
 	return errs
 }
 
+// mapStream reads the stream a chunk at a time calling the function with the
+// chunk number and a reader of the chunk in memory. An empty stream is one empty chunk.
+func (r *FileChunk) mapStream(ctx context.Context, fn func(int, *ChunkReader) error) []error {
+	r.count.Reset()
+	r.size, r.chunk = 0, 0
+	var errs []error
+	buf := make([]byte, r.chunksize)
+	for i := 0; ; i++ {
+		if err := ctx.Err(); err != nil {
+			return append(errs, err)
+		}
+		n, err := io.ReadFull(r.stream, buf)
+		if err == io.EOF && i > 0 {
+			return errs
+		}
+		if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+			return append(errs, err)
+		}
+		off := r.size
+		r.size += int64(n)
+		r.chunk++
+		cr := NewChunkReader(r, off, off+int64(n))
+		cr.ra = &offsetReaderAt{b: buf[:n], off: off}
+		if err := fn(i, cr.WithContext(ctx)); err != nil {
+			return append(errs, err)
+		}
+		errs = append(errs, nil)
+		if n < len(buf) {
+			return errs
+		}
+	}
+}
+
+// offsetReaderAt reads b as the bytes at off of a stream.
+type offsetReaderAt struct {
+	b   []byte
+	off int64
+}
+
+func (r *offsetReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	off -= r.off
+	if off < 0 || off >= int64(len(r.b)) {
+		return 0, io.EOF
+	}
+	n := copy(p, r.b[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
 func (r *FileChunk) Close() error {
-	if r.file == nil {
+	if r.ra == nil {
 		return os.ErrInvalid
 	}
+	if r.file == nil {
+		return nil
+	}
+	if r.fr != nil {
+		r.fr.Close()
+	}
 	return r.file.Close()
 }
 
@@ -110,6 +267,17 @@ func (r *FileChunk) Readers() []*ChunkReader {
 	return readers
 }
 
+// SetCipher encrypts the chunks, the readers return the sealed frames.
+// The sizes of the readers are of the encrypted chunks, the count is of the plain text read.
+func (r *FileChunk) SetCipher(c *Cipher) {
+	r.cipher = c
+}
+
+// SetLimiter throttles the counting readers of all the chunks with a shared limiter.
+func (r *FileChunk) SetLimiter(l *Limiter) {
+	r.limiter = l
+}
+
 func (r *FileChunk) Filename() string {
 	return r.filename
 }
@@ -127,7 +295,25 @@ func (r *FileChunk) ContentType() string {
 }
 
 func (r *FileChunk) MD5() (string, string, error) {
-	return MD5Sum(r.file)
+	return MD5Sum(sectionReader(r.ra, 0, r.size))
+}
+
+// Checksum computes the digests of the algorithms of the whole file and of
+// each chunk in a single pass. The chunks are of the plain text, a stream
+// has no checksum before it is mapped.
+func (r *FileChunk) Checksum(algs ...string) (*Checksum, []*Checksum, error) {
+	if r.stream != nil {
+		return nil, nil, os.ErrInvalid
+	}
+	sizes := make([]int64, r.chunk)
+	for i := range sizes {
+		off := int64(i) * r.chunksize
+		sizes[i] = r.chunksize
+		if off+sizes[i] > r.size {
+			sizes[i] = r.size - off
+		}
+	}
+	return ChecksumParts(r.ra, sizes, algs...)
 }
 
 func (r *FileChunk) Size() int64 {
@@ -144,15 +330,25 @@ func (r *FileChunk) Chunk() int {
 
 type ChunkReader struct {
 	reader   *FileChunk
+	ra       io.ReaderAt
 	base     int64
 	off      int64
 	limit    int64
 	counting bool
+	ctx      context.Context
+	sealed   []byte // encrypted frame not yet read
+
+	buf  []byte // chunk in memory if buffered
+	pool *BufferPool
+
+	block    []byte // block of a readahead file read
+	blockOff int64
 }
 
 func NewChunkReader(r *FileChunk, off, limit int64) *ChunkReader {
 	return &ChunkReader{
 		reader:   r,
+		ra:       r.ra,
 		base:     off,
 		off:      off,
 		limit:    limit,
@@ -160,9 +356,19 @@ func NewChunkReader(r *FileChunk, off, limit int64) *ChunkReader {
 	}
 }
 
+// WithContext returns a shallow copy of the reader which fails reading
+// with the context error once ctx is done.
+func (r *ChunkReader) WithContext(ctx context.Context) *ChunkReader {
+	cr := *r
+	cr.ctx = ctx
+	return &cr
+}
+
 func (r *ChunkReader) MD5() (string, string, error) {
 	cr := &ChunkReader{
 		reader:   r.reader,
+		ra:       r.ra,
+		base:     r.base,
 		off:      r.off,
 		limit:    r.limit,
 		counting: false,
@@ -170,6 +376,79 @@ func (r *ChunkReader) MD5() (string, string, error) {
 	return MD5Sum(cr)
 }
 
+// Checksum returns the digests of the algorithms of the chunk as uploaded,
+// encrypted if the FileChunk has a cipher.
+func (r *ChunkReader) Checksum(algs ...string) (*Checksum, error) {
+	cr := &ChunkReader{
+		reader:   r.reader,
+		ra:       r.ra,
+		base:     r.base,
+		off:      r.base,
+		limit:    r.limit,
+		counting: false,
+	}
+	return ChecksumOf(cr, algs...)
+}
+
+// Buffered reads the chunk once into a buffer of the pool, hashing the plain
+// text with the algorithms as read, and returns a reader of the chunk in
+// memory and the checksum of the chunk as uploaded. The checksum of an
+// encrypted chunk is computed from memory. Release returns the buffer.
+func (r *ChunkReader) Buffered(pool *BufferPool, algs ...string) (*ChunkReader, *Checksum, error) {
+	if r.reader.stream != nil {
+		// already in memory
+		sum, err := r.Checksum(algs...)
+		return r, sum, err
+	}
+	sum, err := NewChecksum(algs...)
+	if err != nil {
+		return nil, nil, err
+	}
+	var w io.Writer = sum
+	if r.reader.cipher != nil {
+		w = ioutil.Discard
+	}
+	cr := *r
+	cr.off = r.base
+	cr.sealed = nil
+	cr.block = nil
+	if f, ok := r.ra.(*FileReader); ok && f.slice(r.base, r.limit-r.base) != nil {
+		// a mapped file is already in memory
+		buf := f.slice(r.base, r.limit-r.base)
+		w.Write(buf)
+		cr.ra = &offsetReaderAt{b: buf, off: r.base}
+	} else {
+		buf := pool.Get()[:r.limit-r.base]
+		if _, err := io.ReadFull(io.TeeReader(sectionReader(r.ra, r.base, int64(len(buf))), w), buf); err != nil {
+			pool.Put(buf)
+			return nil, nil, err
+		}
+		cr.ra = &offsetReaderAt{b: buf, off: r.base}
+		cr.buf = buf
+		cr.pool = pool
+	}
+	if r.reader.cipher != nil {
+		if sum, err = cr.Checksum(algs...); err != nil {
+			cr.Release()
+			return nil, nil, err
+		}
+	}
+	return &cr, sum, nil
+}
+
+// Release returns the buffer of a buffered reader, or the block of a
+// readahead read, to its pool. The reader must not be read after.
+func (r *ChunkReader) Release() {
+	if r.pool != nil && r.buf != nil {
+		r.pool.Put(r.buf)
+		r.buf = nil
+	}
+	if f, ok := r.ra.(*FileReader); ok && r.block != nil {
+		f.pool.Put(r.block)
+		r.block = nil
+	}
+}
+
 func (r *ChunkReader) read(p []byte) (int, error) {
 	if r.off >= r.limit {
 		return 0, io.EOF
@@ -177,12 +456,93 @@ func (r *ChunkReader) read(p []byte) (int, error) {
 	if max := r.limit - r.off; int64(len(p)) > max {
 		p = p[0:max]
 	}
-	n, err := r.reader.file.ReadAt(p, r.off)
+	if f, ok := r.ra.(*FileReader); ok && f.mode == ReadModeReadahead {
+		return r.readBlock(f, p)
+	}
+	n, err := r.ra.ReadAt(p, r.off)
 	r.off += int64(n)
 	return n, err
 }
 
+// readBlock copies from the block of the file with the offset, reading it
+// if needed. The block returns to the pool once the chunk is read.
+func (r *ChunkReader) readBlock(f *FileReader, p []byte) (int, error) {
+	if r.off < r.blockOff || r.off >= r.blockOff+int64(len(r.block)) {
+		if r.block != nil {
+			f.pool.Put(r.block)
+		}
+		block, off, err := f.readBlock(r.off)
+		r.block, r.blockOff = block, off
+		if err != nil {
+			return 0, err
+		}
+		if r.off >= off+int64(len(block)) {
+			// the file is shorter than its chunks
+			return 0, io.ErrUnexpectedEOF
+		}
+	}
+	n := copy(p, r.block[r.off-r.blockOff:])
+	r.off += int64(n)
+	if r.off >= r.limit {
+		f.pool.Put(r.block)
+		r.block = nil
+	}
+	return n, nil
+}
+
 func (r *ChunkReader) Read(p []byte) (int, error) {
+	ctx := r.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	if r.reader.cipher != nil {
+		return r.readSealed(ctx, p)
+	}
+	return r.readPlain(ctx, p)
+}
+
+// readSealed encrypts the chunk frame by frame.
+func (r *ChunkReader) readSealed(ctx context.Context, p []byte) (int, error) {
+	c := r.reader.cipher
+	if len(r.sealed) == 0 {
+		if r.off >= r.limit {
+			return 0, io.EOF
+		}
+		size := int64(c.FrameSize())
+		if max := r.limit - r.off; size > max {
+			size = max
+		}
+		n := int((r.off - r.base) / int64(c.FrameSize()))
+		frame := make([]byte, size)
+		for i := 0; i < len(frame); {
+			m, err := r.readPlain(ctx, frame[i:])
+			i += m
+			if err != nil && (err != io.EOF || i < len(frame)) {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return 0, err
+			}
+		}
+		part := int(r.base/r.reader.chunksize) + 1
+		r.sealed = c.Seal(frame[:0:0], frame, part, n)
+	}
+	n := copy(p, r.sealed)
+	r.sealed = r.sealed[n:]
+	return n, nil
+}
+
+func (r *ChunkReader) readPlain(ctx context.Context, p []byte) (int, error) {
+	if r.counting && r.reader.limiter != nil && len(p) > 0 {
+		n, err := r.reader.limiter.WaitContext(ctx, len(p))
+		if err != nil {
+			return 0, err
+		}
+		p = p[:n]
+	}
 	n, err := r.read(p)
 	if r.counting {
 		r.reader.count.Increment(int64(n))
@@ -193,6 +553,7 @@ func (r *ChunkReader) Read(p []byte) (int, error) {
 func (r *ChunkReader) Reset() {
 	r.reader.count.Decrement(r.off - r.base)
 	r.off = r.base
+	r.sealed = nil
 }
 
 func (r *ChunkReader) CopyTo(w io.Writer) {
@@ -201,6 +562,15 @@ func (r *ChunkReader) CopyTo(w io.Writer) {
 	bw.Flush()
 }
 
+// Len returns the plain text bytes of the chunk.
+func (r *ChunkReader) Len() int64 {
+	return r.limit - r.base
+}
+
+// Size returns the bytes of the chunk, encrypted if the FileChunk has a cipher.
 func (r *ChunkReader) Size() int64 {
+	if c := r.reader.cipher; c != nil {
+		return c.SealedSize(r.limit - r.base)
+	}
 	return r.limit - r.base
 }
@@ -189,3 +189,143 @@ func TestFileChunk(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestStreamChunk(t *testing.T) {
+	content := []byte("The quick brown fox jumps over the lazy dog")
+	for _, chunksize := range []int64{10, 43, 100} {
+		fc := NewStreamChunk(bytes.NewReader(content), "fox", chunksize)
+		var buf bytes.Buffer
+		var sizes []int64
+		errs := fc.Map(func(i int, r *ChunkReader) error {
+			sizes = append(sizes, r.Size())
+			r.CopyTo(&buf)
+			return nil
+		})
+		t.Logf("chunksize: %v chunks: %v sizes: %v", chunksize, fc.Chunk(), sizes)
+		for _, err := range errs {
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+		}
+		if !bytes.Equal(buf.Bytes(), content) || fc.Size() != int64(len(content)) || fc.Count() != fc.Size() || fc.Chunk() != len(sizes) {
+			t.FailNow()
+		}
+	}
+
+	// empty stream is one empty chunk
+	fc := NewStreamChunk(bytes.NewReader(nil), "empty", 10)
+	errs := fc.Map(func(i int, r *ChunkReader) error {
+		return nil
+	})
+	if len(errs) != 1 || fc.Chunk() != 1 || fc.Size() != 0 {
+		t.FailNow()
+	}
+}
+
+func TestChunkReaderBuffered(t *testing.T) {
+	content := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 1000)
+	mk, _ := NewMasterKey(bytes.Repeat([]byte{7}, KeySize))
+	_, c, _ := NewEnvelope(mk, int64(len(content)), 10000, "")
+
+	for _, cipher := range []*Cipher{nil, c} {
+		fc := NewReaderChunk(bytes.NewReader(content), int64(len(content)), "fox", 10000)
+		fc.SetCipher(cipher)
+		pool := NewBufferPool(10000)
+		errs := fc.Map(func(i int, r *ChunkReader) error {
+			expected, err := r.Checksum(ChecksumMD5, ChecksumSHA256)
+			if err != nil {
+				return err
+			}
+			br, sum, err := r.Buffered(pool, ChecksumMD5, ChecksumSHA256)
+			if err != nil {
+				return err
+			}
+			defer br.Release()
+			b, err := ioutil.ReadAll(br)
+			if err != nil {
+				return err
+			}
+			actual, _ := ChecksumOf(bytes.NewReader(b), ChecksumSHA256)
+			if sum.Hex(ChecksumMD5) != expected.Hex(ChecksumMD5) || sum.Hex(ChecksumSHA256) != actual.Hex(ChecksumSHA256) || int64(len(b)) != br.Size() {
+				return fmt.Errorf("chunk %v: checksum mismatch", i)
+			}
+			return nil
+		})
+		for _, err := range errs {
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+		}
+		if fc.Count() != int64(len(content)) {
+			t.Logf("count: %v", fc.Count())
+			t.FailNow()
+		}
+	}
+}
+
+// benchmarkFile creates a temporary file of size bytes.
+func benchmarkFile(b *testing.B, size int) string {
+	f, err := ioutil.TempFile("", "chunk")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	if _, err := f.Write(bytes.Repeat([]byte{'x'}, size)); err != nil {
+		b.Fatal(err)
+	}
+	return f.Name()
+}
+
+const (
+	benchmarkSize      = 64 << 20
+	benchmarkChunkSize = 8 << 20
+)
+
+// BenchmarkChunkReread reads each chunk twice, to hash it and to upload it.
+func BenchmarkChunkReread(b *testing.B) {
+	filename := benchmarkFile(b, benchmarkSize)
+	defer os.Remove(filename)
+	b.SetBytes(benchmarkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fc := NewFileChunk(filename, benchmarkChunkSize)
+		if err := fc.Open(); err != nil {
+			b.Fatal(err)
+		}
+		fc.Map(func(i int, r *ChunkReader) error {
+			if _, _, err := r.MD5(); err != nil {
+				return err
+			}
+			_, err := io.Copy(ioutil.Discard, r)
+			return err
+		})
+		fc.Close()
+	}
+}
+
+// BenchmarkChunkBuffered reads each chunk once into a pooled buffer, hashing it as read.
+func BenchmarkChunkBuffered(b *testing.B) {
+	filename := benchmarkFile(b, benchmarkSize)
+	defer os.Remove(filename)
+	pool := NewBufferPool(benchmarkChunkSize)
+	b.SetBytes(benchmarkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fc := NewFileChunk(filename, benchmarkChunkSize)
+		if err := fc.Open(); err != nil {
+			b.Fatal(err)
+		}
+		fc.Map(func(i int, r *ChunkReader) error {
+			br, _, err := r.Buffered(pool, ChecksumMD5)
+			if err != nil {
+				return err
+			}
+			defer br.Release()
+			_, err = io.Copy(ioutil.Discard, br)
+			return err
+		})
+		fc.Close()
+	}
+}
@@ -0,0 +1,298 @@
+package internal
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Client side encryption of the chunks.
+//
+// Each object has a random data key. The chunks are encrypted with AES-256-GCM
+// in frames of FrameSize bytes so a part is sealed and opened as a stream.
+// The nonce of a frame is the random prefix of the object, the part number
+// and the frame number within the part, so the parts are encrypted
+// independently and a part encrypted again on resume is identical.
+// The data key is sealed with the master key in the Envelope stored in the
+// object metadata.
+const (
+	KeySize          = 32
+	DefaultFrameSize = 64 * 1024
+
+	envelopeVersion = 1
+	algorithm       = "AES-256-GCM"
+	kdfNone         = "none"
+	kdfScrypt       = "scrypt"
+)
+
+var ErrDecrypt = errors.New("decryption failed: wrong key or corrupted data")
+
+// MasterKey encrypts the data keys, either a 256-bit key or a passphrase
+// derived with scrypt.
+type MasterKey struct {
+	key        []byte
+	passphrase []byte
+}
+
+// NewMasterKey returns a master key of the 256-bit key.
+func NewMasterKey(key []byte) (*MasterKey, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("key must be %v bytes", KeySize)
+	}
+	return &MasterKey{key: key}, nil
+}
+
+// PassphraseKey returns a master key derived from the passphrase.
+func PassphraseKey(passphrase string) *MasterKey {
+	return &MasterKey{passphrase: []byte(passphrase)}
+}
+
+func (r *MasterKey) kdf() string {
+	if r.passphrase != nil {
+		return kdfScrypt
+	}
+	return kdfNone
+}
+
+// derive returns the key encryption key for the salt.
+func (r *MasterKey) derive(kdf string, salt []byte) ([]byte, error) {
+	if kdf != r.kdf() {
+		return nil, fmt.Errorf("object is encrypted with kdf %q", kdf)
+	}
+	if kdf == kdfNone {
+		return r.key, nil
+	}
+	return scrypt.Key(r.passphrase, salt, 1<<15, 8, 1, KeySize)
+}
+
+// Envelope describes the encryption of an object. The parameters are
+// authenticated with the sealed data key.
+type Envelope struct {
+	Version     int    `json:"v"`
+	Algorithm   string `json:"alg"`
+	KDF         string `json:"kdf"`
+	Salt        []byte `json:"salt,omitempty"`
+	Key         []byte `json:"key"`   // sealed data key
+	Nonce       []byte `json:"nonce"` // prefix of the frame nonces
+	FrameSize   int    `json:"frame"`
+	ChunkSize   int64  `json:"chunk"`
+	Size        int64  `json:"size"` // plain text size
+	ContentType string `json:"type,omitempty"`
+}
+
+// NewEnvelope generates the data key of an object of size bytes uploaded
+// in chunks and returns its envelope and cipher.
+func NewEnvelope(mk *MasterKey, size, chunksize int64, contentType string) (*Envelope, *Cipher, error) {
+	e := &Envelope{
+		Version:     envelopeVersion,
+		Algorithm:   algorithm,
+		KDF:         mk.kdf(),
+		Nonce:       make([]byte, 4),
+		FrameSize:   DefaultFrameSize,
+		ChunkSize:   chunksize,
+		Size:        size,
+		ContentType: contentType,
+	}
+	dataKey := make([]byte, KeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return nil, nil, err
+	}
+	if _, err := io.ReadFull(rand.Reader, e.Nonce); err != nil {
+		return nil, nil, err
+	}
+	if e.KDF == kdfScrypt {
+		e.Salt = make([]byte, 16)
+		if _, err := io.ReadFull(rand.Reader, e.Salt); err != nil {
+			return nil, nil, err
+		}
+	}
+	kek, err := mk.derive(e.KDF, e.Salt)
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, nil, err
+	}
+	e.Key = aead.Seal(nonce, nonce, dataKey, e.params())
+
+	c, err := e.cipher(dataKey)
+	return e, c, err
+}
+
+// DecodeEnvelope decodes the envelope encoded by Encode.
+func DecodeEnvelope(s string) (*Envelope, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid envelope: %v", err)
+	}
+	var e Envelope
+	if err := json.Unmarshal(b, &e); err != nil {
+		return nil, fmt.Errorf("invalid envelope: %v", err)
+	}
+	if e.Version != envelopeVersion || e.Algorithm != algorithm {
+		return nil, fmt.Errorf("unsupported envelope: version %v %s", e.Version, e.Algorithm)
+	}
+	if e.FrameSize <= 0 || e.ChunkSize <= 0 || e.Size < 0 || len(e.Nonce) != 4 {
+		return nil, errors.New("invalid envelope parameters")
+	}
+	return &e, nil
+}
+
+// Encode returns the envelope as a string fit for the object metadata.
+func (r *Envelope) Encode() string {
+	b, _ := json.Marshal(r)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// Open unseals the data key with the master key and returns the cipher of the object.
+func (r *Envelope) Open(mk *MasterKey) (*Cipher, error) {
+	kek, err := mk.derive(r.KDF, r.Salt)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := newGCM(kek)
+	if err != nil {
+		return nil, err
+	}
+	if len(r.Key) < aead.NonceSize() {
+		return nil, ErrDecrypt
+	}
+	n := aead.NonceSize()
+	dataKey, err := aead.Open(nil, r.Key[:n], r.Key[n:], r.params())
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return r.cipher(dataKey)
+}
+
+// params are the additional data of the sealed data key.
+func (r *Envelope) params() []byte {
+	return []byte(fmt.Sprintf("%v|%s|%x|%v|%v|%v", r.Version, r.Algorithm, r.Nonce, r.FrameSize, r.ChunkSize, r.Size))
+}
+
+func (r *Envelope) cipher(dataKey []byte) (*Cipher, error) {
+	aead, err := newGCM(dataKey)
+	if err != nil {
+		return nil, err
+	}
+	c := &Cipher{
+		aead:      aead,
+		frameSize: r.FrameSize,
+		chunkSize: r.ChunkSize,
+		size:      r.Size,
+	}
+	copy(c.prefix[:], r.Nonce)
+	return c, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Cipher encrypts and decrypts the chunks of an object.
+type Cipher struct {
+	aead      cipher.AEAD
+	prefix    [4]byte
+	frameSize int
+	chunkSize int64
+	size      int64
+}
+
+func (r *Cipher) nonce(part, frame int) []byte {
+	nonce := make([]byte, 12)
+	copy(nonce, r.prefix[:])
+	binary.BigEndian.PutUint32(nonce[4:], uint32(part))
+	binary.BigEndian.PutUint32(nonce[8:], uint32(frame))
+	return nonce
+}
+
+// Seal appends the encrypted frame of the part to dst.
+func (r *Cipher) Seal(dst, frame []byte, part, n int) []byte {
+	return r.aead.Seal(dst, r.nonce(part, n), frame, nil)
+}
+
+// Open appends the decrypted frame of the part to dst.
+func (r *Cipher) Open(dst, frame []byte, part, n int) ([]byte, error) {
+	b, err := r.aead.Open(dst, r.nonce(part, n), frame, nil)
+	if err != nil {
+		return nil, ErrDecrypt
+	}
+	return b, nil
+}
+
+// FrameSize is the size of the plain text frames.
+func (r *Cipher) FrameSize() int {
+	return r.frameSize
+}
+
+// SealedSize returns the encrypted size of a chunk of n bytes.
+func (r *Cipher) SealedSize(n int64) int64 {
+	frames := (n + int64(r.frameSize) - 1) / int64(r.frameSize)
+	return n + frames*int64(r.aead.Overhead())
+}
+
+// ObjectSize returns the encrypted size of the object.
+func (r *Cipher) ObjectSize() int64 {
+	full := r.size / r.chunkSize
+	size := full * r.SealedSize(r.chunkSize)
+	if rem := r.size % r.chunkSize; rem != 0 {
+		size += r.SealedSize(rem)
+	}
+	return size
+}
+
+// Decrypt writes the plain text of the encrypted object read from src to dst.
+func (r *Cipher) Decrypt(dst io.Writer, src io.Reader) error {
+	overhead := r.aead.Overhead()
+	buf := make([]byte, r.frameSize+overhead)
+	var plain []byte
+	for part := 1; int64(part-1)*r.chunkSize < r.size; part++ {
+		remaining := r.size - int64(part-1)*r.chunkSize
+		if remaining > r.chunkSize {
+			remaining = r.chunkSize
+		}
+		for n := 0; remaining > 0; n++ {
+			size := r.frameSize
+			if int64(size) > remaining {
+				size = int(remaining)
+			}
+			frame := buf[:size+overhead]
+			if _, err := io.ReadFull(src, frame); err != nil {
+				if err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return err
+			}
+			var err error
+			if plain, err = r.Open(plain[:0], frame, part, n); err != nil {
+				return err
+			}
+			if _, err := dst.Write(plain); err != nil {
+				return err
+			}
+			remaining -= int64(size)
+		}
+	}
+	// trailing data is not part of the object
+	if n, _ := io.ReadFull(src, buf[:1]); n != 0 {
+		return ErrDecrypt
+	}
+	return nil
+}
@@ -0,0 +1,123 @@
+package internal
+
+import (
+	"bytes"
+	"io/ioutil"
+	"testing"
+)
+
+// sealObject encrypts content in chunks as uploaded and returns the object.
+func sealObject(t *testing.T, c *Cipher, content []byte, chunksize int64) []byte {
+	fc := NewReaderChunk(bytes.NewReader(content), int64(len(content)), "test", chunksize)
+	fc.SetCipher(c)
+	var object bytes.Buffer
+	errs := fc.Map(func(i int, r *ChunkReader) error {
+		b, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		if int64(len(b)) != r.Size() {
+			t.Logf("chunk: %v size: %v read: %v", i, r.Size(), len(b))
+			t.FailNow()
+		}
+		object.Write(b)
+		return nil
+	})
+	for _, err := range errs {
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+	if fc.Count() != int64(len(content)) || int64(object.Len()) != c.ObjectSize() {
+		t.Logf("count: %v object: %v expected: %v", fc.Count(), object.Len(), c.ObjectSize())
+		t.FailNow()
+	}
+	return object.Bytes()
+}
+
+func TestCipher(t *testing.T) {
+	content := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 10000)
+	var chunksize int64 = 150000 // frames of 64KiB and a short frame per chunk
+
+	mk, err := NewMasterKey(bytes.Repeat([]byte{7}, KeySize))
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	e, c, err := NewEnvelope(mk, int64(len(content)), chunksize, "text/plain")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	object := sealObject(t, c, content, chunksize)
+
+	// decrypt with the envelope of the metadata
+	e, err = DecodeEnvelope(e.Encode())
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	c, err = e.Open(mk)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	var plain bytes.Buffer
+	if err := c.Decrypt(&plain, bytes.NewReader(object)); err != nil || !bytes.Equal(plain.Bytes(), content) {
+		t.Logf("decrypt: %v", err)
+		t.FailNow()
+	}
+
+	// wrong key
+	other, _ := NewMasterKey(bytes.Repeat([]byte{8}, KeySize))
+	if _, err := e.Open(other); err != ErrDecrypt {
+		t.Logf("wrong key: %v", err)
+		t.FailNow()
+	}
+
+	// truncated size in the envelope
+	e.Size -= 10
+	if _, err := e.Open(mk); err != ErrDecrypt {
+		t.Logf("tampered envelope: %v", err)
+		t.FailNow()
+	}
+	e.Size += 10
+
+	// corrupted and truncated object
+	object[len(object)/2] ^= 1
+	if err := c.Decrypt(ioutil.Discard, bytes.NewReader(object)); err != ErrDecrypt {
+		t.Logf("corrupted: %v", err)
+		t.FailNow()
+	}
+	object[len(object)/2] ^= 1
+	if err := c.Decrypt(ioutil.Discard, bytes.NewReader(object[:len(object)-1])); err == nil {
+		t.Log("truncated object decrypted")
+		t.FailNow()
+	}
+}
+
+func TestCipherPassphrase(t *testing.T) {
+	content := []byte("The quick brown fox jumps over the lazy dog")
+	e, c, err := NewEnvelope(PassphraseKey("secret"), int64(len(content)), 10, "")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	object := sealObject(t, c, content, 10)
+
+	c, err = e.Open(PassphraseKey("secret"))
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	var plain bytes.Buffer
+	if err := c.Decrypt(&plain, bytes.NewReader(object)); err != nil || !bytes.Equal(plain.Bytes(), content) {
+		t.Logf("decrypt: %v", err)
+		t.FailNow()
+	}
+	if _, err := e.Open(PassphraseKey("wrong")); err != ErrDecrypt {
+		t.Logf("wrong passphrase: %v", err)
+		t.FailNow()
+	}
+}
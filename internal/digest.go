@@ -0,0 +1,198 @@
+package internal
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+)
+
+// Digest is a whole-file digest combined from the digests of the chunks.
+type Digest struct {
+	Algorithm string
+	Sum       []byte
+	// Parts is the number of chunks of a composite digest, the digest of
+	// the concatenated digests of the chunks as the ETag of a S3 multipart
+	// upload. It is 0 if the digest is of the whole content, as for CRC32
+	// and CRC32C which are combined.
+	Parts int
+}
+
+// Hex returns the hex coded digest, suffixed with -<parts> if composite.
+func (r *Digest) Hex() string {
+	return r.suffix(hex.EncodeToString(r.Sum))
+}
+
+// Base64 returns the base64 coded digest, suffixed with -<parts> if composite.
+func (r *Digest) Base64() string {
+	return r.suffix(base64.StdEncoding.EncodeToString(r.Sum))
+}
+
+func (r *Digest) suffix(s string) string {
+	if r.Parts == 0 {
+		return s
+	}
+	return fmt.Sprintf("%s-%v", s, r.Parts)
+}
+
+// Digest computes the whole-file digests of the algorithms hashing the chunks
+// concurrently with up to workers goroutines, the number of CPUs if 0.
+func (r *FileChunk) Digest(workers int, algs ...string) ([]*Digest, error) {
+	if r.stream != nil {
+		return nil, os.ErrInvalid
+	}
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+	if _, err := NewChecksum(algs...); err != nil {
+		return nil, err
+	}
+
+	sums := make([]*Checksum, r.chunk)
+	errs := make([]error, r.chunk)
+	next := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				off, n := r.chunkRange(i)
+				sums[i], errs[i] = ChecksumOf(sectionReader(r.ra, off, n), algs...)
+			}
+		}()
+	}
+	for i := 0; i < r.chunk; i++ {
+		next <- i
+	}
+	close(next)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var digests []*Digest
+	for _, alg := range algs {
+		d, err := r.combine(alg, sums)
+		if err != nil {
+			return nil, err
+		}
+		digests = append(digests, d)
+	}
+	return digests, nil
+}
+
+// chunkRange returns the offset and the size of the chunk.
+func (r *FileChunk) chunkRange(i int) (int64, int64) {
+	off := int64(i) * r.chunksize
+	n := r.chunksize
+	if off+n > r.size {
+		n = r.size - off
+	}
+	return off, n
+}
+
+// combine returns the whole-file digest of the algorithm from the chunk checksums.
+func (r *FileChunk) combine(alg string, sums []*Checksum) (*Digest, error) {
+	h, err := NewHash(alg)
+	if err != nil {
+		return nil, err
+	}
+	d := &Digest{Algorithm: alg}
+	switch alg {
+	case ChecksumCRC32, ChecksumCRC32C:
+		poly := uint32(crc32IEEE)
+		if alg == ChecksumCRC32C {
+			poly = crc32Castagnoli
+		}
+		var crc uint32
+		for i, s := range sums {
+			_, n := r.chunkRange(i)
+			crc = crc32Combine(poly, crc, beUint32(s.Sum(alg)), n)
+		}
+		d.Sum = []byte{byte(crc >> 24), byte(crc >> 16), byte(crc >> 8), byte(crc)}
+	default:
+		if len(sums) == 0 {
+			d.Sum = h.Sum(nil)
+			break
+		}
+		for _, s := range sums {
+			h.Write(s.Sum(alg))
+		}
+		d.Sum = h.Sum(nil)
+		d.Parts = len(sums)
+	}
+	return d, nil
+}
+
+func beUint32(b []byte) uint32 {
+	return uint32(b[0])<<24 | uint32(b[1])<<16 | uint32(b[2])<<8 | uint32(b[3])
+}
+
+// Reversed polynomials of CRC32 and CRC32C.
+const (
+	crc32IEEE       = 0xedb88320
+	crc32Castagnoli = 0x82f63b78
+)
+
+// crc32Combine returns the CRC of the concatenation of two blocks from
+// their CRCs and the length of the second, as crc32_combine of zlib.
+func crc32Combine(poly, crc1, crc2 uint32, len2 int64) uint32 {
+	if len2 <= 0 {
+		return crc1
+	}
+	even := make([]uint32, 32) // operator for 2^n zero bits, n even
+	odd := make([]uint32, 32)  // operator for 2^n zero bits, n odd
+
+	// operator for one zero bit
+	odd[0] = poly
+	row := uint32(1)
+	for n := 1; n < 32; n++ {
+		odd[n] = row
+		row <<= 1
+	}
+	gf2MatrixSquare(even, odd) // two zero bits
+	gf2MatrixSquare(odd, even) // four zero bits
+
+	// apply len2 zero bytes to crc1, the first square is for one zero byte
+	for {
+		gf2MatrixSquare(even, odd)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(even, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+		gf2MatrixSquare(odd, even)
+		if len2&1 != 0 {
+			crc1 = gf2MatrixTimes(odd, crc1)
+		}
+		len2 >>= 1
+		if len2 == 0 {
+			break
+		}
+	}
+	return crc1 ^ crc2
+}
+
+func gf2MatrixTimes(mat []uint32, vec uint32) uint32 {
+	var sum uint32
+	for i := 0; vec != 0; i++ {
+		if vec&1 != 0 {
+			sum ^= mat[i]
+		}
+		vec >>= 1
+	}
+	return sum
+}
+
+func gf2MatrixSquare(square, mat []uint32) {
+	for n := 0; n < 32; n++ {
+		square[n] = gf2MatrixTimes(mat, mat[n])
+	}
+}
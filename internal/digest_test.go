@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestDigest(t *testing.T) {
+	content := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 1000)
+	whole, err := ChecksumOf(bytes.NewReader(content), ChecksumCRC32, ChecksumCRC32C)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	for _, chunksize := range []int64{1, 1000, 4500, 7777, 100000} {
+		fc := NewReaderChunk(bytes.NewReader(content), int64(len(content)), "fox", chunksize)
+		digests, err := fc.Digest(4, ChecksumMD5, ChecksumCRC32, ChecksumCRC32C)
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		// S3 multipart ETag
+		var etag []byte
+		for i := 0; i < fc.Chunk(); i++ {
+			off, n := fc.chunkRange(i)
+			sum := md5.Sum(content[off : off+n])
+			etag = append(etag, sum[:]...)
+		}
+		sum := md5.Sum(etag)
+		expected := fmt.Sprintf("%x-%v", sum, fc.Chunk())
+
+		t.Logf("chunksize: %v md5: %v crc32: %v crc32c: %v", chunksize, digests[0].Hex(), digests[1].Hex(), digests[2].Hex())
+		if digests[0].Hex() != expected || digests[1].Hex() != whole.Hex(ChecksumCRC32) || digests[2].Hex() != whole.Hex(ChecksumCRC32C) {
+			t.FailNow()
+		}
+	}
+}
+
+// go test -timeout 30m github.com/gostones/s3upload/internal -run ^TestDigestIntegration$ -v
+func TestDigestIntegration(t *testing.T) {
+	if testing.Short() {
+		t.Skip("skipping integration test")
+	}
+
+	files := []string{
+		"/tmp/500M.raw",
+		"/tmp/1G.raw",
+		"/tmp/5G.raw",
+		"/tmp/10G.raw",
+		"/tmp/50G.raw",
+	}
+	for _, file := range files {
+		fc := NewFileChunk(file, 10000000)
+		if err := fc.Open(); err != nil {
+			t.Log(err)
+			continue
+		}
+		track := TimeTrack(file)
+		func() {
+			defer track(time.Now())
+			digests, err := fc.Digest(0, ChecksumMD5, ChecksumCRC32C)
+			if err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+			fmt.Printf("file: %s md5: %s crc32c: %s\n", file, digests[0].Hex(), digests[1].Hex())
+		}()
+		fc.Close()
+	}
+}
@@ -0,0 +1,182 @@
+package internal
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Read modes of a file, how the chunks are read from the disk.
+const (
+	// ReadModeReadAt reads with the buffer of the caller, the default.
+	ReadModeReadAt = ""
+	// ReadModeMmap maps the file in memory and reads the chunks as slices.
+	// It is unsafe for files that may change: reading the mapping of a
+	// truncated file faults with SIGBUS, which crashes the program.
+	ReadModeMmap = "mmap"
+	// ReadModeReadahead reads large blocks at page aligned offsets through
+	// the page cache, hinting the kernel to read ahead the next block.
+	ReadModeReadahead = "readahead"
+)
+
+const (
+	readAlign = 4096 // alignment of the block reads, the page size
+	// ReadBlockSize is the size of the block reads of ReadModeReadahead.
+	ReadBlockSize = 1 << 20
+)
+
+// FileReader is a ReaderAt of a file, or of a range of it, with a read mode.
+type FileReader struct {
+	file    *os.File
+	base    int64 // offset of the range in the file
+	size    int64
+	mode    string
+	data    []byte      // mapped range
+	mapping []byte      // mapped file, nil for a range of another reader
+	pool    *BufferPool // blocks of the readahead reads
+}
+
+// NewFileReader returns a reader of the file with the read mode.
+// Close releases the mapping but does not close the file.
+func NewFileReader(f *os.File, mode string) (*FileReader, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	r := &FileReader{
+		file: f,
+		size: fi.Size(),
+		mode: mode,
+	}
+	switch mode {
+	case ReadModeReadAt:
+	case ReadModeMmap:
+		if r.size > 0 {
+			if r.mapping, err = mmap(f, r.size); err != nil {
+				return nil, err
+			}
+			r.data = r.mapping
+			adviseSequential(nil, r.data)
+		}
+	case ReadModeReadahead:
+		r.pool = NewBufferPool(ReadBlockSize)
+		adviseSequential(f, nil)
+	default:
+		return nil, fmt.Errorf("unsupported read mode: %q", mode)
+	}
+	return r, nil
+}
+
+// ReadAt reads from the mapping if mapped, from the file otherwise.
+func (r *FileReader) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	var eof error
+	if max := r.size - off; int64(len(p)) > max {
+		p = p[:max]
+		eof = io.EOF
+	}
+	if r.data != nil {
+		return copy(p, r.data[off:]), eof
+	}
+	n, err := r.file.ReadAt(p, r.base+off)
+	if err == nil {
+		err = eof
+	}
+	return n, err
+}
+
+// Range returns a reader of n bytes of the reader at off, the rest if n is
+// negative. The range shares the mapping, it is not read after Close.
+func (r *FileReader) Range(off, n int64) (*FileReader, error) {
+	if n < 0 {
+		n = r.size - off
+	}
+	if off < 0 || n < 0 || off+n > r.size {
+		return nil, fmt.Errorf("range %v+%v out of the %v bytes of %s", off, n, r.size, r.file.Name())
+	}
+	v := *r
+	v.base = r.base + off
+	v.size = n
+	v.mapping = nil
+	if r.data != nil {
+		v.data = r.data[off : off+n : off+n]
+	}
+	return &v, nil
+}
+
+// File returns the file read.
+func (r *FileReader) File() *os.File {
+	return r.file
+}
+
+// Size returns the size of the file when opened, or of the range.
+func (r *FileReader) Size() int64 {
+	return r.size
+}
+
+// Mode returns the read mode.
+func (r *FileReader) Mode() string {
+	return r.mode
+}
+
+// Close unmaps the file. It is a no-op for a range.
+func (r *FileReader) Close() error {
+	if r.mapping == nil {
+		return nil
+	}
+	mapping := r.mapping
+	r.mapping = nil
+	r.data = nil
+	return munmap(mapping)
+}
+
+// slice returns n bytes of the mapping at off, nil if not mapped.
+func (r *FileReader) slice(off, n int64) []byte {
+	if r.data == nil || off < 0 || off+n > int64(len(r.data)) {
+		return nil
+	}
+	return r.data[off : off+n : off+n]
+}
+
+// readBlock reads the block of the file aligned with off, hinting the
+// kernel to read ahead the next one. It returns the block and its offset
+// in the range, negative if the block starts before the range.
+func (r *FileReader) readBlock(off int64) ([]byte, int64, error) {
+	pos := r.base + off
+	pos -= pos % readAlign
+	buf := r.pool.Get()
+	adviseWillNeed(r.file, pos+ReadBlockSize, ReadBlockSize)
+	n, err := r.file.ReadAt(buf, pos)
+	if n == 0 {
+		r.pool.Put(buf)
+		if err == nil {
+			err = io.EOF
+		}
+		return nil, pos - r.base, err
+	}
+	return buf[:n], pos - r.base, nil
+}
+
+// sectionReader returns a reader of n bytes of ra at off, reading slices of
+// a mapped file and blocks of a readahead one.
+func sectionReader(ra io.ReaderAt, off, n int64) io.Reader {
+	switch ra := ra.(type) {
+	case *FileReader:
+		if b := ra.slice(off, n); b != nil {
+			return bytes.NewReader(b)
+		}
+		if ra.mode == ReadModeReadahead {
+			return bufio.NewReaderSize(io.NewSectionReader(ra, off, n), ReadBlockSize)
+		}
+	case *Segments:
+		return ra.sectionReader(off, n)
+	}
+	return io.NewSectionReader(ra, off, n)
+}
@@ -0,0 +1,174 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/md5"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+var readModes = []string{ReadModeReadAt, ReadModeMmap, ReadModeReadahead}
+
+func TestReadMode(t *testing.T) {
+	content := make([]byte, 3*ReadBlockSize+123)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	f, err := ioutil.TempFile("", "chunk")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.Remove(f.Name())
+	f.Write(content)
+	f.Close()
+	expected := fmt.Sprintf("%x", md5.Sum(content))
+
+	var chunksize int64 = ReadBlockSize + 4099 // chunks across the blocks
+	pool := NewBufferPool(chunksize)
+	for _, mode := range readModes {
+		fc := NewFileChunk(f.Name(), chunksize)
+		fc.SetReadMode(mode)
+		if err := fc.Open(); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		_, hex, err := fc.MD5()
+		if err != nil || hex != expected {
+			t.Logf("mode: %q md5: %v %v", mode, hex, err)
+			t.FailNow()
+		}
+
+		read := make([][]byte, fc.Chunk())
+		buffered := make([][]byte, fc.Chunk())
+		errs := fc.MapAsync(func(i int, r *ChunkReader) error {
+			var b bytes.Buffer
+			// small reads as io.Copy does
+			if _, err := io.CopyBuffer(&b, r, make([]byte, 8192)); err != nil {
+				return err
+			}
+			read[i] = b.Bytes()
+
+			br, _, err := r.Buffered(pool, ChecksumMD5)
+			if err != nil {
+				return err
+			}
+			defer br.Release()
+			buffered[i], err = ioutil.ReadAll(br)
+			return err
+		})
+		for _, err := range errs {
+			if err != nil {
+				t.Logf("mode: %q %v", mode, err)
+				t.FailNow()
+			}
+		}
+		if !bytes.Equal(bytes.Join(read, nil), content) || !bytes.Equal(bytes.Join(buffered, nil), content) {
+			t.Logf("mode: %q content mismatch", mode)
+			t.FailNow()
+		}
+		if err := fc.Close(); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+	}
+}
+
+func benchmarkReadMode(b *testing.B, mode string) {
+	filename := benchmarkFile(b, benchmarkSize)
+	defer os.Remove(filename)
+	b.SetBytes(benchmarkSize)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		fc := NewFileChunk(filename, benchmarkChunkSize)
+		fc.SetReadMode(mode)
+		if err := fc.Open(); err != nil {
+			b.Fatal(err)
+		}
+		fc.MapAsync(func(i int, r *ChunkReader) error {
+			_, err := io.Copy(ioutil.Discard, r)
+			return err
+		})
+		fc.Close()
+	}
+}
+
+// BenchmarkReadModeReadAt reads the chunks with the buffers of io.Copy.
+func BenchmarkReadModeReadAt(b *testing.B) {
+	benchmarkReadMode(b, ReadModeReadAt)
+}
+
+// BenchmarkReadModeMmap copies the chunks from the mapped file.
+func BenchmarkReadModeMmap(b *testing.B) {
+	benchmarkReadMode(b, ReadModeMmap)
+}
+
+// BenchmarkReadModeReadahead reads the chunks in blocks with readahead hints.
+func BenchmarkReadModeReadahead(b *testing.B) {
+	benchmarkReadMode(b, ReadModeReadahead)
+}
+
+func TestFileChunkRange(t *testing.T) {
+	content := make([]byte, 2*ReadBlockSize+5000)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	f, err := ioutil.TempFile("", "chunk")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.Remove(f.Name())
+	f.Write(content)
+	f.Close()
+
+	var offset int64 = ReadBlockSize - 1000 // not aligned
+	var length int64 = ReadBlockSize + 3000
+	for _, mode := range readModes {
+		for _, n := range []int64{length, -1} {
+			fc := NewFileChunk(f.Name(), 300000)
+			fc.SetReadMode(mode)
+			fc.SetRange(offset, n)
+			if err := fc.Open(); err != nil {
+				t.Log(err)
+				t.FailNow()
+			}
+			expected := content[offset:]
+			if n >= 0 {
+				expected = content[offset : offset+n]
+			}
+			read := make([][]byte, fc.Chunk())
+			errs := fc.Map(func(i int, r *ChunkReader) error {
+				var b bytes.Buffer
+				_, err := io.CopyBuffer(&b, r, make([]byte, 8192))
+				read[i] = b.Bytes()
+				return err
+			})
+			_, hex, err := fc.MD5()
+			if firstErr(errs) != nil || err != nil || fc.Size() != int64(len(expected)) || !bytes.Equal(bytes.Join(read, nil), expected) || hex != fmt.Sprintf("%x", md5.Sum(expected)) {
+				t.Logf("mode: %q length: %v size: %v errors: %v %v", mode, n, fc.Size(), errs, err)
+				t.FailNow()
+			}
+			fc.Close()
+		}
+	}
+
+	fc := NewFileChunk(f.Name(), 300000)
+	fc.SetRange(int64(len(content))-10, 11)
+	if err := fc.Open(); err == nil {
+		t.Log("range past the end of the file")
+		t.FailNow()
+	}
+}
+
+func firstErr(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package internal
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// FileState identifies the content of a file by its size, modification
+// time and inode, to detect the file was modified while read.
+type FileState struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	Inode   uint64    `json:"inode,omitempty"` // 0 if not supported
+}
+
+// NewFileState returns the state of the file info.
+func NewFileState(fi os.FileInfo) *FileState {
+	return &FileState{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		Inode:   inode(fi),
+	}
+}
+
+// StatFile returns the state of the open file.
+func StatFile(f *os.File) (*FileState, error) {
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	return NewFileState(fi), nil
+}
+
+// ModifiedError is returned when a file was modified since its state was recorded.
+type ModifiedError struct {
+	Name   string
+	Change string // what changed, e.g. size 10 -> 20
+	// Replaced reports whether another file is now at the name, e.g. rotated.
+	Replaced bool
+}
+
+func (e *ModifiedError) Error() string {
+	return fmt.Sprintf("%s was modified while uploading: %s", e.Name, e.Change)
+}
+
+// CheckFile returns a *ModifiedError if the open file changed from the state
+// or, if name is not empty, another file is at the name.
+func CheckFile(f *os.File, name string, state *FileState) error {
+	now, err := StatFile(f)
+	if err != nil {
+		return err
+	}
+	switch {
+	case now.Size != state.Size:
+		return &ModifiedError{Name: name, Change: fmt.Sprintf("size %v -> %v", state.Size, now.Size)}
+	case !now.ModTime.Equal(state.ModTime):
+		return &ModifiedError{Name: name, Change: fmt.Sprintf("modification time %v -> %v", state.ModTime, now.ModTime)}
+	case name == "":
+		return nil
+	}
+	fi, err := os.Stat(name)
+	if os.IsNotExist(err) {
+		return &ModifiedError{Name: name, Change: "renamed or removed", Replaced: true}
+	}
+	if err != nil {
+		return err
+	}
+	if ino := inode(fi); ino != state.Inode {
+		return &ModifiedError{Name: name, Change: fmt.Sprintf("inode %v -> %v", state.Inode, ino), Replaced: true}
+	}
+	return nil
+}
+
+// CheckModified returns a *ModifiedError if the file was modified since Open.
+// It returns nil for a FileChunk not opened from a file.
+func (r *FileChunk) CheckModified() error {
+	if r.file == nil || r.state == nil {
+		return nil
+	}
+	return CheckFile(r.file, r.filename, r.state)
+}
+
+// State returns the state of the file when opened, nil if not opened from a file.
+func (r *FileChunk) State() *FileState {
+	return r.state
+}
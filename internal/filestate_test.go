@@ -0,0 +1,97 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestCheckFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	name := dir + "/app.log"
+	if err := ioutil.WriteFile(name, []byte("line 1\n"), 0600); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	fc := NewFileChunk(name, 4)
+	if err := fc.Open(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer fc.Close()
+	if err := fc.CheckModified(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// rewritten in place with the same size
+	ioutil.WriteFile(name, []byte("line 2\n"), 0600)
+	os.Chtimes(name, time.Now(), fc.State().ModTime.Add(time.Second))
+	err = fc.CheckModified()
+	t.Logf("rewritten: %v", err)
+	if me, ok := err.(*ModifiedError); !ok || me.Replaced {
+		t.FailNow()
+	}
+
+	// appended to
+	f, _ := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0)
+	f.Write([]byte("line 3\n"))
+	f.Close()
+	err = fc.CheckModified()
+	t.Logf("appended: %v", err)
+	if me, ok := err.(*ModifiedError); !ok || me.Replaced {
+		t.FailNow()
+	}
+}
+
+func TestCheckFileRotated(t *testing.T) {
+	dir, err := ioutil.TempDir("", "state")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	name := dir + "/app.log"
+	ioutil.WriteFile(name, []byte("line 1\n"), 0600)
+
+	f, err := os.Open(name)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer f.Close()
+	state, err := StatFile(f)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// renamed, the content of the open file is the same
+	os.Rename(name, name+".1")
+	err = CheckFile(f, name, state)
+	t.Logf("renamed: %v", err)
+	if me, ok := err.(*ModifiedError); !ok || !me.Replaced {
+		t.FailNow()
+	}
+	if err := CheckFile(f, "", state); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	// a new file at the name
+	ioutil.WriteFile(name, []byte("line 2\n"), 0600)
+	err = CheckFile(f, name, state)
+	t.Logf("rotated: %v", err)
+	if state.Inode != 0 {
+		if me, ok := err.(*ModifiedError); !ok || !me.Replaced {
+			t.FailNow()
+		}
+	}
+}
@@ -0,0 +1,199 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxWait caps a single sleep so rate changes take effect promptly.
+const maxWait = 250 * time.Millisecond
+
+// Limiter is a token bucket shared by all the readers of an upload.
+// A rate of zero or less means unlimited.
+type Limiter struct {
+	mu       sync.Mutex
+	rate     int64 // bytes per second
+	schedule Schedule
+	tokens   float64
+	last     time.Time
+	now      func() time.Time
+}
+
+func NewLimiter(rate int64) *Limiter {
+	return &Limiter{
+		rate: rate,
+		now:  time.Now,
+	}
+}
+
+// SetRate changes the base rate in bytes per second at runtime.
+func (r *Limiter) SetRate(rate int64) {
+	r.mu.Lock()
+	r.rate = rate
+	r.mu.Unlock()
+}
+
+// SetSchedule sets the time windows overriding the base rate.
+func (r *Limiter) SetSchedule(s Schedule) {
+	r.mu.Lock()
+	r.schedule = s
+	r.mu.Unlock()
+}
+
+// Rate returns the base rate.
+func (r *Limiter) Rate() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rate
+}
+
+// Effective returns the rate in effect at the moment, taking the schedule into account.
+func (r *Limiter) Effective() int64 {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.effective(r.now())
+}
+
+func (r *Limiter) effective(t time.Time) int64 {
+	if rate, ok := r.schedule.Rate(t); ok {
+		return rate
+	}
+	return r.rate
+}
+
+// Wait blocks until at least one byte can be sent and returns the number
+// of bytes, no more than n, the caller is allowed to transfer.
+func (r *Limiter) Wait(n int) int {
+	allowed, _ := r.WaitContext(context.Background(), n)
+	return allowed
+}
+
+// WaitContext is like Wait but returns the context error if ctx is done while waiting.
+func (r *Limiter) WaitContext(ctx context.Context, n int) (int, error) {
+	for {
+		d, allowed := r.reserve(n)
+		if allowed > 0 || n <= 0 {
+			return allowed, nil
+		}
+		t := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return 0, ctx.Err()
+		case <-t.C:
+		}
+	}
+}
+
+// reserve takes up to n tokens from the bucket. If none is available it
+// returns the time to wait before trying again.
+func (r *Limiter) reserve(n int) (time.Duration, int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	now := r.now()
+	rate := r.effective(now)
+	if rate <= 0 || n <= 0 {
+		r.last = time.Time{}
+		return 0, n
+	}
+	// burst of one second worth of bytes
+	burst := float64(rate)
+	if r.last.IsZero() {
+		r.tokens = burst
+	} else {
+		r.tokens += now.Sub(r.last).Seconds() * float64(rate)
+		if r.tokens > burst {
+			r.tokens = burst
+		}
+	}
+	r.last = now
+
+	if r.tokens >= 1 {
+		allowed := n
+		if float64(allowed) > r.tokens {
+			allowed = int(r.tokens)
+		}
+		r.tokens -= float64(allowed)
+		return 0, allowed
+	}
+	d := time.Duration((1 - r.tokens) / float64(rate) * float64(time.Second))
+	if d > maxWait {
+		d = maxWait
+	}
+	return d, 0
+}
+
+// Window is a daily time window [Start, End) with its own rate.
+// Start and End are offsets from midnight, End may be less than Start for
+// windows spanning midnight.
+type Window struct {
+	Start time.Duration
+	End   time.Duration
+	Rate  int64
+}
+
+func (w Window) contains(t time.Time) bool {
+	d := time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute + time.Duration(t.Second())*time.Second
+	if w.Start <= w.End {
+		return d >= w.Start && d < w.End
+	}
+	return d >= w.Start || d < w.End
+}
+
+// Schedule is a list of windows, the first matching window wins.
+type Schedule []Window
+
+// Rate returns the rate of the window containing t in local time.
+func (s Schedule) Rate(t time.Time) (int64, bool) {
+	for _, w := range s {
+		if w.contains(t) {
+			return w.Rate, true
+		}
+	}
+	return 0, false
+}
+
+// ParseSchedule parses a comma separated list of windows in the form
+// HH:MM-HH:MM=rate, e.g. "22:00-06:00=0,09:00-18:00=1048576".
+// A rate of 0 means unlimited.
+func ParseSchedule(s string) (Schedule, error) {
+	var sched Schedule
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		kv := strings.SplitN(item, "=", 2)
+		span := strings.SplitN(kv[0], "-", 2)
+		if len(kv) != 2 || len(span) != 2 {
+			return nil, fmt.Errorf("invalid schedule window: %q", item)
+		}
+		start, err := parseClock(span[0])
+		if err != nil {
+			return nil, err
+		}
+		end, err := parseClock(span[1])
+		if err != nil {
+			return nil, err
+		}
+		rate, err := strconv.ParseInt(strings.TrimSpace(kv[1]), 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid schedule rate: %q", item)
+		}
+		sched = append(sched, Window{Start: start, End: end, Rate: rate})
+	}
+	return sched, nil
+}
+
+func parseClock(s string) (time.Duration, error) {
+	t, err := time.Parse("15:04", strings.TrimSpace(s))
+	if err != nil {
+		return 0, fmt.Errorf("invalid time of day: %q", s)
+	}
+	return time.Duration(t.Hour())*time.Hour + time.Duration(t.Minute())*time.Minute, nil
+}
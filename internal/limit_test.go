@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParseSchedule(t *testing.T) {
+	s, err := ParseSchedule("22:00-06:00=0, 09:00-18:00=1048576")
+	if err != nil || len(s) != 2 {
+		t.Log(s, err)
+		t.FailNow()
+	}
+	at := func(clock string) time.Time {
+		c, _ := time.Parse("15:04", clock)
+		return time.Date(2019, 9, 16, c.Hour(), c.Minute(), 0, 0, time.Local)
+	}
+	tests := []struct {
+		clock string
+		rate  int64
+		ok    bool
+	}{
+		{"23:30", 0, true},
+		{"05:59", 0, true},
+		{"06:00", 0, false},
+		{"12:00", 1048576, true},
+		{"18:00", 0, false},
+	}
+	for _, tc := range tests {
+		rate, ok := s.Rate(at(tc.clock))
+		t.Logf("clock: %s rate: %v ok: %v", tc.clock, rate, ok)
+		if rate != tc.rate || ok != tc.ok {
+			t.FailNow()
+		}
+	}
+
+	for _, bad := range []string{"22:00=1", "22:00-06:00", "25:00-06:00=1", "22:00-06:00=x"} {
+		if _, err := ParseSchedule(bad); err == nil {
+			t.Logf("expected error for %q", bad)
+			t.FailNow()
+		}
+	}
+}
+
+func TestLimiter(t *testing.T) {
+	now := time.Date(2019, 9, 16, 12, 0, 0, 0, time.Local)
+	l := NewLimiter(1000)
+	l.now = func() time.Time { return now }
+
+	// initial burst
+	if d, n := l.reserve(4096); n != 1000 || d != 0 {
+		t.Log(d, n)
+		t.FailNow()
+	}
+	// bucket empty
+	if d, n := l.reserve(4096); n != 0 || d <= 0 {
+		t.Log(d, n)
+		t.FailNow()
+	}
+	// refill
+	now = now.Add(500 * time.Millisecond)
+	if _, n := l.reserve(4096); n != 500 {
+		t.Log(n)
+		t.FailNow()
+	}
+
+	// unlimited at night
+	l.SetSchedule(Schedule{{Start: 22 * time.Hour, End: 6 * time.Hour, Rate: 0}})
+	now = time.Date(2019, 9, 16, 23, 0, 0, 0, time.Local)
+	if _, n := l.reserve(1 << 20); n != 1<<20 {
+		t.Log(n)
+		t.FailNow()
+	}
+
+	// runtime adjustment
+	now = time.Date(2019, 9, 17, 12, 0, 0, 0, time.Local)
+	l.SetRate(10)
+	if _, n := l.reserve(4096); n != 10 || l.Effective() != 10 {
+		t.Log(n)
+		t.FailNow()
+	}
+}
+
+func TestChunkReaderLimit(t *testing.T) {
+	fc := NewFileChunk("./testdata/file.txt", 16)
+	if err := fc.Open(); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer fc.Close()
+
+	l := NewLimiter(8)
+	fc.SetLimiter(l)
+	buf := make([]byte, 16)
+	rd := fc.Readers()[0]
+	n, err := rd.Read(buf)
+	t.Logf("read: %v count: %v error: %v", n, fc.Count(), err)
+	if n != 8 || fc.Count() != 8 {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,182 @@
+// Package logging is a small leveled logger writing one JSON object per line.
+package logging
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	if l < LevelDebug || l > LevelError {
+		return fmt.Sprintf("level(%d)", int(l))
+	}
+	return levelNames[l]
+}
+
+// ParseLevel parses a level name such as "info".
+func ParseLevel(s string) (Level, error) {
+	for i, name := range levelNames {
+		if strings.EqualFold(s, name) {
+			return Level(i), nil
+		}
+	}
+	return LevelInfo, fmt.Errorf("unknown log level: %q", s)
+}
+
+// Logger writes entries at or above its level with the key value pairs
+// added by With. Values are redacted with RedactString before writing.
+type Logger struct {
+	mu     *sync.Mutex
+	w      io.Writer
+	level  Level
+	fields []interface{}
+	now    func() time.Time
+}
+
+func New(w io.Writer, level Level) *Logger {
+	return &Logger{
+		mu:    &sync.Mutex{},
+		w:     w,
+		level: level,
+		now:   time.Now,
+	}
+}
+
+// Default logs to stderr at info level.
+var Default = New(os.Stderr, LevelInfo)
+
+// With returns a logger adding the key value pairs to every entry.
+func (l *Logger) With(kv ...interface{}) *Logger {
+	c := *l
+	c.fields = append(append([]interface{}{}, l.fields...), kv...)
+	return &c
+}
+
+// Enabled reports whether entries of the level are written.
+func (l *Logger) Enabled(level Level) bool {
+	return level >= l.level
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	// keep the order of the keys
+	var b strings.Builder
+	b.WriteByte('{')
+	writeField(&b, "time", l.now().UTC().Format(time.RFC3339Nano))
+	b.WriteByte(',')
+	writeField(&b, "level", level.String())
+	b.WriteByte(',')
+	writeField(&b, "msg", RedactString(msg))
+	for _, fields := range [][]interface{}{l.fields, kv} {
+		for i := 0; i < len(fields); i += 2 {
+			key := fmt.Sprint(fields[i])
+			var v interface{} = "(missing)"
+			if i+1 < len(fields) {
+				v = fields[i+1]
+			}
+			b.WriteByte(',')
+			writeField(&b, key, value(v))
+		}
+	}
+	b.WriteString("}\n")
+
+	l.mu.Lock()
+	io.WriteString(l.w, b.String())
+	l.mu.Unlock()
+}
+
+func writeField(b *strings.Builder, key string, v interface{}) {
+	k, _ := json.Marshal(key)
+	b.Write(k)
+	b.WriteByte(':')
+	j, err := json.Marshal(v)
+	if err != nil {
+		j, _ = json.Marshal(fmt.Sprint(v))
+	}
+	b.Write(j)
+}
+
+// value converts v to a JSON friendly value with the secrets redacted.
+func value(v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case string:
+		return RedactString(t)
+	case error:
+		return RedactString(t.Error())
+	case fmt.Stringer:
+		return RedactString(t.String())
+	case bool, int, int32, int64, uint, uint32, uint64, float32, float64:
+		return t
+	case time.Duration:
+		return t.String()
+	}
+	return RedactString(fmt.Sprintf("%+v", v))
+}
+
+type contextKey int
+
+const (
+	loggerKey contextKey = iota
+	requestIDKey
+)
+
+// NewContext returns a context carrying the logger.
+func NewContext(ctx context.Context, l *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey, l)
+}
+
+// FromContext returns the logger of the context or Default.
+func FromContext(ctx context.Context) *Logger {
+	if l, ok := ctx.Value(loggerKey).(*Logger); ok {
+		return l
+	}
+	return Default
+}
+
+// WithRequestID returns a context carrying the request correlation id.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey, id)
+}
+
+// RequestID returns the request correlation id of the context, if any.
+func RequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+	return id
+}
+
+// NewRequestID returns a random correlation id.
+func NewRequestID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return fmt.Sprintf("%x", time.Now().UnixNano())
+	}
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,82 @@
+package logging
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLogger(t *testing.T) {
+	var buf bytes.Buffer
+	l := New(&buf, LevelInfo)
+	l.now = func() time.Time { return time.Date(2019, 9, 16, 12, 0, 0, 0, time.UTC) }
+
+	l.Debug("hidden")
+	l.With("request_id", "abc").Info("presigned", "url", "http://s3/b/k?partNumber=1&X-Amz-Signature=secret", "err", errors.New("boom"), "n", 3)
+
+	s := buf.String()
+	t.Log(s)
+	if strings.Contains(s, "hidden") || strings.Contains(s, "secret") {
+		t.FailNow()
+	}
+	var entry map[string]interface{}
+	if err := json.Unmarshal(buf.Bytes(), &entry); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	if entry["level"] != "info" || entry["request_id"] != "abc" || entry["err"] != "boom" || entry["n"] != float64(3) ||
+		entry["time"] != "2019-09-16T12:00:00Z" {
+		t.FailNow()
+	}
+}
+
+func TestParseLevel(t *testing.T) {
+	if l, err := ParseLevel("WARN"); err != nil || l != LevelWarn {
+		t.FailNow()
+	}
+	if _, err := ParseLevel("verbose"); err == nil {
+		t.FailNow()
+	}
+}
+
+func TestContext(t *testing.T) {
+	if FromContext(context.Background()) != Default {
+		t.FailNow()
+	}
+	l := New(&bytes.Buffer{}, LevelDebug)
+	ctx := WithRequestID(NewContext(context.Background(), l), "abc")
+	if FromContext(ctx) != l || RequestID(ctx) != "abc" {
+		t.FailNow()
+	}
+	if id := NewRequestID(); len(id) != 16 || id == NewRequestID() {
+		t.FailNow()
+	}
+}
+
+func TestRedact(t *testing.T) {
+	u := "https://s3.amazonaws.com/bucket/key?partNumber=1&uploadId=x&X-Amz-Credential=AKIA%2F&X-Amz-Signature=abcdef"
+	r := RedactURL(u)
+	t.Log(r)
+	if strings.Contains(r, "abcdef") || strings.Contains(r, "AKIA") || !strings.Contains(r, "uploadId=x") {
+		t.FailNow()
+	}
+
+	s := RedactString("PUT " + u + " failed")
+	t.Log(s)
+	if strings.Contains(s, "abcdef") || strings.Contains(s, "AKIA") || !strings.HasSuffix(s, " failed") {
+		t.FailNow()
+	}
+
+	h := http.Header{}
+	h.Set("Authorization", "AWS4-HMAC-SHA256 secret")
+	h.Set("Content-Type", "text/plain")
+	rh := RedactHeader(h)
+	if rh.Get("Authorization") != redacted || rh.Get("Content-Type") != "text/plain" || h.Get("Authorization") == redacted {
+		t.FailNow()
+	}
+}
@@ -0,0 +1,85 @@
+package logging
+
+import (
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+const redacted = "REDACTED"
+
+// sensitiveParams are the query parameters of presigned URLs granting access.
+var sensitiveParams = []string{
+	"X-Amz-Signature",
+	"X-Amz-Credential",
+	"X-Amz-Security-Token",
+	"Signature",
+	"AWSAccessKeyId",
+	"x-amz-server-side-encryption-customer-key",
+}
+
+// sensitiveHeaders are the headers carrying credentials or keys.
+var sensitiveHeaders = []string{
+	"Authorization",
+	"X-Amz-Security-Token",
+	"X-Amz-Server-Side-Encryption-Customer-Key",
+	"X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key",
+	"X-S3upload-Signature",
+}
+
+// paramPattern matches a sensitive query parameter anywhere in a text.
+var paramPattern = func() *regexp.Regexp {
+	var names []string
+	for _, p := range sensitiveParams {
+		names = append(names, regexp.QuoteMeta(p))
+	}
+	return regexp.MustCompile(`(?i)((?:` + strings.Join(names, "|") + `)=)[^&\s"]*`)
+}()
+
+// RedactURL replaces the values of the sensitive query parameters of the url.
+func RedactURL(u string) string {
+	p, err := url.Parse(u)
+	if err != nil {
+		return RedactString(u)
+	}
+	if p.User != nil {
+		p.User = url.User(p.User.Username())
+	}
+	q := p.Query()
+	changed := false
+	for k := range q {
+		for _, s := range sensitiveParams {
+			if strings.EqualFold(k, s) {
+				q.Set(k, redacted)
+				changed = true
+			}
+		}
+	}
+	if changed {
+		p.RawQuery = q.Encode()
+	}
+	return p.String()
+}
+
+// RedactString replaces the values of the sensitive query parameters found in s.
+func RedactString(s string) string {
+	if !paramPattern.MatchString(s) {
+		return s
+	}
+	return paramPattern.ReplaceAllString(s, "${1}"+redacted)
+}
+
+// RedactHeader returns a copy of the header with the sensitive values replaced.
+func RedactHeader(h http.Header) http.Header {
+	c := make(http.Header, len(h))
+	for k, v := range h {
+		c[k] = v
+	}
+	for _, k := range sensitiveHeaders {
+		if c.Get(k) != "" {
+			c.Set(k, redacted)
+		}
+	}
+	return c
+}
@@ -0,0 +1,33 @@
+package internal
+
+import (
+	"sync"
+)
+
+// BufferPool recycles the buffers of the chunks so a part is read once
+// into memory without allocating a chunk per part.
+type BufferPool struct {
+	size int64
+	pool sync.Pool
+}
+
+// NewBufferPool returns a pool of buffers of size bytes.
+func NewBufferPool(size int64) *BufferPool {
+	return &BufferPool{size: size}
+}
+
+// Get returns a buffer of the pool size.
+func (r *BufferPool) Get() []byte {
+	if b, ok := r.pool.Get().(*[]byte); ok {
+		return (*b)[:r.size]
+	}
+	return make([]byte, r.size)
+}
+
+// Put returns the buffer to the pool.
+func (r *BufferPool) Put(b []byte) {
+	if int64(cap(b)) < r.size {
+		return
+	}
+	r.pool.Put(&b)
+}
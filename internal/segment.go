@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"io"
+	"os"
+	"sort"
+)
+
+// Segment is Length bytes of a ReaderAt at Offset.
+type Segment struct {
+	ReaderAt io.ReaderAt
+	Offset   int64
+	Length   int64
+}
+
+// Segments is a ReaderAt of the concatenation of segments, e.g. ranges of
+// several files chunked as one.
+type Segments struct {
+	segs []Segment
+	ends []int64 // end offset of each segment in the concatenation
+}
+
+// NewSegments returns a reader of the concatenation of the segments.
+func NewSegments(segs ...Segment) *Segments {
+	r := &Segments{segs: segs}
+	var end int64
+	for _, s := range segs {
+		end += s.Length
+		r.ends = append(r.ends, end)
+	}
+	return r
+}
+
+// Size returns the total length of the segments.
+func (r *Segments) Size() int64 {
+	if len(r.ends) == 0 {
+		return 0
+	}
+	return r.ends[len(r.ends)-1]
+}
+
+// Segments returns the segments.
+func (r *Segments) Segments() []Segment {
+	return r.segs
+}
+
+// find returns the segment with off and the offset in it.
+func (r *Segments) find(off int64) (int, int64) {
+	i := sort.Search(len(r.ends), func(i int) bool { return r.ends[i] > off })
+	if i == len(r.ends) {
+		return i, 0
+	}
+	return i, off - (r.ends[i] - r.segs[i].Length)
+}
+
+// ReadAt reads across the segments.
+func (r *Segments) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 {
+		return 0, os.ErrInvalid
+	}
+	i, soff := r.find(off)
+	var n int
+	for ; i < len(r.segs) && n < len(p); i++ {
+		s := r.segs[i]
+		b := p[n:]
+		if rest := s.Length - soff; int64(len(b)) > rest {
+			b = b[:rest]
+		}
+		m, err := s.ReaderAt.ReadAt(b, s.Offset+soff)
+		n += m
+		if m < len(b) {
+			if err == nil || err == io.EOF {
+				// the segment is shorter than its length
+				err = io.ErrUnexpectedEOF
+			}
+			return n, err
+		}
+		soff = 0
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// sectionReader returns a reader of n bytes at off reading each segment as
+// its section reader.
+func (r *Segments) sectionReader(off, n int64) io.Reader {
+	var rs []io.Reader
+	i, soff := r.find(off)
+	for ; i < len(r.segs) && n > 0; i++ {
+		s := r.segs[i]
+		m := s.Length - soff
+		if m > n {
+			m = n
+		}
+		rs = append(rs, sectionReader(s.ReaderAt, s.Offset+soff, m))
+		n -= m
+		soff = 0
+	}
+	return io.MultiReader(rs...)
+}
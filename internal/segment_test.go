@@ -0,0 +1,55 @@
+package internal
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestSegments(t *testing.T) {
+	a := []byte("The quick brown fox ")
+	b := []byte("jumps over the lazy dog")
+	r := NewSegments(
+		Segment{ReaderAt: bytes.NewReader(a), Offset: 4, Length: 6},  // quick
+		Segment{ReaderAt: bytes.NewReader(b), Offset: 0, Length: 6},  // jumps
+		Segment{ReaderAt: bytes.NewReader(b), Offset: 15, Length: 8}, // lazy dog
+	)
+	expected := "quick jumps lazy dog"
+	if r.Size() != int64(len(expected)) {
+		t.Logf("size: %v", r.Size())
+		t.FailNow()
+	}
+	for off := 0; off < len(expected); off++ {
+		for n := 1; off+n <= len(expected); n++ {
+			p := make([]byte, n)
+			m, err := r.ReadAt(p, int64(off))
+			if m != n || err != nil || string(p) != expected[off:off+n] {
+				t.Logf("off: %v n: %v read: %q %v", off, n, p[:m], err)
+				t.FailNow()
+			}
+			s, err := ioutil.ReadAll(sectionReader(r, int64(off), int64(n)))
+			if err != nil || string(s) != expected[off:off+n] {
+				t.Logf("off: %v n: %v section: %q %v", off, n, s, err)
+				t.FailNow()
+			}
+		}
+	}
+	if n, err := r.ReadAt(make([]byte, 5), 18); n != 2 || err != io.EOF {
+		t.Logf("past the end: %v %v", n, err)
+		t.FailNow()
+	}
+
+	// chunks across the segments
+	fc := NewReaderChunk(r, r.Size(), "fox", 7)
+	var chunks []string
+	fc.Map(func(i int, cr *ChunkReader) error {
+		b, _ := ioutil.ReadAll(cr)
+		chunks = append(chunks, string(b))
+		return nil
+	})
+	t.Logf("chunks: %q", chunks)
+	if len(chunks) != 3 || chunks[0]+chunks[1]+chunks[2] != expected {
+		t.FailNow()
+	}
+}
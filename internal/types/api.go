@@ -0,0 +1,51 @@
+package types
+
+// APIVersion is the version prefix of the server endpoints.
+const APIVersion = "v1"
+
+// Endpoints of the server API, shared by the server and the client so a
+// change of contract breaks the build. See openapi.json for the spec.
+const (
+	PathStartUpload    = "/" + APIVersion + "/start-upload"
+	PathGetUploadURL   = "/" + APIVersion + "/get-upload-url"
+	PathCompleteUpload = "/" + APIVersion + "/complete-upload"
+	PathAbortUpload    = "/" + APIVersion + "/abort-upload"
+	PathCopyUploadPart = "/" + APIVersion + "/copy-upload-part"
+	PathComposeUpload  = "/" + APIVersion + "/compose-upload"
+	PathGetDownloadURL = "/" + APIVersion + "/get-download-url"
+	PathListParts      = "/" + APIVersion + "/list-parts"
+)
+
+// HeaderRequestID carries the correlation id of the requests of an upload
+// from the client to the server logs.
+const HeaderRequestID = "X-Request-Id"
+
+// HeaderUser identifies the uploader for the audit trail, set by the
+// authenticating proxy in front of the server. The server ignores it
+// unless it trusts the proxy.
+const HeaderUser = "X-Upload-User"
+
+// Headers of the customer provided key (SSE-C), sent by the client on
+// start-upload and get-upload-url and by the server back in the signed headers
+// of the part. The key is base64 encoded, the MD5 is of the raw key.
+const (
+	HeaderSSECustomerAlgorithm = "X-Amz-Server-Side-Encryption-Customer-Algorithm"
+	HeaderSSECustomerKey       = "X-Amz-Server-Side-Encryption-Customer-Key"
+	HeaderSSECustomerKeyMD5    = "X-Amz-Server-Side-Encryption-Customer-Key-MD5"
+)
+
+// Headers of the customer provided key of the source objects of
+// copy-upload-part and compose-upload.
+const (
+	HeaderCopySourceSSECustomerAlgorithm = "X-Amz-Copy-Source-Server-Side-Encryption-Customer-Algorithm"
+	HeaderCopySourceSSECustomerKey       = "X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key"
+	HeaderCopySourceSSECustomerKeyMD5    = "X-Amz-Copy-Source-Server-Side-Encryption-Customer-Key-MD5"
+)
+
+// Headers of the notification webhooks. The signature is the hex encoded
+// HMAC-SHA256 of the timestamp, a dot and the body, keyed with the shared secret.
+const (
+	HeaderEvent     = "X-S3upload-Event"
+	HeaderTimestamp = "X-S3upload-Timestamp"
+	HeaderSignature = "X-S3upload-Signature"
+)
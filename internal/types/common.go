@@ -1,8 +1,19 @@
 package types
 
+// StartUploadRequest is sent as query parameters or, with the metadata
+// and tags, as JSON body of a POST.
 type StartUploadRequest struct {
-	FileName string `json:"fileName"`
-	FileType string `json:"fileType"`
+	FileName             string            `json:"fileName"`
+	FileType             string            `json:"fileType"`
+	FileSize             int64             `json:"fileSize"` // optional, 0 if unknown
+	CacheControl         string            `json:"cacheControl,omitempty"`
+	ContentDisposition   string            `json:"contentDisposition,omitempty"`
+	ContentEncoding      string            `json:"contentEncoding,omitempty"`
+	StorageClass         string            `json:"storageClass,omitempty"`
+	ServerSideEncryption string            `json:"serverSideEncryption,omitempty"` // AES256 or aws:kms, SSE-C is set with headers
+	ChecksumAlgorithm    string            `json:"checksumAlgorithm,omitempty"`    // SHA256, SHA1, CRC32 or CRC32C of the parts
+	Metadata             map[string]string `json:"metadata,omitempty"`             // x-amz-meta-*
+	Tags                 map[string]string `json:"tags,omitempty"`
 }
 
 type StartUploadResponse struct {
@@ -13,10 +24,17 @@ type GetUploadURLRequest struct {
 	FileName   string `json:"fileName"`
 	PartNumber string `json:"partNumber"`
 	UploadID   string `json:"uploadId"`
+	MD5        string `json:"md5"` // base64 coded MD5 checksum of the part
+
+	// base64 coded checksum of the part with the algorithm of the upload
+	ChecksumAlgorithm string `json:"checksumAlgorithm"`
+	Checksum          string `json:"checksum"`
 }
 
 type GetUploadURLResponse struct {
 	PresignedURL string `json:"presignedUrl"`
+	// Headers are signed with the URL and must be sent with the PUT of the part.
+	Headers map[string]string `json:"headers,omitempty"`
 }
 
 type CompleteUploadRequest struct {
@@ -24,14 +42,16 @@ type CompleteUploadRequest struct {
 }
 
 type CompleteUploadParams struct {
-	FileName string               `json:"fileName"`
-	Parts    []CompleteUploadPart `json:"parts"`
-	UploadID string               `json:"uploadId"`
+	FileName          string               `json:"fileName"`
+	Parts             []CompleteUploadPart `json:"parts"`
+	UploadID          string               `json:"uploadId"`
+	ChecksumAlgorithm string               `json:"checksumAlgorithm,omitempty"` // of the upload, the parts have its checksum
 }
 
 type CompleteUploadPart struct {
 	ETag       string
 	PartNumber int64
+	Checksum   string `json:",omitempty"` // base64 coded
 }
 
 type CompleteUploadResponse struct {
@@ -44,3 +64,121 @@ type CompleteUploadData struct {
 	Key      string
 	ETag     string
 }
+
+// CopyUploadPartRequest copies a byte range of an object of the bucket as a
+// part of an upload, the storage copies the data.
+type CopyUploadPartRequest struct {
+	FileName   string `json:"fileName"`
+	UploadID   string `json:"uploadId"`
+	PartNumber int64  `json:"partNumber"`
+	Source     string `json:"source"`          // key of the object copied
+	Range      string `json:"range,omitempty"` // bytes=first-last, the whole object if empty
+
+	ChecksumAlgorithm string `json:"checksumAlgorithm,omitempty"` // of the upload
+}
+
+type CopyUploadPartResponse struct {
+	ETag     string `json:"etag"`
+	Checksum string `json:"checksum,omitempty"` // base64 coded, with the algorithm of the upload
+}
+
+// ComposeUploadRequest creates an object from parts in order, ranges of
+// objects of the bucket copied by the storage or parts already uploaded.
+// The upload is started with Params unless UploadID is set, then Params
+// only names the object and its checksum algorithm.
+type ComposeUploadRequest struct {
+	Params   StartUploadRequest  `json:"params"`
+	UploadID string              `json:"uploadId,omitempty"`
+	Parts    []ComposeUploadPart `json:"parts"`
+}
+
+// ComposeUploadPart is either copied from Source or uploaded with ETag,
+// it is numbered by its position from 1.
+type ComposeUploadPart struct {
+	Source   string `json:"source,omitempty"` // key of the object copied
+	Range    string `json:"range,omitempty"`  // bytes=first-last of the source, the whole object if empty
+	ETag     string `json:"etag,omitempty"`   // of the part uploaded
+	Checksum string `json:"checksum,omitempty"`
+}
+
+// GetDownloadURLRequest presigns the download of an object, or of a byte
+// range of it, sent as query parameters.
+type GetDownloadURLRequest struct {
+	FileName string `json:"fileName"`
+	Range    string `json:"range"`   // bytes=first-last, the whole object if empty
+	IfMatch  string `json:"ifMatch"` // ETag of the object, the download fails if changed
+}
+
+type GetDownloadURLResponse struct {
+	PresignedURL string `json:"presignedUrl"`
+	// Headers are signed with the URL and must be sent with the GET.
+	Headers map[string]string `json:"headers,omitempty"`
+
+	// Description of the object, omitted for a range.
+	Size                 int64             `json:"size,omitempty"`
+	ETag                 string            `json:"etag,omitempty"`
+	PartSizes            []int64           `json:"partSizes,omitempty"` // of the parts of a multipart object, in order
+	ContentType          string            `json:"contentType,omitempty"`
+	ServerSideEncryption string            `json:"serverSideEncryption,omitempty"`
+	Checksums            map[string]string `json:"checksums,omitempty"` // base64 coded S3 checksums by algorithm
+	Metadata             map[string]string `json:"metadata,omitempty"`  // x-amz-meta-*, lower case keys
+}
+
+type AbortUploadRequest struct {
+	FileName string `json:"fileName"`
+	UploadID string `json:"uploadId"`
+}
+
+type ListPartsRequest struct {
+	FileName string `json:"fileName"`
+	UploadID string `json:"uploadId"`
+}
+
+// ListPartsResponse lists the parts uploaded, in order.
+type ListPartsResponse struct {
+	Parts []UploadedPart `json:"parts"`
+}
+
+type UploadedPart struct {
+	PartNumber int64             `json:"partNumber"`
+	ETag       string            `json:"etag"`
+	Size       int64             `json:"size"`
+	Checksums  map[string]string `json:"checksums,omitempty"` // base64 coded S3 checksums by algorithm
+}
+
+// ErrorResponse is the body of every error response of the server.
+type ErrorResponse struct {
+	Error ErrorDetail `json:"error"`
+}
+
+type ErrorDetail struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// Error codes of ErrorDetail. The S3 error codes are passed through as is.
+const (
+	ErrCodeInvalidRequest     = "InvalidRequest"
+	ErrCodeNotFound           = "NotFound"
+	ErrCodeServiceUnavailable = "ServiceUnavailable"
+	ErrCodeInternalError      = "InternalError"
+	ErrCodeNoSuchUpload       = "NoSuchUpload"
+	ErrCodeInvalidPart        = "InvalidPart"
+	ErrCodeInvalidPartOrder   = "InvalidPartOrder"
+	ErrCodeEntityTooSmall     = "EntityTooSmall"
+	ErrCodeAccessDenied       = "AccessDenied"
+)
+
+// UploadEvent is the payload of the notification webhooks.
+type UploadEvent struct {
+	Event    string            `json:"event"` // upload.completed, upload.failed or upload.aborted
+	Time     string            `json:"time"`  // RFC 3339
+	Bucket   string            `json:"bucket"`
+	Key      string            `json:"key"`
+	UploadID string            `json:"uploadId"`
+	ETag     string            `json:"etag,omitempty"`
+	Size     int64             `json:"size,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+	Uploader string            `json:"uploader,omitempty"`
+	Error    string            `json:"error,omitempty"`
+}
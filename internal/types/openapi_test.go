@@ -0,0 +1,209 @@
+package types
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// schemaTypes maps the schemas of openapi.json to the Go types.
+var schemaTypes = map[string]interface{}{
+	"StartUploadRequest":     StartUploadRequest{},
+	"StartUploadResponse":    StartUploadResponse{},
+	"GetUploadURLResponse":   GetUploadURLResponse{},
+	"CompleteUploadRequest":  CompleteUploadRequest{},
+	"CompleteUploadParams":   CompleteUploadParams{},
+	"CompleteUploadPart":     CompleteUploadPart{},
+	"CompleteUploadResponse": CompleteUploadResponse{},
+	"CompleteUploadData":     CompleteUploadData{},
+	"CopyUploadPartRequest":  CopyUploadPartRequest{},
+	"CopyUploadPartResponse": CopyUploadPartResponse{},
+	"ComposeUploadRequest":   ComposeUploadRequest{},
+	"ComposeUploadPart":      ComposeUploadPart{},
+	"GetDownloadURLResponse": GetDownloadURLResponse{},
+	"ListPartsResponse":      ListPartsResponse{},
+	"UploadedPart":           UploadedPart{},
+	"ErrorResponse":          ErrorResponse{},
+	"ErrorDetail":            ErrorDetail{},
+	"UploadEvent":            UploadEvent{},
+}
+
+// queryTypes maps the x-go-type of the operations taking query parameters to the Go types.
+var queryTypes = map[string]interface{}{
+	"StartUploadRequest":    StartUploadRequest{},
+	"GetUploadURLRequest":   GetUploadURLRequest{},
+	"AbortUploadRequest":    AbortUploadRequest{},
+	"GetDownloadURLRequest": GetDownloadURLRequest{},
+	"ListPartsRequest":      ListPartsRequest{},
+}
+
+var paths = []string{
+	PathStartUpload,
+	PathGetUploadURL,
+	PathCompleteUpload,
+	PathAbortUpload,
+	PathCopyUploadPart,
+	PathComposeUpload,
+	PathGetDownloadURL,
+	PathListParts,
+}
+
+type openAPI struct {
+	Paths      map[string]map[string]operation `json:"paths"`
+	Components struct {
+		Schemas map[string]schema `json:"schemas"`
+	} `json:"components"`
+}
+
+type operation struct {
+	GoType     string `json:"x-go-type"`
+	Parameters []struct {
+		Name string `json:"name"`
+		In   string `json:"in"`
+	} `json:"parameters"`
+}
+
+type schema struct {
+	Type                 string             `json:"type,omitempty"`
+	Ref                  string             `json:"$ref,omitempty"`
+	Items                *schema            `json:"items,omitempty"`
+	Properties           map[string]*schema `json:"properties,omitempty"`
+	AdditionalProperties *schema            `json:"additionalProperties,omitempty"`
+}
+
+func loadSpec(t *testing.T) *openAPI {
+	b, err := ioutil.ReadFile("openapi.json")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	var spec openAPI
+	if err := json.Unmarshal(b, &spec); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	return &spec
+}
+
+// jsonName returns the name of the field in JSON, empty if the field is skipped.
+func jsonName(f reflect.StructField) string {
+	tag := strings.Split(f.Tag.Get("json"), ",")[0]
+	if tag == "-" || f.PkgPath != "" {
+		return ""
+	}
+	if tag == "" {
+		return f.Name
+	}
+	return tag
+}
+
+// schemaOf derives the schema of a Go type, referencing the named structs.
+func schemaOf(t reflect.Type, top bool) *schema {
+	switch t.Kind() {
+	case reflect.String:
+		return &schema{Type: "string"}
+	case reflect.Bool:
+		return &schema{Type: "boolean"}
+	case reflect.Int, reflect.Int32, reflect.Int64:
+		return &schema{Type: "integer"}
+	case reflect.Ptr:
+		return schemaOf(t.Elem(), top)
+	case reflect.Slice:
+		return &schema{Type: "array", Items: schemaOf(t.Elem(), false)}
+	case reflect.Map:
+		return &schema{Type: "object", AdditionalProperties: schemaOf(t.Elem(), false)}
+	case reflect.Struct:
+		if !top {
+			return &schema{Ref: "#/components/schemas/" + t.Name()}
+		}
+		s := &schema{Type: "object", Properties: map[string]*schema{}}
+		for i := 0; i < t.NumField(); i++ {
+			if name := jsonName(t.Field(i)); name != "" {
+				s.Properties[name] = schemaOf(t.Field(i).Type, false)
+			}
+		}
+		return s
+	}
+	return &schema{Type: t.Kind().String()}
+}
+
+func TestOpenAPISchemas(t *testing.T) {
+	spec := loadSpec(t)
+
+	for name, s := range spec.Components.Schemas {
+		v, ok := schemaTypes[name]
+		if !ok {
+			t.Logf("schema %s has no Go type", name)
+			t.FailNow()
+		}
+		expected, _ := json.Marshal(schemaOf(reflect.TypeOf(v), true))
+		actual, _ := json.Marshal(s)
+		if string(expected) != string(actual) {
+			t.Logf("schema %s doesn't match the Go type\nspec: %s\n  go: %s", name, actual, expected)
+			t.Fail()
+		}
+	}
+	for name := range schemaTypes {
+		if _, ok := spec.Components.Schemas[name]; !ok {
+			t.Logf("type %s is missing in the spec", name)
+			t.Fail()
+		}
+	}
+}
+
+func TestOpenAPIPaths(t *testing.T) {
+	spec := loadSpec(t)
+
+	var expected, actual []string
+	for _, p := range paths {
+		expected = append(expected, p)
+	}
+	for p := range spec.Paths {
+		actual = append(actual, p)
+	}
+	sort.Strings(expected)
+	sort.Strings(actual)
+	if !reflect.DeepEqual(expected, actual) {
+		t.Logf("paths don't match\nspec: %v\n  go: %v", actual, expected)
+		t.FailNow()
+	}
+
+	// query parameters
+	for p, ops := range spec.Paths {
+		for method, op := range ops {
+			if op.GoType == "" {
+				continue
+			}
+			v, ok := queryTypes[op.GoType]
+			if !ok {
+				t.Logf("%s %s: unknown x-go-type %s", method, p, op.GoType)
+				t.FailNow()
+			}
+			var params, fields []string
+			for _, param := range op.Parameters {
+				if param.In == "query" {
+					params = append(params, param.Name)
+				}
+			}
+			typ := reflect.TypeOf(v)
+			for i := 0; i < typ.NumField(); i++ {
+				// maps are only sent in the JSON body
+				if typ.Field(i).Type.Kind() == reflect.Map {
+					continue
+				}
+				if name := jsonName(typ.Field(i)); name != "" {
+					fields = append(fields, name)
+				}
+			}
+			sort.Strings(params)
+			sort.Strings(fields)
+			if !reflect.DeepEqual(params, fields) {
+				t.Logf("%s %s: parameters don't match %s\nspec: %v\n  go: %v", method, p, op.GoType, params, fields)
+				t.Fail()
+			}
+		}
+	}
+}
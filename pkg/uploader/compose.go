@@ -0,0 +1,226 @@
+package uploader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/gostones/s3upload/internal"
+	"github.com/gostones/s3upload/internal/logging"
+	"github.com/gostones/s3upload/internal/types"
+)
+
+// S3 limits of a multipart upload.
+const (
+	maxParts    = 10000
+	minPartSize = 5 << 20
+	maxPartSize = 5 << 30
+)
+
+// ComposePart is a part of a composed object, either a range of an object
+// of the bucket copied by the storage or a range of a local file uploaded.
+// All parts but the last must be at least 5 MiB, the size of a whole
+// source is described by the server that must allow its download.
+type ComposePart struct {
+	// Source is the key of the object copied, the data is not downloaded.
+	Source string
+	// Offset and Length are the range of the source copied, the whole
+	// object if Length is negative as for a Range. A part is at most 5 GiB.
+	Offset int64
+	Length int64
+	// SourceSSECustomerKey is the customer key of the source if it is
+	// encrypted with one, the same for all the sources.
+	SourceSSECustomerKey []byte
+
+	// File is the local range uploaded if Source is empty, 1 byte to 5 GiB.
+	File *Range
+}
+
+// Compose creates the object key from the parts in order, e.g. to stitch
+// segments into a file. The local parts are uploaded first, then the server
+// copies the sources and completes the upload. The upload is aborted if a
+// part fails, it can't be resumed. The progress is of the bytes of the
+// local parts. Client side encryption and compression are not supported.
+func (r *Uploader) Compose(ctx context.Context, key string, parts ...ComposePart) (*Result, error) {
+	if r.opts.EncryptionKey != nil || r.opts.Compression != "" {
+		return nil, errors.New("compose doesn't support client side encryption and compression")
+	}
+	if len(parts) == 0 || len(parts) > maxParts {
+		return nil, fmt.Errorf("compose needs 1 to %v parts", maxParts)
+	}
+	if n := len(r.opts.SSECustomerKey); n != 0 && n != 32 {
+		return nil, errors.New("customer key must be 256-bit")
+	}
+
+	// the local ranges are opened up front, before starting the upload
+	cp := &Checkpoint{Key: key, ContentType: r.opts.ContentType}
+	files := make([]*internal.Segments, len(parts))
+	var sourceKey []byte // of all the sources, sent once
+	sources := 0
+	for i, p := range parts {
+		switch {
+		case p.Source != "" && p.File != nil:
+			return nil, fmt.Errorf("part %v: both a source and a file", i+1)
+		case p.Source != "":
+			// the rest of an object can't be copied, the range needs its end
+			if p.Offset < 0 || p.Length == 0 || p.Offset > 0 && p.Length < 0 {
+				return nil, fmt.Errorf("part %v: invalid range %v+%v of %s", i+1, p.Offset, p.Length, p.Source)
+			}
+			if p.Length > maxPartSize {
+				return nil, fmt.Errorf("part %v: %v bytes of %s exceed the maximum part size", i+1, p.Length, p.Source)
+			}
+			if n := len(p.SourceSSECustomerKey); n != 0 && n != 32 {
+				return nil, errors.New("customer key must be 256-bit")
+			}
+			if sources > 0 && !bytes.Equal(p.SourceSSECustomerKey, sourceKey) {
+				return nil, fmt.Errorf("part %v: the sources must have the same customer key", i+1)
+			}
+			sourceKey = p.SourceSSECustomerKey
+			sources++
+		case p.File != nil:
+			ra, closeFn, err := r.openRanges([]Range{*p.File})
+			if err != nil {
+				return nil, err
+			}
+			defer closeFn()
+			if size := ra.Size(); size == 0 || size > maxPartSize {
+				return nil, fmt.Errorf("part %v: %v bytes of %s, a part is 1 byte to 5 GiB", i+1, size, p.File.Filename)
+			}
+			files[i] = ra
+			cp.Size += ra.Size()
+			if cp.ContentType == "" {
+				cp.ContentType, _ = internal.ContentType(io.NewSectionReader(ra, 0, ra.Size()))
+			}
+		default:
+			return nil, fmt.Errorf("part %v: no source or file", i+1)
+		}
+	}
+
+	requestID := r.opts.RequestID
+	if requestID == "" {
+		requestID = logging.NewRequestID()
+	}
+	ctx = logging.WithRequestID(ctx, requestID)
+
+	// the sizes are checked before starting the upload
+	for i, p := range parts {
+		size := p.Length
+		switch {
+		case files[i] != nil:
+			size = files[i].Size()
+		case p.Length < 0:
+			info, err := r.getDownloadURL(ctx, i+1, p.Source, "", "", p.SourceSSECustomerKey)
+			if err != nil {
+				return nil, err
+			}
+			size = info.Size
+			if size == 0 || size > maxPartSize {
+				return nil, fmt.Errorf("part %v: %v bytes of %s, a part is 1 byte to 5 GiB", i+1, size, p.Source)
+			}
+		}
+		if size < minPartSize && i < len(parts)-1 {
+			return nil, fmt.Errorf("part %v: %v bytes, all parts but the last must be at least 5 MiB", i+1, size)
+		}
+	}
+
+	req := &types.ComposeUploadRequest{
+		Params: *r.startUploadRequest(cp, 0, nil),
+		Parts:  make([]types.ComposeUploadPart, len(parts)),
+	}
+	for i, p := range parts {
+		if p.Source != "" {
+			req.Parts[i] = types.ComposeUploadPart{Source: p.Source}
+			if p.Length > 0 {
+				req.Parts[i].Range = fmt.Sprintf("bytes=%v-%v", p.Offset, p.Offset+p.Length-1)
+			}
+		}
+	}
+	if cp.Size == 0 {
+		// the server starts the upload and aborts it on a failure
+		result, err := r.composeUpload(ctx, req, sourceKey)
+		if err != nil {
+			return nil, err
+		}
+		result.RequestID = requestID
+		return result, nil
+	}
+
+	// the size of the object is not known up front
+	uploadID, err := r.startUpload(ctx, &req.Params)
+	if err != nil {
+		return nil, err
+	}
+	cp.UploadID = uploadID
+	r.logf("request id: %v upload id: %v", requestID, cp.UploadID)
+
+	var sent int64 // of the local parts completed
+	for i := range parts {
+		ra := files[i]
+		if ra == nil {
+			continue
+		}
+		partNo := i + 1
+		fc := internal.NewReaderChunk(ra, ra.Size(), key, ra.Size())
+		if r.opts.Limiter != nil {
+			fc.SetLimiter(r.opts.Limiter)
+		}
+		base := sent
+		fn := func(_ int, reader *internal.ChunkReader) error {
+			// the part may be too large to buffer, it is read twice
+			sum, err := reader.Checksum(r.partAlgorithms()...)
+			if err != nil {
+				return &Error{Op: OpPresign, PartNumber: partNo, Err: err}
+			}
+			part, err := r.uploadPart(ctx, cp, partNo, reader, sum, func() int64 { return base + fc.Count() })
+			if err != nil {
+				return err
+			}
+			req.Parts[i] = types.ComposeUploadPart{ETag: part.ETag, Checksum: part.Checksum}
+			return nil
+		}
+		if err := firstError(fc.MapContext(ctx, fn)); err != nil {
+			r.abort(ctx, cp)
+			return nil, err
+		}
+		sent += ra.Size()
+	}
+
+	req.UploadID = cp.UploadID
+	result, err := r.composeUpload(ctx, req, sourceKey)
+	if err != nil {
+		r.abort(ctx, cp)
+		return nil, err
+	}
+	result.RequestID = requestID
+	return result, nil
+}
+
+// composeUpload calls the server to copy the sources and complete the
+// upload, sourceKey is the customer key of the sources.
+func (r *Uploader) composeUpload(ctx context.Context, req *types.ComposeUploadRequest, sourceKey []byte) (*Result, error) {
+	headers := customerKeyHeaders(r.sseHeaders(), sourceKey,
+		types.HeaderCopySourceSSECustomerAlgorithm, types.HeaderCopySourceSSECustomerKey, types.HeaderCopySourceSSECustomerKeyMD5)
+
+	var composeResp types.CompleteUploadResponse
+	resp, err := r.c.R().
+		SetContext(ctx).
+		SetBody(req).
+		SetHeader("Accept", "application/json").
+		SetHeaders(headers).
+		SetResult(&composeResp).
+		Post(types.PathComposeUpload)
+	if err := checkResponse(OpCompose, 0, resp, err); err != nil {
+		return nil, err
+	}
+	r.logf("composed: %v parts: %v", req.Params.FileName, len(req.Parts))
+
+	d := composeResp.Data
+	return &Result{
+		Location: d.Location,
+		Bucket:   d.Bucket,
+		Key:      d.Key,
+		ETag:     d.ETag,
+	}, nil
+}
@@ -0,0 +1,63 @@
+package uploader
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+
+	"github.com/gostones/s3upload/internal"
+	"github.com/klauspost/compress/zstd"
+)
+
+// Compression methods of Options.Compression, set as Content-Encoding of the object.
+const (
+	CompressGzip = "gzip"
+	CompressZstd = "zstd"
+)
+
+// Metadata keys of the original file of a compressed object.
+const (
+	OriginalSizeMetaKey   = "s3upload-original-size"
+	OriginalSHA256MetaKey = "s3upload-original-sha256"
+)
+
+// compress returns a reader of the content of r compressed with the method.
+// Closing the reader stops the compression.
+func compress(r io.Reader, method string) (io.ReadCloser, error) {
+	pr, pw := io.Pipe()
+	var w io.WriteCloser
+	switch method {
+	case CompressGzip:
+		w = gzip.NewWriter(pw)
+	case CompressZstd:
+		// a single goroutine keeps the output deterministic so a resumed
+		// upload compresses the parts already uploaded the same
+		zw, err := zstd.NewWriter(pw, zstd.WithEncoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		w = zw
+	default:
+		return nil, fmt.Errorf("unsupported compression: %q", method)
+	}
+	go func() {
+		_, err := io.Copy(w, r)
+		if cerr := w.Close(); err == nil {
+			err = cerr
+		}
+		pw.CloseWithError(err)
+	}()
+	return pr, nil
+}
+
+// countingReader counts the bytes read.
+type countingReader struct {
+	r     io.Reader
+	count internal.Counter
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	r.count.Increment(int64(n))
+	return n, err
+}
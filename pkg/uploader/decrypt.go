@@ -0,0 +1,49 @@
+package uploader
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+
+	"github.com/gostones/s3upload/internal"
+)
+
+// ErrNotEncrypted is returned by DownloadDecrypted for an object without
+// the envelope of the client side encryption.
+var ErrNotEncrypted = errors.New("object is not encrypted by the client")
+
+// DownloadDecrypted downloads the object encrypted with Options.EncryptionKey
+// from url, e.g. a presigned GET url, and writes its plain text to w.
+// Nothing is written past a frame failing authentication.
+func (r *Uploader) DownloadDecrypted(ctx context.Context, url string, w io.Writer) error {
+	if r.opts.EncryptionKey == nil {
+		return errors.New("no encryption key")
+	}
+	req, err := http.NewRequest("GET", url, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := r.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}
+	}
+
+	v := resp.Header.Get("X-Amz-Meta-" + EnvelopeMetaKey)
+	if v == "" {
+		return ErrNotEncrypted
+	}
+	e, err := internal.DecodeEnvelope(v)
+	if err != nil {
+		return err
+	}
+	c, err := e.Open(r.opts.EncryptionKey)
+	if err != nil {
+		return err
+	}
+	return c.Decrypt(w, resp.Body)
+}
@@ -0,0 +1,442 @@
+package uploader
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gostones/s3upload/internal"
+	"github.com/gostones/s3upload/internal/logging"
+	"github.com/gostones/s3upload/internal/types"
+)
+
+// DefaultDownloadWorkers is the number of ranges downloaded concurrently.
+const DefaultDownloadWorkers = 4
+
+// JournalSuffix is appended to the name of the file downloaded for the
+// name of its journal.
+const JournalSuffix = ".journal"
+
+// retryDelay is the delay before the first retry of a range, doubled after each.
+const retryDelay = 500 * time.Millisecond
+
+// DownloadJournal records the ranges of a download written to the file, so
+// an interrupted download fetches the missing ranges only. It is removed
+// once the download completes.
+type DownloadJournal struct {
+	Key       string `json:"key"`
+	Size      int64  `json:"size"`
+	ETag      string `json:"etag"`
+	RangeSize int64  `json:"rangeSize"`
+	Done      []int  `json:"done"` // indexes of the ranges written
+}
+
+// Download downloads the object key into the named file. The file is
+// preallocated and ranges of ChunkSize bytes are fetched with presigned
+// URLs by DownloadWorkers goroutines, each retried up to DownloadRetries
+// times, and written in place. The download resumes from the journal of
+// the file if its object didn't change and the file has its size. The
+// content is verified afterwards against the ETag, the S3 checksums and the
+// digests in the metadata. Composite ones, of multipart uploads, are
+// verified if the server returns the part size of the object.
+func (r *Uploader) Download(ctx context.Context, key, filename string) (*Result, error) {
+	if n := len(r.opts.SSECustomerKey); n != 0 && n != 32 {
+		return nil, fmt.Errorf("customer key must be 256-bit")
+	}
+	requestID := r.opts.RequestID
+	if requestID == "" {
+		requestID = logging.NewRequestID()
+	}
+	ctx = logging.WithRequestID(ctx, requestID)
+
+	info, err := r.getDownloadURL(ctx, 0, key, "", "", r.opts.SSECustomerKey)
+	if err != nil {
+		return nil, err
+	}
+	journal := &DownloadJournal{
+		Key:       key,
+		Size:      info.Size,
+		ETag:      info.ETag,
+		RangeSize: r.opts.ChunkSize,
+	}
+	journalFile := filename + JournalSuffix
+	resumed := false
+	if j, err := loadJournal(journalFile); err != nil {
+		return nil, err
+	} else if j != nil && j.Key == key && j.Size == info.Size && j.ETag == info.ETag && j.RangeSize == r.opts.ChunkSize {
+		// the ranges done are not in a file deleted or replaced since
+		if fi, err := os.Stat(filename); err == nil && fi.Size() == info.Size {
+			journal, resumed = j, true
+		}
+	}
+
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE, 0666)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	if !resumed {
+		if err := f.Truncate(0); err != nil {
+			return nil, err
+		}
+	}
+	if err := f.Truncate(info.Size); err != nil {
+		return nil, err
+	}
+	if err := saveJournal(journalFile, journal); err != nil {
+		return nil, err
+	}
+	r.logf("request id: %v download: %v size: %v resumed ranges: %v", requestID, key, info.Size, len(journal.Done))
+
+	if err := r.downloadRanges(ctx, f, journal, journalFile); err != nil {
+		return nil, err
+	}
+	if err := f.Sync(); err != nil {
+		return nil, err
+	}
+	// the ranges are written, a mismatch is not fixed by resuming
+	os.Remove(journalFile)
+	if err := r.verify(f, key, info); err != nil {
+		return nil, err
+	}
+	return &Result{
+		Key:       key,
+		ETag:      info.ETag,
+		RequestID: requestID,
+	}, nil
+}
+
+// downloadRanges fetches the ranges missing in the journal into f,
+// recording them in the journal as written.
+func (r *Uploader) downloadRanges(ctx context.Context, f *os.File, journal *DownloadJournal, journalFile string) error {
+	size, rangeSize := journal.Size, journal.RangeSize
+	done := make(map[int]bool)
+	for _, i := range journal.Done {
+		done[i] = true
+	}
+	var todo []int
+	for i := 0; int64(i)*rangeSize < size; i++ {
+		if !done[i] {
+			todo = append(todo, i)
+		}
+	}
+	workers := r.opts.DownloadWorkers
+	if workers <= 0 {
+		workers = DefaultDownloadWorkers
+	}
+	if workers > len(todo) {
+		workers = len(todo)
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		mu       sync.Mutex
+		firstErr error
+		sent     internal.Counter
+		wg       sync.WaitGroup
+	)
+	sent.Increment(int64(len(journal.Done)) * rangeSize)
+	next := make(chan int)
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range next {
+				off := int64(i) * rangeSize
+				n := rangeSize
+				if off+n > size {
+					n = size - off
+				}
+				err := r.downloadRange(ctx, f, journal, i, off, n, &sent)
+				mu.Lock()
+				// the range is on disk before the journal records it
+				if err == nil {
+					err = f.Sync()
+				}
+				if err == nil {
+					journal.Done = append(journal.Done, i)
+					err = saveJournal(journalFile, journal)
+				}
+				if err != nil && firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}()
+	}
+	for _, i := range todo {
+		select {
+		case next <- i:
+		case <-ctx.Done():
+		}
+	}
+	close(next)
+	wg.Wait()
+	if firstErr == nil {
+		firstErr = ctx.Err()
+	}
+	return firstErr
+}
+
+// downloadRange fetches n bytes of the object at off into f, retrying
+// with a new presigned URL unless the object changed.
+func (r *Uploader) downloadRange(ctx context.Context, f *os.File, journal *DownloadJournal, i int, off, n int64, sent *internal.Counter) error {
+	delay := retryDelay
+	for attempt := 0; ; attempt++ {
+		written, err := r.getRange(ctx, f, journal, i, off, n, sent)
+		if err == nil {
+			return nil
+		}
+		sent.Decrement(written)
+		if attempt >= r.opts.DownloadRetries || ctx.Err() != nil || !retryable(err) {
+			return err
+		}
+		r.logf("range: %v attempt: %v error: %v", i, attempt+1, err)
+		t := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			t.Stop()
+			return ctx.Err()
+		case <-t.C:
+		}
+		delay *= 2
+	}
+}
+
+// getRange GETs the range with a presigned URL and writes it at its offset
+// in f. It returns the bytes written.
+func (r *Uploader) getRange(ctx context.Context, f *os.File, journal *DownloadJournal, i int, off, n int64, sent *internal.Counter) (int64, error) {
+	rng := fmt.Sprintf("bytes=%v-%v", off, off+n-1)
+	u, err := r.getDownloadURL(ctx, i+1, journal.Key, rng, journal.ETag, r.opts.SSECustomerKey)
+	if err != nil {
+		return 0, err
+	}
+	req, err := http.NewRequest("GET", u.PresignedURL, nil)
+	if err != nil {
+		return 0, &Error{Op: OpGet, PartNumber: i + 1, Err: err}
+	}
+	for k, v := range u.Headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := r.hc.Do(req.WithContext(ctx))
+	if err != nil {
+		return 0, &Error{Op: OpGet, PartNumber: i + 1, Err: err}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusPartialContent {
+		return 0, &Error{Op: OpGet, PartNumber: i + 1, Err: &StatusError{StatusCode: resp.StatusCode, Status: resp.Status}}
+	}
+
+	var body io.Reader = resp.Body
+	if r.opts.Limiter != nil {
+		body = &limitedReader{ctx: ctx, r: body, l: r.opts.Limiter}
+	}
+	w := &offsetWriter{f: f, off: off, fn: func(m int) {
+		total := sent.Increment(int64(m))
+		if r.opts.Progress != nil {
+			r.opts.Progress(total, journal.Size)
+		}
+	}}
+	written, err := io.CopyN(w, body, n)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return written, &Error{Op: OpGet, PartNumber: i + 1, Err: err}
+	}
+	return written, nil
+}
+
+// getDownloadURL presigns the GET of the range of the object bound to the
+// ETag, of the whole object described if rng is empty. customerKey is the
+// SSE-C key of the object.
+func (r *Uploader) getDownloadURL(ctx context.Context, partNo int, key, rng, etag string, customerKey []byte) (*types.GetDownloadURLResponse, error) {
+	var result types.GetDownloadURLResponse
+	resp, err := r.c.R().
+		SetContext(ctx).
+		SetQueryParams(map[string]string{
+			"fileName": key,
+			"range":    rng,
+			"ifMatch":  etag,
+		}).
+		SetHeader("Accept", "application/json").
+		SetHeaders(customerKeyHeaders(nil, customerKey, types.HeaderSSECustomerAlgorithm, types.HeaderSSECustomerKey, types.HeaderSSECustomerKeyMD5)).
+		SetResult(&result).
+		Get(types.PathGetDownloadURL)
+	if err := checkResponse(OpDownloadURL, partNo, resp, err); err != nil {
+		return nil, err
+	}
+	return &result, nil
+}
+
+// retryable reports whether the range may be fetched on retry: not if the
+// object is missing or changed since the download started.
+func retryable(err error) bool {
+	e, ok := err.(*Error)
+	if !ok {
+		return true
+	}
+	se, ok := e.Err.(*StatusError)
+	if !ok {
+		return true
+	}
+	switch se.StatusCode {
+	case http.StatusBadRequest, http.StatusNotFound, http.StatusPreconditionFailed:
+		return false
+	}
+	return true
+}
+
+// expectedDigest is a digest of the object to verify the download against.
+type expectedDigest struct {
+	name   string // e.g. ETag or metadata key
+	alg    string
+	value  string
+	encode func([]byte) string
+}
+
+// verify checks the content of f against the ETag, the S3 checksums and the
+// digests in the metadata of the object.
+func (r *Uploader) verify(f *os.File, key string, info *types.GetDownloadURLResponse) error {
+	var expected []expectedDigest
+	// the ETag of an encrypted object is not its MD5
+	if etag := strings.Trim(info.ETag, `"`); etag != "" && info.ServerSideEncryption != "aws:kms" && len(r.opts.SSECustomerKey) == 0 {
+		expected = append(expected, expectedDigest{"ETag", internal.ChecksumMD5, etag, hex.EncodeToString})
+	}
+	for alg, v := range info.Checksums {
+		expected = append(expected, expectedDigest{"checksum " + alg, alg, v, base64.StdEncoding.EncodeToString})
+	}
+	// the digests of compressed and encrypted objects are of the original file
+	if info.Metadata[OriginalSizeMetaKey] == "" && info.Metadata[EnvelopeMetaKey] == "" {
+		for _, alg := range []string{internal.ChecksumMD5, internal.ChecksumSHA256, internal.ChecksumSHA1, internal.ChecksumCRC32, internal.ChecksumCRC32C} {
+			if v := info.Metadata[DigestMetaKey(alg)]; v != "" {
+				expected = append(expected, expectedDigest{DigestMetaKey(alg), alg, v, hex.EncodeToString})
+			}
+		}
+	}
+	if len(expected) == 0 {
+		return nil
+	}
+	var algs []string
+	for _, e := range expected {
+		algs = algorithms(algs, []string{e.alg})
+	}
+
+	// hashed by part if the sizes of the parts of the object are known
+	sizes := info.PartSizes
+	var total int64
+	for _, n := range sizes {
+		total += n
+	}
+	if total != info.Size {
+		sizes = []int64{info.Size}
+	}
+	sum, chunks, err := internal.ChecksumParts(f, sizes, algs...)
+	if err != nil {
+		return err
+	}
+	for _, e := range expected {
+		value, parts := splitParts(e.value)
+		var actual []byte
+		switch {
+		case parts == 0:
+			actual = sum.Sum(e.alg)
+		case parts == len(info.PartSizes) && total == info.Size:
+			// the digest of the digests of the parts
+			h, _ := internal.NewHash(e.alg)
+			for _, c := range chunks {
+				h.Write(c.Sum(e.alg))
+			}
+			actual = h.Sum(nil)
+		default:
+			r.logf("%s of %v parts not verified, the sizes of the parts are unknown", e.name, parts)
+			continue
+		}
+		if a := e.encode(actual); a != value {
+			return &DigestMismatchError{Digest: e.name, Expected: e.value, Actual: a}
+		}
+	}
+	return nil
+}
+
+// splitParts splits the number of parts off a composite digest, 0 if not composite.
+func splitParts(v string) (string, int) {
+	i := strings.LastIndex(v, "-")
+	if i < 0 {
+		return v, 0
+	}
+	n, err := strconv.Atoi(v[i+1:])
+	if err != nil {
+		return v, 0
+	}
+	return v[:i], n
+}
+
+func loadJournal(filename string) (*DownloadJournal, error) {
+	b, err := ioutil.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var j DownloadJournal
+	if err := json.Unmarshal(b, &j); err != nil {
+		return nil, fmt.Errorf("invalid journal %s: %v", filename, err)
+	}
+	return &j, nil
+}
+
+// saveJournal replaces the journal file, not leaving it half written.
+func saveJournal(filename string, j *DownloadJournal) error {
+	b, err := json.Marshal(j)
+	if err != nil {
+		return err
+	}
+	tmp := filename + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0666); err != nil {
+		return err
+	}
+	return os.Rename(tmp, filename)
+}
+
+// offsetWriter writes sequentially to the file from off.
+type offsetWriter struct {
+	f   *os.File
+	off int64
+	fn  func(n int) // called with the bytes of each write
+}
+
+func (w *offsetWriter) Write(p []byte) (int, error) {
+	n, err := w.f.WriteAt(p, w.off)
+	w.off += int64(n)
+	w.fn(n)
+	return n, err
+}
+
+// limitedReader throttles the reads with the limiter.
+type limitedReader struct {
+	ctx context.Context
+	r   io.Reader
+	l   *RateLimiter
+}
+
+func (r *limitedReader) Read(p []byte) (int, error) {
+	n, err := r.l.WaitContext(r.ctx, len(p))
+	if err != nil {
+		return 0, err
+	}
+	return r.r.Read(p[:n])
+}
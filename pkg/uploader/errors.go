@@ -0,0 +1,142 @@
+package uploader
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/gostones/s3upload/internal/types"
+)
+
+// Op names the step of the upload that failed.
+type Op string
+
+const (
+	OpStart    Op = "start-upload"
+	OpPresign  Op = "get-upload-url"
+	OpPut      Op = "put-part"
+	OpCopy     Op = "copy-upload-part"
+	OpComplete Op = "complete-upload"
+	OpAbort    Op = "abort-upload"
+	OpCompose  Op = "compose-upload"
+
+	OpDownloadURL Op = "get-download-url"
+	OpGet         Op = "get-range"
+)
+
+// ErrCheckpointMismatch is returned by Resume when the checkpoint doesn't match the content.
+var ErrCheckpointMismatch = errors.New("checkpoint does not match the upload")
+
+// CanceledError is returned by Upload when the context is done before the upload completes.
+type CanceledError struct {
+	// Checkpoint to resume the upload, nil if the upload was not started or was aborted.
+	Checkpoint *Checkpoint
+	// Aborted reports whether the upload was aborted on the server.
+	Aborted bool
+	// Err is the context error.
+	Err error
+}
+
+func (e *CanceledError) Error() string {
+	return fmt.Sprintf("upload canceled: %v", e.Err)
+}
+
+// Unwrap returns the context error.
+func (e *CanceledError) Unwrap() error {
+	return e.Err
+}
+
+// IsCanceled reports whether err is a *CanceledError.
+func IsCanceled(err error) bool {
+	_, ok := err.(*CanceledError)
+	return ok
+}
+
+// Error is returned by Upload when a step fails.
+type Error struct {
+	Op         Op
+	PartNumber int // 0 if the step is not specific to a part
+	Err        error
+}
+
+func (e *Error) Error() string {
+	if e.PartNumber > 0 {
+		return fmt.Sprintf("%s part %d: %v", e.Op, e.PartNumber, e.Err)
+	}
+	return fmt.Sprintf("%s: %v", e.Op, e.Err)
+}
+
+// Unwrap returns the underlying error.
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// DigestMismatchError is returned by Download when the file doesn't match
+// a digest of the object.
+type DigestMismatchError struct {
+	Digest   string // ETag, checksum <algorithm> or the metadata key
+	Expected string
+	Actual   string
+}
+
+func (e *DigestMismatchError) Error() string {
+	return fmt.Sprintf("%s mismatch: expected %s, got %s", e.Digest, e.Expected, e.Actual)
+}
+
+// StatusError is the underlying error of an Error when the server or the
+// storage responds with an unexpected HTTP status.
+type StatusError struct {
+	StatusCode int
+	Status     string
+	Code       string // error code of the server, e.g. NoSuchUpload
+	Body       string // error message or the response body
+}
+
+func (e *StatusError) Error() string {
+	if e.Body == "" {
+		return e.Status
+	}
+	if e.Code != "" {
+		return fmt.Sprintf("%s: %s: %s", e.Status, e.Code, e.Body)
+	}
+	return fmt.Sprintf("%s: %s", e.Status, e.Body)
+}
+
+// Temporary reports whether the request may succeed if retried later.
+func (e *StatusError) Temporary() bool {
+	return e.StatusCode >= 500 || e.StatusCode == http.StatusTooManyRequests
+}
+
+// checkResponse wraps the error of a server API call or a non 200 status in an Error.
+func checkResponse(op Op, partNo int, resp *resty.Response, err error) error {
+	if err != nil {
+		return &Error{Op: op, PartNumber: partNo, Err: err}
+	}
+	if resp.StatusCode() != http.StatusOK {
+		se := &StatusError{
+			StatusCode: resp.StatusCode(),
+			Status:     resp.Status(),
+			Body:       strings.TrimSpace(resp.String()),
+		}
+		var er types.ErrorResponse
+		if json.Unmarshal(resp.Body(), &er) == nil && er.Error.Code != "" {
+			se.Code = er.Error.Code
+			se.Body = er.Error.Message
+		}
+		return &Error{Op: op, PartNumber: partNo, Err: se}
+	}
+	return nil
+}
+
+// firstError returns the first non nil error.
+func firstError(errs []error) error {
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,946 @@
+// Package uploader uploads files to S3 in parts through presigned URLs
+// issued by the s3upload server.
+package uploader
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-resty/resty/v2"
+	"github.com/gostones/s3upload/internal"
+	"github.com/gostones/s3upload/internal/logging"
+	"github.com/gostones/s3upload/internal/types"
+)
+
+// DefaultChunkSize is the part size used when Options.ChunkSize is not set.
+const DefaultChunkSize int64 = 10000000 // 10MB
+
+// abortTimeout bounds the abort call made after the upload context is done.
+const abortTimeout = 30 * time.Second
+
+// RateLimiter is a token bucket shared by all the parts of an upload.
+type RateLimiter = internal.Limiter
+
+// Schedule is a list of daily time windows overriding the rate of a RateLimiter.
+type Schedule = internal.Schedule
+
+// NewRateLimiter returns a limiter of rate bytes per second, 0 for unlimited.
+func NewRateLimiter(rate int64) *RateLimiter {
+	return internal.NewLimiter(rate)
+}
+
+// ParseSchedule parses windows in the form HH:MM-HH:MM=rate separated by comma.
+func ParseSchedule(s string) (Schedule, error) {
+	return internal.ParseSchedule(s)
+}
+
+// EncryptionKey is the master key of the client side encryption.
+type EncryptionKey = internal.MasterKey
+
+// NewEncryptionKey returns a master key of the 256-bit key.
+func NewEncryptionKey(key []byte) (*EncryptionKey, error) {
+	return internal.NewMasterKey(key)
+}
+
+// PassphraseKey returns a master key derived from the passphrase with scrypt.
+func PassphraseKey(passphrase string) *EncryptionKey {
+	return internal.PassphraseKey(passphrase)
+}
+
+// EnvelopeMetaKey is the metadata key of the encryption envelope of the
+// objects encrypted by the client, it must be allowed by the server policy.
+const EnvelopeMetaKey = "s3upload-envelope"
+
+// FileState identifies the content of a source file by its size,
+// modification time and inode.
+type FileState = internal.FileState
+
+// SourceModifiedError is returned by Upload when the source file is
+// modified or replaced while uploading. The upload is aborted.
+type SourceModifiedError = internal.ModifiedError
+
+// Read modes of Options.ReadMode.
+const (
+	ReadModeReadAt    = internal.ReadModeReadAt
+	ReadModeMmap      = internal.ReadModeMmap
+	ReadModeReadahead = internal.ReadModeReadahead
+)
+
+// Options configures an Uploader.
+type Options struct {
+	// BaseURL is the url of the upload server, e.g. http://localhost:4000
+	BaseURL string
+
+	// ChunkSize is the size of each part in bytes.
+	ChunkSize int64
+
+	// ContentType of the object, sniffed from the content if empty.
+	ContentType string
+
+	// Object headers, subject to the policy of the server.
+	CacheControl       string
+	ContentDisposition string
+	ContentEncoding    string
+	StorageClass       string
+
+	// Metadata is stored as x-amz-meta-* headers of the object.
+	Metadata map[string]string
+
+	// Tags of the object.
+	Tags map[string]string
+
+	// ServerSideEncryption is AES256 (SSE-S3) or aws:kms (SSE-KMS), the
+	// server default if empty. The KMS key is chosen by the server.
+	ServerSideEncryption string
+
+	// SSECustomerKey is the 256-bit key to encrypt the object with (SSE-C).
+	// S3 doesn't keep the key, the same key is required to read the object.
+	SSECustomerKey []byte
+
+	// EncryptionKey encrypts the parts on the client with AES-GCM if not nil.
+	// The object is stored as application/octet-stream with the encryption
+	// envelope in its metadata and is read back with DownloadDecrypted.
+	EncryptionKey *EncryptionKey
+
+	// Compression compresses the content with gzip or zstd before chunking
+	// and sets the Content-Encoding of the object. The original size and
+	// SHA-256 are stored in the metadata. Not supported with EncryptionKey.
+	Compression string
+
+	// ChecksumAlgorithm is the S3 checksum of the parts, verified by S3 on
+	// upload: SHA256, SHA1, CRC32 or CRC32C. The parts have a MD5 checksum otherwise.
+	ChecksumAlgorithm string
+
+	// Checksums are the algorithms of the whole-file digests stored hex coded
+	// in the metadata as s3upload-<algorithm>, e.g. s3upload-sha256. The
+	// digests are of the original file, before compression or encryption.
+	Checksums []string
+
+	// DigestWorkers hashes the chunks with that many goroutines for the
+	// Checksums if positive. CRC32 and CRC32C digests are then combined into
+	// the digest of the whole file, the others are composite: the digest of
+	// the digests of the chunks suffixed with -<chunks>, the ETag of a S3
+	// multipart upload for MD5.
+	DigestWorkers int
+
+	// ReadMode sets how a *os.File passed to Upload or Resume, and the files
+	// of UploadRanges, are read: ReadModeMmap maps the file in memory,
+	// ReadModeReadahead reads it in large blocks with readahead hints.
+	// ReadAt with the buffers of the part uploads otherwise. ReadModeMmap
+	// is refused with CheckSourcePerPart or SourceRestarts: a file truncated
+	// while mapped crashes the program with SIGBUS.
+	ReadMode string
+
+	// CheckSourcePerPart checks the source files were not modified after
+	// each part, failing early. They are checked before completing the
+	// upload anyway.
+	CheckSourcePerPart bool
+
+	// SourceRestarts restarts the upload of a modified source file up to
+	// that many times instead of failing with a *SourceModifiedError.
+	SourceRestarts int
+
+	// HTTPClient is used for both the server API and the presigned part uploads.
+	// http.DefaultClient is used if nil.
+	HTTPClient *http.Client
+
+	// Limiter throttles the part uploads and the range downloads if not nil.
+	Limiter *RateLimiter
+
+	// DownloadWorkers is the number of ranges of ChunkSize bytes Download
+	// fetches concurrently, DefaultDownloadWorkers if 0.
+	DownloadWorkers int
+
+	// DownloadRetries is the number of retries of a failed range of Download.
+	DownloadRetries int
+
+	// AbortOnCancel aborts the multipart upload on the server when ctx is done,
+	// discarding the uploaded parts. Otherwise the upload can be resumed from
+	// the checkpoint of the CanceledError.
+	AbortOnCancel bool
+
+	// Progress is called with the bytes sent so far and the total size.
+	Progress func(sent, total int64)
+
+	// User identifies the uploader in the audit trail of the server.
+	User string
+
+	// RequestID correlates the server logs of the upload, generated if empty.
+	RequestID string
+
+	// Logf receives debug messages if not nil. Presigned URLs are redacted.
+	Logf func(format string, args ...interface{})
+}
+
+// Checkpoint records the progress of an upload so it can be resumed.
+type Checkpoint struct {
+	Key         string                     `json:"key"`
+	Size        int64                      `json:"size"`
+	ChunkSize   int64                      `json:"chunkSize"`
+	ContentType string                     `json:"contentType"`
+	UploadID    string                     `json:"uploadId"`
+	Parts       []types.CompleteUploadPart `json:"parts"`              // completed parts
+	Envelope    string                     `json:"envelope,omitempty"` // client side encryption
+	Sources     []*FileState               `json:"sources,omitempty"`  // of the source files when started
+}
+
+// Result describes the uploaded object.
+type Result struct {
+	Location  string
+	Bucket    string
+	Key       string
+	ETag      string
+	RequestID string
+}
+
+// Uploader uploads objects with the multipart upload protocol of the server.
+type Uploader struct {
+	opts Options
+	c    *resty.Client
+	hc   *http.Client
+}
+
+// New returns an Uploader configured by opts.
+func New(opts Options) *Uploader {
+	if opts.ChunkSize <= 0 {
+		opts.ChunkSize = DefaultChunkSize
+	}
+	hc := opts.HTTPClient
+	if hc == nil {
+		hc = http.DefaultClient
+	}
+	c := resty.NewWithClient(hc).SetHostURL(opts.BaseURL)
+	c.OnBeforeRequest(func(c *resty.Client, req *resty.Request) error {
+		if id := logging.RequestID(req.Context()); id != "" {
+			req.SetHeader(types.HeaderRequestID, id)
+		}
+		if opts.User != "" {
+			req.SetHeader(types.HeaderUser, opts.User)
+		}
+		return nil
+	})
+	return &Uploader{
+		opts: opts,
+		c:    c,
+		hc:   hc,
+	}
+}
+
+// UploadFile uploads the named file. The key defaults to the base name of the file.
+func (r *Uploader) UploadFile(ctx context.Context, filename, key string) (*Result, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if key == "" {
+		key = filepath.Base(filename)
+	}
+	return r.Upload(ctx, f, fi.Size(), key)
+}
+
+// Upload uploads size bytes read from ra as the object key.
+// If ctx is done before the upload completes, the returned error is a *CanceledError.
+func (r *Uploader) Upload(ctx context.Context, ra io.ReaderAt, size int64, key string) (*Result, error) {
+	return r.upload(ctx, ra, &Checkpoint{
+		Key:       key,
+		Size:      size,
+		ChunkSize: r.opts.ChunkSize,
+	})
+}
+
+// Range is Length bytes of the named file at Offset, the rest of the file
+// if Length is negative.
+type Range struct {
+	Filename string
+	Offset   int64
+	Length   int64
+}
+
+// UploadRanges uploads the concatenation of the ranges of files as the
+// object key, e.g. segments of a disk image, without copying them first.
+func (r *Uploader) UploadRanges(ctx context.Context, key string, ranges ...Range) (*Result, error) {
+	ra, closeFn, err := r.openRanges(ranges)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFn()
+	return r.Upload(ctx, ra, ra.Size(), key)
+}
+
+// ResumeRanges continues the upload of ranges recorded in the checkpoint of
+// a canceled upload.
+func (r *Uploader) ResumeRanges(ctx context.Context, cp *Checkpoint, ranges ...Range) (*Result, error) {
+	ra, closeFn, err := r.openRanges(ranges)
+	if err != nil {
+		return nil, err
+	}
+	defer closeFn()
+	return r.Resume(ctx, ra, ra.Size(), cp)
+}
+
+// openRanges opens the files of the ranges, once each, with the read mode
+// and returns the reader of their concatenation and a function closing them.
+func (r *Uploader) openRanges(ranges []Range) (*internal.Segments, func(), error) {
+	if err := r.checkReadMode(); err != nil {
+		return nil, nil, err
+	}
+	var closers []io.Closer
+	closeFn := func() {
+		for i := len(closers) - 1; i >= 0; i-- {
+			closers[i].Close()
+		}
+	}
+	readers := make(map[string]*internal.FileReader)
+	var segs []internal.Segment
+	for _, rg := range ranges {
+		fr, ok := readers[rg.Filename]
+		if !ok {
+			f, err := os.Open(rg.Filename)
+			if err != nil {
+				closeFn()
+				return nil, nil, err
+			}
+			closers = append(closers, f)
+			if fr, err = internal.NewFileReader(f, r.opts.ReadMode); err != nil {
+				closeFn()
+				return nil, nil, err
+			}
+			closers = append(closers, fr)
+			readers[rg.Filename] = fr
+		}
+		v, err := fr.Range(rg.Offset, rg.Length)
+		if err != nil {
+			closeFn()
+			return nil, nil, err
+		}
+		segs = append(segs, internal.Segment{ReaderAt: v, Length: v.Size()})
+	}
+	if len(segs) == 0 {
+		return nil, nil, errors.New("no range to upload")
+	}
+	return internal.NewSegments(segs...), closeFn, nil
+}
+
+// checkReadMode refuses to map the files when they are expected to change,
+// reading the mapping of a truncated file faults with SIGBUS.
+func (r *Uploader) checkReadMode() error {
+	if r.opts.ReadMode == ReadModeMmap && (r.opts.CheckSourcePerPart || r.opts.SourceRestarts > 0) {
+		return errors.New("mmap read mode is unsafe with CheckSourcePerPart or SourceRestarts")
+	}
+	return nil
+}
+
+// Resume continues the upload recorded in the checkpoint of a canceled upload,
+// skipping the parts already uploaded. ra must have the same content.
+func (r *Uploader) Resume(ctx context.Context, ra io.ReaderAt, size int64, cp *Checkpoint) (*Result, error) {
+	if cp.Size != size || cp.ChunkSize <= 0 || cp.UploadID == "" {
+		return nil, ErrCheckpointMismatch
+	}
+	return r.upload(ctx, ra, cp)
+}
+
+// upload uploads the content of ra, restarting from the beginning if the
+// source file is modified and restarts are allowed. Ranges of files are
+// not restarted, their lengths may no longer match.
+func (r *Uploader) upload(ctx context.Context, ra io.ReaderAt, cp *Checkpoint) (*Result, error) {
+	for restarts := 0; ; restarts++ {
+		result, err := r.uploadOnce(ctx, ra, cp)
+		me, ok := err.(*SourceModifiedError)
+		if _, file := ra.(*os.File); !ok || !file || restarts >= r.opts.SourceRestarts {
+			return result, err
+		}
+		r.logf("%v, restarting the upload", me)
+		if me.Replaced {
+			f, err := os.Open(me.Name)
+			if err != nil {
+				return nil, err
+			}
+			defer f.Close()
+			ra = f
+		}
+		fi, err := ra.(*os.File).Stat()
+		if err != nil {
+			return nil, err
+		}
+		cp = &Checkpoint{
+			Key:       cp.Key,
+			Size:      fi.Size(),
+			ChunkSize: cp.ChunkSize,
+		}
+	}
+}
+
+func (r *Uploader) uploadOnce(ctx context.Context, ra io.ReaderAt, cp *Checkpoint) (*Result, error) {
+	// the source files are checked for modifications while uploading
+	var check func() error
+	if files := sourceFiles(ra); len(files) > 0 {
+		if cp.Sources == nil {
+			for _, f := range files {
+				state, err := internal.StatFile(f)
+				if err != nil {
+					return nil, err
+				}
+				cp.Sources = append(cp.Sources, state)
+			}
+			if f, ok := ra.(*os.File); ok && cp.Sources[0].Size != cp.Size {
+				return nil, &SourceModifiedError{Name: f.Name(), Change: fmt.Sprintf("size %v -> %v", cp.Size, cp.Sources[0].Size)}
+			}
+		}
+		if len(cp.Sources) != len(files) {
+			return nil, ErrCheckpointMismatch
+		}
+		check = func() error {
+			for i, f := range files {
+				if err := internal.CheckFile(f, f.Name(), cp.Sources[i]); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err := check(); err != nil {
+			return nil, r.modified(ctx, cp, err)
+		}
+	}
+	if f, ok := ra.(*os.File); ok && r.opts.ReadMode != ReadModeReadAt {
+		if err := r.checkReadMode(); err != nil {
+			return nil, err
+		}
+		fr, err := internal.NewFileReader(f, r.opts.ReadMode)
+		if err != nil {
+			return nil, err
+		}
+		defer fr.Close()
+		ra = fr
+	}
+	if n := len(r.opts.SSECustomerKey); n != 0 && n != 32 {
+		return nil, errors.New("customer key must be 256-bit")
+	}
+	requestID := r.opts.RequestID
+	if requestID == "" {
+		requestID = logging.NewRequestID()
+	}
+	ctx = logging.WithRequestID(ctx, requestID)
+
+	if cp.ContentType == "" {
+		cp.ContentType = r.opts.ContentType
+	}
+	if cp.ContentType == "" {
+		cp.ContentType, _ = internal.ContentType(io.NewSectionReader(ra, 0, cp.Size))
+	}
+
+	var (
+		fc   *internal.FileChunk
+		size = cp.Size // of the object, 0 if unknown
+		meta = make(map[string]string)
+		sent func() int64
+		sums []*internal.Checksum // of the parts if computed up front
+	)
+	switch {
+	case r.opts.Compression != "" && r.opts.EncryptionKey != nil:
+		return nil, errors.New("compression is not supported with client side encryption")
+	case r.opts.Compression != "":
+		// the compressed size is not known up front, the compressed stream
+		// is chunked as read
+		if cp.UploadID == "" {
+			algs := algorithms([]string{internal.ChecksumSHA256}, r.opts.Checksums)
+			sum, err := internal.ChecksumOf(io.NewSectionReader(ra, 0, cp.Size), algs...)
+			if err != nil {
+				return nil, err
+			}
+			meta[OriginalSizeMetaKey] = strconv.FormatInt(cp.Size, 10)
+			meta[OriginalSHA256MetaKey] = sum.Hex(internal.ChecksumSHA256)
+			setDigests(meta, sum, r.opts.Checksums)
+		}
+		src := &countingReader{r: io.NewSectionReader(ra, 0, cp.Size)}
+		zr, err := compress(src, r.opts.Compression)
+		if err != nil {
+			return nil, err
+		}
+		defer zr.Close()
+		fc = internal.NewStreamChunk(zr, cp.Key, cp.ChunkSize)
+		size = 0
+		sent = src.count.Get
+	case r.opts.EncryptionKey != nil:
+		fc = internal.NewReaderChunk(ra, cp.Size, cp.Key, cp.ChunkSize)
+		c, err := r.cipher(cp)
+		if err != nil {
+			return nil, err
+		}
+		if cp.UploadID == "" && len(r.opts.Checksums) > 0 {
+			if _, err := r.digests(fc, meta, nil); err != nil {
+				return nil, err
+			}
+		}
+		fc.SetCipher(c)
+		size = c.ObjectSize()
+		meta[EnvelopeMetaKey] = cp.Envelope
+	default:
+		fc = internal.NewReaderChunk(ra, cp.Size, cp.Key, cp.ChunkSize)
+		if cp.UploadID == "" && len(r.opts.Checksums) > 0 {
+			// the checksums of the parts are computed in the same pass
+			chunks, err := r.digests(fc, meta, r.partAlgorithms())
+			if err != nil {
+				return nil, err
+			}
+			sums = chunks
+		}
+	}
+	if r.opts.Limiter != nil {
+		fc.SetLimiter(r.opts.Limiter)
+	}
+
+	if cp.UploadID == "" {
+		uploadID, err := r.startUpload(ctx, r.startUploadRequest(cp, size, meta))
+		if err != nil {
+			return nil, r.canceled(ctx, nil, err)
+		}
+		cp.UploadID = uploadID
+	}
+	r.logf("request id: %v upload id: %v", requestID, cp.UploadID)
+
+	parts, err := r.uploadParts(ctx, fc, cp, sent, sums, check)
+	if err != nil {
+		return nil, r.modified(ctx, cp, r.canceled(ctx, cp, err))
+	}
+	if check != nil {
+		if err := check(); err != nil {
+			return nil, r.modified(ctx, cp, err)
+		}
+	}
+
+	result, err := r.completeUpload(ctx, cp.Key, cp.UploadID, parts)
+	if err != nil {
+		return nil, r.canceled(ctx, cp, err)
+	}
+	result.RequestID = requestID
+	return result, nil
+}
+
+// canceled turns err into a CanceledError if ctx is done, aborting the
+// upload on the server if configured so.
+func (r *Uploader) canceled(ctx context.Context, cp *Checkpoint, err error) error {
+	if ctx.Err() == nil {
+		return err
+	}
+	ce := &CanceledError{Checkpoint: cp, Err: ctx.Err()}
+	if cp != nil && r.opts.AbortOnCancel && r.abort(ctx, cp) {
+		ce.Aborted = true
+		ce.Checkpoint = nil
+	}
+	return ce
+}
+
+// abort aborts the upload of the checkpoint on the server, ctx may be done.
+// It reports whether the upload was aborted.
+func (r *Uploader) abort(ctx context.Context, cp *Checkpoint) bool {
+	actx, cancel := context.WithTimeout(logging.WithRequestID(context.Background(), logging.RequestID(ctx)), abortTimeout)
+	defer cancel()
+	if err := r.abortUpload(actx, cp.Key, cp.UploadID); err != nil {
+		r.logf("abort upload: %v", err)
+		return false
+	}
+	return true
+}
+
+// sourceFiles returns the files read by ra, once each.
+func sourceFiles(ra io.ReaderAt) []*os.File {
+	switch ra := ra.(type) {
+	case *os.File:
+		return []*os.File{ra}
+	case *internal.FileReader:
+		return []*os.File{ra.File()}
+	case *internal.Segments:
+		var files []*os.File
+		seen := make(map[*os.File]bool)
+		for _, s := range ra.Segments() {
+			for _, f := range sourceFiles(s.ReaderAt) {
+				if !seen[f] {
+					seen[f] = true
+					files = append(files, f)
+				}
+			}
+		}
+		return files
+	}
+	return nil
+}
+
+// modified aborts the upload if err is a *SourceModifiedError, the parts
+// uploaded are of another content.
+func (r *Uploader) modified(ctx context.Context, cp *Checkpoint, err error) error {
+	if _, ok := err.(*SourceModifiedError); !ok || cp.UploadID == "" {
+		return err
+	}
+	r.abort(ctx, cp)
+	return err
+}
+
+// cipher returns the cipher of the envelope of the checkpoint, generating
+// the envelope of a new upload.
+func (r *Uploader) cipher(cp *Checkpoint) (*internal.Cipher, error) {
+	if cp.Envelope != "" {
+		e, err := internal.DecodeEnvelope(cp.Envelope)
+		if err != nil {
+			return nil, err
+		}
+		if e.Size != cp.Size || e.ChunkSize != cp.ChunkSize {
+			return nil, ErrCheckpointMismatch
+		}
+		return e.Open(r.opts.EncryptionKey)
+	}
+	e, c, err := internal.NewEnvelope(r.opts.EncryptionKey, cp.Size, cp.ChunkSize, cp.ContentType)
+	if err != nil {
+		return nil, err
+	}
+	cp.Envelope = e.Encode()
+	cp.ContentType = "application/octet-stream"
+	return c, nil
+}
+
+// partAlgorithms returns the checksum algorithms of the parts.
+func (r *Uploader) partAlgorithms() []string {
+	if r.opts.ChecksumAlgorithm == "" {
+		return []string{internal.ChecksumMD5}
+	}
+	return []string{internal.ChecksumMD5, r.opts.ChecksumAlgorithm}
+}
+
+// algorithms returns the algorithms of the lists without duplicates.
+func algorithms(lists ...[]string) []string {
+	var algs []string
+	seen := make(map[string]bool)
+	for _, list := range lists {
+		for _, alg := range list {
+			if !seen[alg] {
+				seen[alg] = true
+				algs = append(algs, alg)
+			}
+		}
+	}
+	return algs
+}
+
+// DigestMetaKey returns the metadata key of the whole-file digest of the algorithm.
+func DigestMetaKey(alg string) string {
+	return "s3upload-" + strings.ToLower(alg)
+}
+
+// setDigests sets the hex coded digests of the algorithms in the metadata.
+func setDigests(meta map[string]string, sum *internal.Checksum, algs []string) {
+	for _, alg := range algs {
+		meta[DigestMetaKey(alg)] = sum.Hex(alg)
+	}
+}
+
+// digests sets the whole-file digests of the Checksums in the metadata and
+// returns the checksums of the chunks with the part algorithms if computed
+// in the same pass.
+func (r *Uploader) digests(fc *internal.FileChunk, meta map[string]string, partAlgs []string) ([]*internal.Checksum, error) {
+	if r.opts.DigestWorkers > 0 {
+		digests, err := fc.Digest(r.opts.DigestWorkers, r.opts.Checksums...)
+		if err != nil {
+			return nil, err
+		}
+		for _, d := range digests {
+			meta[DigestMetaKey(d.Algorithm)] = d.Hex()
+		}
+		return nil, nil
+	}
+	sum, chunks, err := fc.Checksum(algorithms(partAlgs, r.opts.Checksums)...)
+	if err != nil {
+		return nil, err
+	}
+	setDigests(meta, sum, r.opts.Checksums)
+	if len(partAlgs) == 0 {
+		return nil, nil
+	}
+	return chunks, nil
+}
+
+// startUploadRequest describes the object of size bytes to create with the
+// options and the metadata added by the uploader.
+func (r *Uploader) startUploadRequest(cp *Checkpoint, size int64, meta map[string]string) *types.StartUploadRequest {
+	metadata := r.opts.Metadata
+	if len(meta) > 0 {
+		metadata = make(map[string]string, len(r.opts.Metadata)+len(meta))
+		for k, v := range r.opts.Metadata {
+			metadata[k] = v
+		}
+		for k, v := range meta {
+			metadata[k] = v
+		}
+	}
+	encoding := r.opts.ContentEncoding
+	if r.opts.Compression != "" {
+		encoding = r.opts.Compression
+	}
+	return &types.StartUploadRequest{
+		FileName:             cp.Key,
+		FileType:             cp.ContentType,
+		FileSize:             size,
+		CacheControl:         r.opts.CacheControl,
+		ContentDisposition:   r.opts.ContentDisposition,
+		ContentEncoding:      encoding,
+		StorageClass:         r.opts.StorageClass,
+		Metadata:             metadata,
+		Tags:                 r.opts.Tags,
+		ServerSideEncryption: r.opts.ServerSideEncryption,
+		ChecksumAlgorithm:    r.opts.ChecksumAlgorithm,
+	}
+}
+
+// sseHeaders returns the headers of the customer key, nil if not set.
+func (r *Uploader) sseHeaders() map[string]string {
+	return customerKeyHeaders(nil, r.opts.SSECustomerKey, types.HeaderSSECustomerAlgorithm, types.HeaderSSECustomerKey, types.HeaderSSECustomerKeyMD5)
+}
+
+// customerKeyHeaders adds the algorithm, key and key MD5 headers of a
+// customer key to headers, allocated if nil. Empty keys are not added.
+func customerKeyHeaders(headers map[string]string, key []byte, algorithm, keyHeader, md5Header string) map[string]string {
+	if len(key) == 0 {
+		return headers
+	}
+	if headers == nil {
+		headers = make(map[string]string)
+	}
+	sum := md5.Sum(key)
+	headers[algorithm] = "AES256"
+	headers[keyHeader] = base64.StdEncoding.EncodeToString(key)
+	headers[md5Header] = base64.StdEncoding.EncodeToString(sum[:])
+	return headers
+}
+
+// startUpload obtains an uploadId generated in the backend
+// server by the AWS S3 SDK. This uploadId will be used subsequently for uploading
+// the individual chunks of the file.
+func (r *Uploader) startUpload(ctx context.Context, req *types.StartUploadRequest) (string, error) {
+	var result types.StartUploadResponse
+	resp, err := r.c.R().
+		SetContext(ctx).
+		SetBody(req).
+		SetHeader("Accept", "application/json").
+		SetHeaders(r.sseHeaders()).
+		SetResult(&result).
+		Post(types.PathStartUpload)
+	if err := checkResponse(OpStart, 0, resp, err); err != nil {
+		return "", err
+	}
+	return result.UploadID, nil
+}
+
+// uploadParts splits the content into chunks and for each part not yet in the checkpoint
+// (1) calls the backend server for a presigned url and
+// (2) uploads it.
+// The checkpoint is updated as parts complete. The progress is of the bytes
+// returned by sent if not nil, of the chunks read otherwise. The checksums
+// of the parts are computed as needed if sums is nil.
+func (r *Uploader) uploadParts(ctx context.Context, fc *internal.FileChunk, cp *Checkpoint, sent func() int64, sums []*internal.Checksum, check func() error) ([]types.CompleteUploadPart, error) {
+	// the chunks are mapped in order, the number of chunks of a stream is not known up front
+	var parts []types.CompleteUploadPart
+	done := make(map[int]types.CompleteUploadPart)
+	for _, p := range cp.Parts {
+		done[int(p.PartNumber)] = p
+	}
+	var skipped int64
+	pool := internal.NewBufferPool(cp.ChunkSize)
+
+	fn := func(idx int, reader *internal.ChunkReader) error {
+		partNo := idx + 1
+		if p, ok := done[partNo]; ok && p.ETag != "" {
+			parts = append(parts, p)
+			skipped += reader.Len()
+			return nil
+		}
+
+		// (1) Generate presigned URL for each part
+		// the part is read once into memory, hashed as read, unless hashed up front
+		var sum *internal.Checksum
+		if idx < len(sums) {
+			sum = sums[idx]
+		} else {
+			br, s, err := reader.Buffered(pool, r.partAlgorithms()...)
+			if err != nil {
+				return &Error{Op: OpPresign, PartNumber: partNo, Err: err}
+			}
+			defer br.Release()
+			reader, sum = br, s
+		}
+		progress := sent
+		if progress == nil {
+			base := skipped
+			progress = func() int64 { return base + fc.Count() }
+		}
+		p, err := r.uploadPart(ctx, cp, partNo, reader, sum, progress)
+		if err != nil {
+			return err
+		}
+		parts = append(parts, p)
+		cp.Parts = append(cp.Parts, p)
+		if check != nil && r.opts.CheckSourcePerPart {
+			return check()
+		}
+		return nil
+	}
+
+	// TODO retry?
+	if err := firstError(fc.MapContext(ctx, fn)); err != nil {
+		return nil, err
+	}
+	return parts, nil
+}
+
+// uploadPart
+// (1) calls the backend server for a presigned url of the part and
+// (2) uploads it.
+// The progress is of the bytes returned by sent.
+func (r *Uploader) uploadPart(ctx context.Context, cp *Checkpoint, partNo int, reader *internal.ChunkReader, sum *internal.Checksum, sent func() int64) (types.CompleteUploadPart, error) {
+	checksum := sum.Base64(r.opts.ChecksumAlgorithm)
+	var getUploadURLResp types.GetUploadURLResponse
+	resp, err := r.c.R().
+		SetContext(ctx).
+		SetQueryParams(map[string]string{
+			"fileName":   cp.Key,
+			"partNumber": strconv.Itoa(partNo),
+			"uploadId":   cp.UploadID,
+			"md5":        sum.Base64(internal.ChecksumMD5),
+
+			"checksumAlgorithm": r.opts.ChecksumAlgorithm,
+			"checksum":          checksum,
+		}).
+		SetHeader("Accept", "application/json").
+		SetHeaders(r.sseHeaders()).
+		SetResult(&getUploadURLResp).
+		Get(types.PathGetUploadURL)
+	if err := checkResponse(OpPresign, partNo, resp, err); err != nil {
+		return types.CompleteUploadPart{}, err
+	}
+
+	presignedURL := getUploadURLResp.PresignedURL
+	r.logf("part: %v contentType: %v Presigned URL: %v", partNo, cp.ContentType, presignedURL)
+
+	// (2) Puts each file part into the storage server
+	pr := &progressReader{r: reader, total: cp.Size, sent: sent, fn: r.opts.Progress}
+	etag, err := r.putPart(ctx, presignedURL, getUploadURLResp.Headers, cp.ContentType, pr)
+	if err != nil {
+		return types.CompleteUploadPart{}, &Error{Op: OpPut, PartNumber: partNo, Err: err}
+	}
+	return types.CompleteUploadPart{
+		ETag:       etag,
+		PartNumber: int64(partNo),
+		Checksum:   checksum,
+	}, nil
+}
+
+// putPart uploads a part to the presigned url with the signed headers and returns its ETag.
+func (r *Uploader) putPart(ctx context.Context, presignedURL string, headers map[string]string, contentType string, reader *progressReader) (string, error) {
+	uploadReq, err := http.NewRequest("PUT", presignedURL, reader)
+	if err != nil {
+		return "", err
+	}
+	uploadReq = uploadReq.WithContext(ctx)
+	for k, v := range headers {
+		uploadReq.Header.Set(k, v)
+	}
+	uploadReq.Header.Set("Content-Type", contentType)
+	uploadReq.Header.Set("Accept", "application/json")
+	uploadReq.ContentLength = reader.r.Size()
+
+	r.logf("request: %v %v", uploadReq.Method, uploadReq.URL)
+	uploadResp, err := r.hc.Do(uploadReq)
+	if err != nil {
+		return "", err
+	}
+	defer uploadResp.Body.Close()
+
+	if uploadResp.StatusCode != http.StatusOK {
+		return "", &StatusError{StatusCode: uploadResp.StatusCode, Status: uploadResp.Status}
+	}
+	return uploadResp.Header.Get("ETag"), nil
+}
+
+// completeUpload calls the CompleteMultipartUpload endpoint in the backend server.
+func (r *Uploader) completeUpload(ctx context.Context, key, uploadID string, parts []types.CompleteUploadPart) (*Result, error) {
+	completeUploadReq := types.CompleteUploadRequest{
+		Params: types.CompleteUploadParams{
+			FileName: key,
+			Parts:    parts,
+			UploadID: uploadID,
+
+			ChecksumAlgorithm: r.opts.ChecksumAlgorithm,
+		},
+	}
+
+	var completeUploadResp types.CompleteUploadResponse
+	resp, err := r.c.R().
+		SetContext(ctx).
+		SetBody(completeUploadReq).
+		SetHeader("Accept", "application/json").
+		SetResult(&completeUploadResp).
+		Post(types.PathCompleteUpload)
+	if err := checkResponse(OpComplete, 0, resp, err); err != nil {
+		return nil, err
+	}
+
+	d := completeUploadResp.Data
+	return &Result{
+		Location: d.Location,
+		Bucket:   d.Bucket,
+		Key:      d.Key,
+		ETag:     d.ETag,
+	}, nil
+}
+
+// abortUpload aborts the multipart upload on the server.
+func (r *Uploader) abortUpload(ctx context.Context, key, uploadID string) error {
+	resp, err := r.c.R().
+		SetContext(ctx).
+		SetQueryParams(map[string]string{
+			"fileName": key,
+			"uploadId": uploadID,
+		}).
+		Post(types.PathAbortUpload)
+	if err != nil {
+		return &Error{Op: OpAbort, Err: err}
+	}
+	if resp.StatusCode() != http.StatusNoContent && resp.StatusCode() != http.StatusOK {
+		return checkResponse(OpAbort, 0, resp, nil)
+	}
+	return nil
+}
+
+func (r *Uploader) logf(format string, args ...interface{}) {
+	if r.opts.Logf != nil {
+		r.opts.Logf("%s", logging.RedactString(fmt.Sprintf(format, args...)))
+	}
+}
+
+// progressReader reports the bytes sent of the file after each read.
+type progressReader struct {
+	r     *internal.ChunkReader
+	total int64
+	sent  func() int64
+	fn    func(sent, total int64)
+}
+
+func (r *progressReader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if r.fn != nil && n > 0 {
+		r.fn(r.sent(), r.total)
+	}
+	return n, err
+}
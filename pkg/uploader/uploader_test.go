@@ -0,0 +1,936 @@
+package uploader
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/gostones/s3upload/internal"
+	"github.com/gostones/s3upload/internal/types"
+	"github.com/klauspost/compress/zstd"
+)
+
+// fakeServer implements the upload server API and the storage in memory.
+type fakeServer struct {
+	*httptest.Server
+
+	mu     sync.Mutex
+	start  types.StartUploadRequest
+	sums   map[string]string // checksums of the parts presigned
+	done   types.CompleteUploadParams
+	parts  map[int][]byte
+	object []byte
+	keyMD5 string // customer key MD5 of the last part
+	starts int
+	aborts int
+
+	objects   map[string][]byte // sources of the copied parts and downloads
+	sourceMD5 string            // customer key MD5 of the last copy source
+
+	described types.GetDownloadURLResponse // of the object downloaded
+	gets      int                          // range GETs
+	fail      func(gets int) bool          // fails the range GET if true
+}
+
+func newFakeServer() *fakeServer {
+	s := &fakeServer{parts: map[int][]byte{}, sums: map[string]string{}, objects: map[string][]byte{}}
+	mux := http.NewServeMux()
+	mux.HandleFunc(types.PathStartUpload, func(w http.ResponseWriter, r *http.Request) {
+		json.NewDecoder(r.Body).Decode(&s.start)
+		s.starts++
+		writeJSON(w, &types.StartUploadResponse{UploadID: "id"})
+	})
+	mux.HandleFunc(types.PathGetUploadURL, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		s.mu.Lock()
+		s.sums[q.Get("partNumber")] = q.Get("checksumAlgorithm") + " " + q.Get("checksum")
+		s.mu.Unlock()
+		u := fmt.Sprintf("%s/part?partNumber=%s", s.URL, q.Get("partNumber"))
+		// the customer key headers are signed with the url
+		var headers map[string]string
+		if v := r.Header.Get(types.HeaderSSECustomerKeyMD5); v != "" {
+			headers = map[string]string{types.HeaderSSECustomerKeyMD5: v}
+		}
+		writeJSON(w, &types.GetUploadURLResponse{PresignedURL: u, Headers: headers})
+	})
+	mux.HandleFunc("/part", func(w http.ResponseWriter, r *http.Request) {
+		n, _ := strconv.Atoi(r.URL.Query().Get("partNumber"))
+		b, _ := ioutil.ReadAll(r.Body)
+		s.mu.Lock()
+		s.parts[n] = b
+		s.keyMD5 = r.Header.Get(types.HeaderSSECustomerKeyMD5)
+		s.mu.Unlock()
+		w.Header().Set("ETag", strconv.Itoa(n))
+	})
+	mux.HandleFunc("/object", func(w http.ResponseWriter, r *http.Request) {
+		for k, v := range s.start.Metadata {
+			w.Header().Set("X-Amz-Meta-"+k, v)
+		}
+		w.Write(s.object)
+	})
+	mux.HandleFunc(types.PathCopyUploadPart, func(w http.ResponseWriter, r *http.Request) {
+		var req types.CopyUploadPartRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		b, ok := s.objects[req.Source]
+		if !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		if req.Range != "" {
+			var first, last int
+			fmt.Sscanf(req.Range, "bytes=%d-%d", &first, &last)
+			b = b[first : last+1]
+		}
+		s.parts[int(req.PartNumber)] = b
+		s.sourceMD5 = r.Header.Get(types.HeaderCopySourceSSECustomerKeyMD5)
+		writeJSON(w, &types.CopyUploadPartResponse{ETag: "copy" + strconv.FormatInt(req.PartNumber, 10)})
+	})
+	mux.HandleFunc(types.PathGetDownloadURL, func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		if _, ok := s.objects[q.Get("fileName")]; !ok {
+			http.Error(w, "no such key", http.StatusNotFound)
+			return
+		}
+		var resp types.GetDownloadURLResponse
+		if q.Get("range") == "" {
+			resp = s.described
+			resp.Size = int64(len(s.objects[q.Get("fileName")]))
+		}
+		resp.PresignedURL = s.URL + "/get?key=" + q.Get("fileName")
+		resp.Headers = map[string]string{"Range": q.Get("range"), "If-Match": q.Get("ifMatch")}
+		writeJSON(w, &resp)
+	})
+	mux.HandleFunc("/get", func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.gets++
+		fail := s.fail != nil && s.fail(s.gets)
+		b := s.objects[r.URL.Query().Get("key")]
+		s.mu.Unlock()
+		if fail {
+			http.Error(w, "slow down", http.StatusServiceUnavailable)
+			return
+		}
+		if r.Header.Get("If-Match") != s.described.ETag {
+			http.Error(w, "precondition failed", http.StatusPreconditionFailed)
+			return
+		}
+		var first, last int
+		fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last)
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(b[first : last+1])
+	})
+	mux.HandleFunc(types.PathAbortUpload, func(w http.ResponseWriter, r *http.Request) {
+		s.mu.Lock()
+		s.aborts++
+		s.parts = map[int][]byte{}
+		s.mu.Unlock()
+		writeJSON(w, struct{}{})
+	})
+	mux.HandleFunc(types.PathCompleteUpload, func(w http.ResponseWriter, r *http.Request) {
+		var req types.CompleteUploadRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		s.complete(w, req.Params)
+	})
+	mux.HandleFunc(types.PathComposeUpload, func(w http.ResponseWriter, r *http.Request) {
+		var req types.ComposeUploadRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.UploadID == "" {
+			s.start = req.Params
+			s.starts++
+		}
+		params := types.CompleteUploadParams{FileName: req.Params.FileName, UploadID: req.UploadID}
+		s.mu.Lock()
+		for i, p := range req.Parts {
+			n := i + 1
+			if p.Source == "" {
+				params.Parts = append(params.Parts, types.CompleteUploadPart{ETag: p.ETag, PartNumber: int64(n), Checksum: p.Checksum})
+				continue
+			}
+			b, ok := s.objects[p.Source]
+			if !ok {
+				// the upload started by the server is aborted
+				if req.UploadID == "" {
+					s.aborts++
+				}
+				s.parts = map[int][]byte{}
+				s.mu.Unlock()
+				http.Error(w, "no such key", http.StatusNotFound)
+				return
+			}
+			if p.Range != "" {
+				var first, last int
+				fmt.Sscanf(p.Range, "bytes=%d-%d", &first, &last)
+				b = b[first : last+1]
+			}
+			s.parts[n] = b
+			s.sourceMD5 = r.Header.Get(types.HeaderCopySourceSSECustomerKeyMD5)
+			params.Parts = append(params.Parts, types.CompleteUploadPart{ETag: "copy" + strconv.Itoa(n), PartNumber: int64(n)})
+		}
+		s.mu.Unlock()
+		s.complete(w, params)
+	})
+	s.Server = httptest.NewServer(mux)
+	return s
+}
+
+// complete creates the object from the parts.
+func (s *fakeServer) complete(w http.ResponseWriter, params types.CompleteUploadParams) {
+	s.done = params
+	parts := params.Parts
+	sort.Slice(parts, func(i, j int) bool { return parts[i].PartNumber < parts[j].PartNumber })
+	var buf bytes.Buffer
+	for _, p := range parts {
+		buf.Write(s.parts[int(p.PartNumber)])
+	}
+	s.object = buf.Bytes()
+	writeJSON(w, &types.CompleteUploadResponse{
+		Data: types.CompleteUploadData{Key: params.FileName, ETag: "etag"},
+	})
+}
+
+func writeJSON(w http.ResponseWriter, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+func TestUpload(t *testing.T) {
+	s := newFakeServer()
+	defer s.Close()
+
+	content := []byte("The quick brown fox jumps over the lazy dog")
+	var sent int64
+	u := New(Options{
+		BaseURL:   s.URL,
+		ChunkSize: 10,
+		Metadata:  map[string]string{"project": "fox"},
+		Tags:      map[string]string{"retention": "30d"},
+		Progress: func(n, total int64) {
+			sent = n
+		},
+	})
+	result, err := u.Upload(context.Background(), bytes.NewReader(content), int64(len(content)), "fox.txt")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	t.Logf("result: %+v parts: %v sent: %v", result, len(s.parts), sent)
+	if result.Key != "fox.txt" || len(s.parts) != 5 || !bytes.Equal(s.object, content) || sent != int64(len(content)) {
+		t.FailNow()
+	}
+	if s.start.FileName != "fox.txt" || s.start.FileSize != int64(len(content)) || s.start.Metadata["project"] != "fox" || s.start.Tags["retention"] != "30d" {
+		t.FailNow()
+	}
+}
+
+func TestUploadError(t *testing.T) {
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusBadGateway)
+		json.NewEncoder(w).Encode(&types.ErrorResponse{
+			Error: types.ErrorDetail{Code: "NoSuchBucket", Message: "no bucket"},
+		})
+	}))
+	defer s.Close()
+
+	u := New(Options{BaseURL: s.URL})
+	_, err := u.Upload(context.Background(), bytes.NewReader([]byte("x")), 1, "x")
+	t.Log(err)
+	e, ok := err.(*Error)
+	if !ok || e.Op != OpStart {
+		t.FailNow()
+	}
+	se, ok := e.Err.(*StatusError)
+	if !ok || se.StatusCode != http.StatusBadGateway || se.Code != "NoSuchBucket" || se.Body != "no bucket" || !se.Temporary() {
+		t.FailNow()
+	}
+}
+
+func TestUploadCancel(t *testing.T) {
+	s := newFakeServer()
+	defer s.Close()
+
+	content := []byte("The quick brown fox jumps over the lazy dog")
+	ctx, cancel := context.WithCancel(context.Background())
+	u := New(Options{
+		BaseURL:   s.URL,
+		ChunkSize: 10,
+		Progress: func(n, total int64) {
+			if n >= 15 {
+				cancel()
+			}
+		},
+	})
+	_, err := u.Upload(ctx, bytes.NewReader(content), int64(len(content)), "fox.txt")
+	t.Log(err)
+	ce, ok := err.(*CanceledError)
+	if !ok || ce.Err != context.Canceled || ce.Checkpoint == nil || len(ce.Checkpoint.Parts) != 1 {
+		t.FailNow()
+	}
+
+	// resume
+	u = New(Options{BaseURL: s.URL})
+	result, err := u.Resume(context.Background(), bytes.NewReader(content), int64(len(content)), ce.Checkpoint)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	t.Logf("result: %+v", result)
+	if !bytes.Equal(s.object, content) {
+		t.FailNow()
+	}
+}
+
+func TestUploadRequestID(t *testing.T) {
+	var mu sync.Mutex
+	ids := map[string]bool{}
+	s := newFakeServer()
+	defer s.Close()
+	h := s.Config.Handler
+	s.Config.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/part" {
+			mu.Lock()
+			ids[r.Header.Get(types.HeaderRequestID)] = true
+			mu.Unlock()
+		}
+		h.ServeHTTP(w, r)
+	})
+
+	var logs []string
+	content := []byte("The quick brown fox jumps over the lazy dog")
+	u := New(Options{
+		BaseURL:   s.URL,
+		ChunkSize: 10,
+		RequestID: "req-1",
+		Logf: func(format string, args ...interface{}) {
+			logs = append(logs, fmt.Sprintf(format, args...))
+		},
+	})
+	result, err := u.Upload(context.Background(), bytes.NewReader(content), int64(len(content)), "fox.txt")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	t.Logf("ids: %v logs: %v", ids, len(logs))
+	if result.RequestID != "req-1" || len(ids) != 1 || !ids["req-1"] || len(logs) == 0 {
+		t.FailNow()
+	}
+}
+
+func TestUploadSSECustomerKey(t *testing.T) {
+	s := newFakeServer()
+	defer s.Close()
+
+	content := []byte("The quick brown fox jumps over the lazy dog")
+	u := New(Options{BaseURL: s.URL, ChunkSize: 10, SSECustomerKey: []byte("short")})
+	if _, err := u.Upload(context.Background(), bytes.NewReader(content), int64(len(content)), "fox.txt"); err == nil {
+		t.Log("expected invalid key error")
+		t.FailNow()
+	}
+
+	key := bytes.Repeat([]byte{1}, 32)
+	u = New(Options{BaseURL: s.URL, ChunkSize: 10, SSECustomerKey: key})
+	if _, err := u.Upload(context.Background(), bytes.NewReader(content), int64(len(content)), "fox.txt"); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	expected := u.sseHeaders()[types.HeaderSSECustomerKeyMD5]
+	t.Logf("key md5: %v", s.keyMD5)
+	if s.keyMD5 == "" || s.keyMD5 != expected {
+		t.FailNow()
+	}
+}
+
+func TestUploadEncrypted(t *testing.T) {
+	s := newFakeServer()
+	defer s.Close()
+
+	content := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 5000)
+	key, _ := NewEncryptionKey(bytes.Repeat([]byte{1}, 32))
+	var sent int64
+	u := New(Options{
+		BaseURL:       s.URL,
+		ChunkSize:     100000,
+		EncryptionKey: key,
+		Metadata:      map[string]string{"project": "fox"},
+		Progress: func(n, total int64) {
+			sent = n
+		},
+	})
+	if _, err := u.Upload(context.Background(), bytes.NewReader(content), int64(len(content)), "fox.txt"); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	t.Logf("object: %v declared: %v sent: %v type: %v", len(s.object), s.start.FileSize, sent, s.start.FileType)
+	if int64(len(s.object)) != s.start.FileSize || bytes.Contains(s.object, content[:45]) || sent != int64(len(content)) {
+		t.FailNow()
+	}
+	if s.start.FileType != "application/octet-stream" || s.start.Metadata["project"] != "fox" || s.start.Metadata[EnvelopeMetaKey] == "" {
+		t.FailNow()
+	}
+
+	var plain bytes.Buffer
+	if err := u.DownloadDecrypted(context.Background(), s.URL+"/object", &plain); err != nil || !bytes.Equal(plain.Bytes(), content) {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	other, _ := NewEncryptionKey(bytes.Repeat([]byte{2}, 32))
+	u = New(Options{BaseURL: s.URL, EncryptionKey: other})
+	if err := u.DownloadDecrypted(context.Background(), s.URL+"/object", ioutil.Discard); err == nil {
+		t.Log("decrypted with the wrong key")
+		t.FailNow()
+	}
+}
+
+func TestUploadCompressed(t *testing.T) {
+	content := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 5000)
+	for _, method := range []string{CompressGzip, CompressZstd} {
+		s := newFakeServer()
+		var sent, total int64
+		u := New(Options{
+			BaseURL:     s.URL,
+			ChunkSize:   1000,
+			Compression: method,
+			Progress: func(n, t int64) {
+				sent, total = n, t
+			},
+		})
+		if _, err := u.Upload(context.Background(), bytes.NewReader(content), int64(len(content)), "fox.txt"); err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		s.Close()
+
+		var r io.Reader
+		if method == CompressGzip {
+			r, _ = gzip.NewReader(bytes.NewReader(s.object))
+		} else {
+			r, _ = zstd.NewReader(bytes.NewReader(s.object))
+		}
+		plain, err := ioutil.ReadAll(r)
+		t.Logf("%s: object: %v parts: %v sent: %v/%v error: %v", method, len(s.object), len(s.parts), sent, total, err)
+		if err != nil || !bytes.Equal(plain, content) || sent != total || total != int64(len(content)) {
+			t.FailNow()
+		}
+		if s.start.ContentEncoding != method || s.start.FileType != "text/plain; charset=utf-8" || s.start.Metadata[OriginalSizeMetaKey] != strconv.Itoa(len(content)) || len(s.start.Metadata[OriginalSHA256MetaKey]) != 64 {
+			t.Logf("start: %+v", s.start)
+			t.FailNow()
+		}
+	}
+}
+
+func TestUploadChecksum(t *testing.T) {
+	s := newFakeServer()
+	defer s.Close()
+
+	content := []byte("The quick brown fox jumps over the lazy dog")
+	u := New(Options{
+		BaseURL:           s.URL,
+		ChunkSize:         10,
+		ChecksumAlgorithm: internal.ChecksumSHA256,
+		Checksums:         []string{internal.ChecksumSHA256, internal.ChecksumCRC32C},
+	})
+	if _, err := u.Upload(context.Background(), bytes.NewReader(content), int64(len(content)), "fox.txt"); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	t.Logf("start: %+v sums: %v", s.start, s.sums)
+	if s.start.ChecksumAlgorithm != "SHA256" || s.done.ChecksumAlgorithm != "SHA256" {
+		t.FailNow()
+	}
+	if s.start.Metadata["s3upload-sha256"] != "d7a8fbb307d7809469ca9abcb0082e4f8d5651e46d3cdb762d02d0bf37c9e592" || s.start.Metadata["s3upload-crc32c"] != "22620404" {
+		t.FailNow()
+	}
+	// SHA-256 of the first part "The quick "
+	if s.sums["1"] != "SHA256 GpABHVoXy9cC6knN3SgZBDnf7sFxDg7+UjFeA070Sbw=" || len(s.done.Parts) != 5 {
+		t.FailNow()
+	}
+	for _, p := range s.done.Parts {
+		if "SHA256 "+p.Checksum != s.sums[strconv.Itoa(int(p.PartNumber))] {
+			t.Logf("part: %+v", p)
+			t.FailNow()
+		}
+	}
+}
+
+func TestUploadDigestWorkers(t *testing.T) {
+	s := newFakeServer()
+	defer s.Close()
+
+	content := []byte("The quick brown fox jumps over the lazy dog")
+	u := New(Options{
+		BaseURL:       s.URL,
+		ChunkSize:     10,
+		Checksums:     []string{internal.ChecksumMD5, internal.ChecksumCRC32C},
+		DigestWorkers: 2,
+	})
+	if _, err := u.Upload(context.Background(), bytes.NewReader(content), int64(len(content)), "fox.txt"); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	t.Logf("metadata: %v", s.start.Metadata)
+	// the CRC32C is of the whole file, the MD5 is the ETag of the 5 parts
+	if s.start.Metadata["s3upload-crc32c"] != "22620404" || !strings.HasSuffix(s.start.Metadata["s3upload-md5"], "-5") {
+		t.FailNow()
+	}
+}
+
+func TestUploadReadMode(t *testing.T) {
+	content := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 5000)
+	f, err := ioutil.TempFile("", "fox")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.Remove(f.Name())
+	f.Write(content)
+	f.Close()
+
+	for _, mode := range []string{ReadModeMmap, ReadModeReadahead} {
+		s := newFakeServer()
+		u := New(Options{
+			BaseURL:   s.URL,
+			ChunkSize: 100000,
+			ReadMode:  mode,
+		})
+		_, err := u.UploadFile(context.Background(), f.Name(), "fox.txt")
+		s.Close()
+		t.Logf("%s: object: %v parts: %v error: %v", mode, len(s.object), len(s.parts), err)
+		if err != nil || !bytes.Equal(s.object, content) || len(s.parts) != 3 {
+			t.FailNow()
+		}
+	}
+}
+
+func TestUploadMmapUnsafe(t *testing.T) {
+	f, err := ioutil.TempFile("", "fox")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("The quick brown fox jumps over the lazy dog.")
+	f.Close()
+
+	for _, opts := range []Options{
+		{ReadMode: ReadModeMmap, CheckSourcePerPart: true},
+		{ReadMode: ReadModeMmap, SourceRestarts: 1},
+	} {
+		s := newFakeServer()
+		opts.BaseURL = s.URL
+		opts.ChunkSize = 100000
+		u := New(opts)
+		_, err := u.UploadFile(context.Background(), f.Name(), "fox.txt")
+		_, rerr := u.UploadRanges(context.Background(), "fox.txt", Range{Filename: f.Name(), Length: -1})
+		s.Close()
+		t.Logf("file: %v ranges: %v", err, rerr)
+		if err == nil || rerr == nil || len(s.parts) != 0 {
+			t.FailNow()
+		}
+	}
+}
+
+func TestUploadSourceModified(t *testing.T) {
+	content := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 5000)
+	f, err := ioutil.TempFile("", "fox")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.Remove(f.Name())
+	f.Write(content)
+	f.Close()
+
+	// the file is appended to while the first part is uploaded
+	var appended int
+	appendOnce := func(sent, total int64) {
+		if appended > 0 {
+			return
+		}
+		appended++
+		af, _ := os.OpenFile(f.Name(), os.O_WRONLY|os.O_APPEND, 0)
+		af.Write([]byte("appended"))
+		af.Close()
+	}
+
+	for _, perPart := range []bool{false, true} {
+		s := newFakeServer()
+		appended = 0
+		ioutil.WriteFile(f.Name(), content, 0600)
+		u := New(Options{
+			BaseURL:            s.URL,
+			ChunkSize:          100000,
+			Progress:           appendOnce,
+			CheckSourcePerPart: perPart,
+		})
+		_, err := u.UploadFile(context.Background(), f.Name(), "fox.txt")
+		s.Close()
+		me, ok := err.(*SourceModifiedError)
+		t.Logf("per part: %v error: %v parts: %v aborts: %v", perPart, err, len(s.done.Parts), s.aborts)
+		if !ok || me.Replaced || s.aborts != 1 || len(s.done.Parts) != 0 {
+			t.FailNow()
+		}
+	}
+
+	// restarted with the appended content
+	s := newFakeServer()
+	defer s.Close()
+	appended = 0
+	ioutil.WriteFile(f.Name(), content, 0600)
+	u := New(Options{
+		BaseURL:        s.URL,
+		ChunkSize:      100000,
+		Progress:       appendOnce,
+		SourceRestarts: 1,
+	})
+	if _, err := u.UploadFile(context.Background(), f.Name(), "fox.txt"); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	t.Logf("starts: %v aborts: %v object: %v", s.starts, s.aborts, len(s.object))
+	if s.starts != 2 || s.aborts != 1 || !bytes.Equal(s.object, append(content, "appended"...)) {
+		t.FailNow()
+	}
+}
+
+func TestUploadRanges(t *testing.T) {
+	image := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 5000)
+	layer := bytes.Repeat([]byte("Pack my box with five dozen liquor jugs. "), 3000)
+	var names []string
+	for _, content := range [][]byte{image, layer} {
+		f, err := ioutil.TempFile("", "range")
+		if err != nil {
+			t.Log(err)
+			t.FailNow()
+		}
+		defer os.Remove(f.Name())
+		f.Write(content)
+		f.Close()
+		names = append(names, f.Name())
+	}
+	ranges := []Range{
+		{Filename: names[0], Offset: 4500, Length: 100000},
+		{Filename: names[1], Offset: 0, Length: -1},
+		{Filename: names[0], Offset: 0, Length: 45},
+	}
+	expected := append(append(append([]byte{}, image[4500:104500]...), layer...), image[:45]...)
+
+	for _, mode := range []string{ReadModeReadAt, ReadModeMmap, ReadModeReadahead} {
+		s := newFakeServer()
+		u := New(Options{
+			BaseURL:   s.URL,
+			ChunkSize: 60000,
+			ReadMode:  mode,
+			Checksums: []string{internal.ChecksumSHA256},
+		})
+		_, err := u.UploadRanges(context.Background(), "segments", ranges...)
+		s.Close()
+		t.Logf("%q: object: %v parts: %v error: %v", mode, len(s.object), len(s.parts), err)
+		sum := sha256.Sum256(expected)
+		if err != nil || !bytes.Equal(s.object, expected) || s.start.FileSize != int64(len(expected)) || s.start.Metadata["s3upload-sha256"] != hex.EncodeToString(sum[:]) {
+			t.FailNow()
+		}
+	}
+
+	s := newFakeServer()
+	defer s.Close()
+	u := New(Options{BaseURL: s.URL})
+	if _, err := u.UploadRanges(context.Background(), "segments", Range{Filename: names[1], Offset: 1, Length: int64(len(layer))}); err == nil {
+		t.Log("range past the end of the file")
+		t.FailNow()
+	}
+}
+
+func TestCompose(t *testing.T) {
+	s := newFakeServer()
+	defer s.Close()
+	// all parts but the last are at least 5 MiB
+	intro := bytes.Repeat([]byte("The quick brown "), minPartSize/16)
+	middle := bytes.Repeat([]byte("fox jumps "), minPartSize/10)
+	s.objects["intro.ts"] = intro
+	s.objects["middle.ts"] = append(append([]byte("--"), middle...), "--"...)
+
+	f, err := ioutil.TempFile("", "compose")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("##over the lazy dog")
+	f.Close()
+
+	key := bytes.Repeat([]byte{7}, 32)
+	u := New(Options{BaseURL: s.URL, ContentType: "video/mp2t"})
+	result, err := u.Compose(context.Background(), "movie.ts",
+		ComposePart{Source: "intro.ts", Length: -1, SourceSSECustomerKey: key},
+		ComposePart{Source: "middle.ts", Offset: 2, Length: minPartSize, SourceSSECustomerKey: key},
+		ComposePart{File: &Range{Filename: f.Name(), Offset: 2, Length: -1}},
+	)
+	t.Logf("result: %+v object: %v bytes parts: %+v", result, len(s.object), s.done.Parts)
+	expected := append(append(append([]byte{}, intro...), middle...), "over the lazy dog"...)
+	if err != nil || !bytes.Equal(s.object, expected) || len(s.done.Parts) != 3 {
+		t.FailNow()
+	}
+	if s.done.Parts[0].ETag != "copy1" || s.done.Parts[2].ETag != "3" || s.sourceMD5 == "" || s.start.FileType != "video/mp2t" || s.starts != 1 {
+		t.FailNow()
+	}
+
+	// the server starts the upload of the sources and aborts it if a copy fails
+	_, err = u.Compose(context.Background(), "movie.ts", ComposePart{Source: "missing.ts", Length: 1})
+	t.Logf("error: %v starts: %v aborts: %v", err, s.starts, s.aborts)
+	if e, ok := err.(*Error); !ok || e.Op != OpCompose || s.starts != 2 || s.aborts != 1 {
+		t.FailNow()
+	}
+
+	// the client aborts the upload of its parts
+	_, err = u.Compose(context.Background(), "movie.ts",
+		ComposePart{Source: "missing.ts", Length: minPartSize},
+		ComposePart{File: &Range{Filename: f.Name(), Length: -1}},
+	)
+	t.Logf("error: %v starts: %v aborts: %v", err, s.starts, s.aborts)
+	if e, ok := err.(*Error); !ok || e.Op != OpCompose || s.starts != 3 || s.aborts != 2 {
+		t.FailNow()
+	}
+
+	if _, err := u.Compose(context.Background(), "movie.ts", ComposePart{Source: "intro.ts", Offset: 2}); err == nil {
+		t.Log("offset without a length")
+		t.FailNow()
+	}
+	if _, err := u.Compose(context.Background(), "movie.ts",
+		ComposePart{Source: "intro.ts", Length: -1, SourceSSECustomerKey: key},
+		ComposePart{Source: "middle.ts", Length: -1},
+	); err == nil {
+		t.Log("sources with different customer keys")
+		t.FailNow()
+	}
+}
+
+func TestComposeInvalidSize(t *testing.T) {
+	s := newFakeServer()
+	defer s.Close()
+	empty, err := ioutil.TempFile("", "compose")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.Remove(empty.Name())
+	empty.Close()
+	// sparse, nothing is read
+	large, err := ioutil.TempFile("", "compose")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.Remove(large.Name())
+	if err := large.Truncate(maxPartSize + 1); err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	large.Close()
+
+	s.objects["intro.ts"] = []byte("The quick brown ")
+	small := ComposePart{Source: "intro.ts", Length: 16}
+	tests := []struct {
+		name  string
+		parts []ComposePart
+	}{
+		{"empty source range", []ComposePart{{Source: "intro.ts"}}},
+		{"rest of a source", []ComposePart{{Source: "intro.ts", Offset: 2, Length: -1}}},
+		{"source range over 5 GiB", []ComposePart{{Source: "intro.ts", Length: maxPartSize + 1}}},
+		{"empty file range", []ComposePart{{File: &Range{Filename: large.Name(), Length: 0}}}},
+		{"empty file", []ComposePart{{File: &Range{Filename: empty.Name(), Length: -1}}}},
+		{"file over 5 GiB", []ComposePart{{File: &Range{Filename: large.Name(), Length: -1}}}},
+		{"source range under 5 MiB", []ComposePart{small, small}},
+		{"source under 5 MiB", []ComposePart{{Source: "intro.ts", Length: -1}, small}},
+		{"missing source", []ComposePart{{Source: "missing.ts", Length: -1}}},
+	}
+	u := New(Options{BaseURL: s.URL})
+	for _, test := range tests {
+		_, err := u.Compose(context.Background(), "movie.ts", test.parts...)
+		t.Logf("%s: %v", test.name, err)
+		if err == nil {
+			t.FailNow()
+		}
+	}
+	// rejected before starting the upload
+	if s.starts != 0 {
+		t.FailNow()
+	}
+}
+
+func TestDownload(t *testing.T) {
+	content := bytes.Repeat([]byte("The quick brown fox jumps over the lazy dog. "), 2000)
+	fc := internal.NewReaderChunk(bytes.NewReader(content), int64(len(content)), "fox.txt", 10000)
+	etag, err := fc.Digest(1, internal.ChecksumMD5)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	sum, err := internal.ChecksumOf(bytes.NewReader(content), internal.ChecksumSHA256, internal.ChecksumCRC32C)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+
+	s := newFakeServer()
+	defer s.Close()
+	s.objects["fox.txt"] = content
+	s.described = types.GetDownloadURLResponse{
+		Size:      int64(len(content)),
+		ETag:      `"` + etag[0].Hex() + `"`,
+		PartSizes: []int64{10000, 10000, 10000, 10000, 10000, 10000, 10000, 10000, 10000},
+		Checksums: map[string]string{internal.ChecksumCRC32C: sum.Base64(internal.ChecksumCRC32C)},
+		Metadata:  map[string]string{DigestMetaKey(internal.ChecksumSHA256): sum.Hex(internal.ChecksumSHA256)},
+	}
+	dir, err := ioutil.TempDir("", "download")
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	defer os.RemoveAll(dir)
+	filename := dir + "/fox.txt"
+
+	// transient failures are retried
+	s.fail = func(gets int) bool { return gets == 2 }
+	var sent int64
+	var mu sync.Mutex
+	u := New(Options{
+		BaseURL:         s.URL,
+		ChunkSize:       10000,
+		DownloadWorkers: 3,
+		DownloadRetries: 2,
+		Progress: func(n, total int64) {
+			mu.Lock()
+			sent = n
+			mu.Unlock()
+		},
+	})
+	result, err := u.Download(context.Background(), "fox.txt", filename)
+	b, _ := ioutil.ReadFile(filename)
+	t.Logf("result: %+v gets: %v sent: %v error: %v", result, s.gets, sent, err)
+	if err != nil || !bytes.Equal(b, content) || sent != int64(len(content)) {
+		t.FailNow()
+	}
+	if _, err := os.Stat(filename + JournalSuffix); !os.IsNotExist(err) {
+		t.Log("journal not removed")
+		t.FailNow()
+	}
+
+	// an interrupted download resumes with the missing ranges
+	ioutil.WriteFile(filename, nil, 0666)
+	s.gets = 0
+	s.fail = func(gets int) bool { return gets > 4 }
+	u = New(Options{BaseURL: s.URL, ChunkSize: 10000, DownloadWorkers: 1})
+	_, err = u.Download(context.Background(), "fox.txt", filename)
+	t.Logf("interrupted: %v", err)
+	if e, ok := err.(*Error); !ok || e.Op != OpGet {
+		t.FailNow()
+	}
+	s.gets = 0
+	s.fail = nil
+	_, err = u.Download(context.Background(), "fox.txt", filename)
+	b, _ = ioutil.ReadFile(filename)
+	t.Logf("resumed gets: %v error: %v", s.gets, err)
+	if err != nil || !bytes.Equal(b, content) || s.gets != 9-4 {
+		t.FailNow()
+	}
+
+	// the journal of a deleted file is not trusted
+	s.gets = 0
+	s.fail = func(gets int) bool { return gets > 4 }
+	u.Download(context.Background(), "fox.txt", filename)
+	os.Remove(filename)
+	s.gets = 0
+	s.fail = nil
+	_, err = u.Download(context.Background(), "fox.txt", filename)
+	b, _ = ioutil.ReadFile(filename)
+	t.Logf("deleted gets: %v error: %v", s.gets, err)
+	if err != nil || !bytes.Equal(b, content) || s.gets != 9 {
+		t.FailNow()
+	}
+
+	// the composite ETag is verified with the part sizes of the object, the
+	// chunks are as many but larger
+	described := s.described
+	s.described.ETag = `"` + etag[0].Hex()[:32] + `-9"`
+	u = New(Options{BaseURL: s.URL, ChunkSize: 11000})
+	_, err = u.Download(context.Background(), "fox.txt", filename)
+	t.Logf("chunk size %v: %v", 11000, err)
+	if err != nil {
+		t.FailNow()
+	}
+	// uneven parts of a composed object, as many as the chunks of ChunkSize
+	uneven := []int64{10000, 4000, 16000, 10000, 10000, 10000, 10000, 10000, 10000}
+	_, parts, err := internal.ChecksumParts(bytes.NewReader(content), uneven, internal.ChecksumMD5, internal.ChecksumSHA256)
+	if err != nil {
+		t.Log(err)
+		t.FailNow()
+	}
+	composite := func(alg string) []byte {
+		h, _ := internal.NewHash(alg)
+		for _, p := range parts {
+			h.Write(p.Sum(alg))
+		}
+		return h.Sum(nil)
+	}
+	s.described.ETag = `"` + hex.EncodeToString(composite(internal.ChecksumMD5)) + `-9"`
+	s.described.Checksums = map[string]string{internal.ChecksumSHA256: base64.StdEncoding.EncodeToString(composite(internal.ChecksumSHA256)) + "-9"}
+	s.described.PartSizes = uneven
+	u = New(Options{BaseURL: s.URL, ChunkSize: 10000})
+	_, err = u.Download(context.Background(), "fox.txt", filename)
+	t.Logf("uneven parts: %v", err)
+	if err != nil {
+		t.FailNow()
+	}
+	// and they are not the chunks
+	s.described.PartSizes = described.PartSizes
+	_, err = u.Download(context.Background(), "fox.txt", filename)
+	t.Logf("even parts: %v", err)
+	if e, ok := err.(*DigestMismatchError); !ok || e.Digest != "ETag" {
+		t.FailNow()
+	}
+	// not verified if the part sizes are unknown
+	s.described.PartSizes = nil
+	_, err = u.Download(context.Background(), "fox.txt", filename)
+	t.Logf("part sizes unknown: %v", err)
+	if err != nil {
+		t.FailNow()
+	}
+	s.described = described
+
+	// the content is verified
+	s.described.Metadata[DigestMetaKey(internal.ChecksumSHA256)] = hex.EncodeToString(make([]byte, 32))
+	_, err = u.Download(context.Background(), "fox.txt", filename)
+	t.Logf("mismatch: %v", err)
+	if e, ok := err.(*DigestMismatchError); !ok || e.Digest != DigestMetaKey(internal.ChecksumSHA256) {
+		t.FailNow()
+	}
+}